@@ -0,0 +1,136 @@
+package vmess
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const AccessCloseNormal = "normal"
+
+// AccessRecord describes one accepted request, emitted once its handler returns.
+type AccessRecord struct {
+	Start        time.Time
+	Duration     time.Duration
+	User         string
+	Source       string
+	Destination  string
+	Command      byte
+	Security     byte
+	BytesRead    uint64
+	BytesWritten uint64
+	CloseReason  string
+}
+
+type AccessLogger interface {
+	LogAccess(record AccessRecord)
+}
+
+type AccessLoggerFunc func(record AccessRecord)
+
+func (f AccessLoggerFunc) LogAccess(record AccessRecord) {
+	f(record)
+}
+
+type AccessLogPrivacy struct {
+	HashUsers      bool
+	HashKey        []byte
+	SourceIPv4Bits int
+	SourceIPv6Bits int
+}
+
+type JSONAccessLogger struct {
+	access  sync.Mutex
+	encoder *json.Encoder
+	err     error
+}
+
+func NewJSONAccessLogger(writer io.Writer) *JSONAccessLogger {
+	return &JSONAccessLogger{encoder: json.NewEncoder(writer)}
+}
+
+func (l *JSONAccessLogger) LogAccess(record AccessRecord) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.err == nil {
+		l.err = l.encoder.Encode(record)
+	}
+}
+
+func (l *JSONAccessLogger) Err() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	return l.err
+}
+
+type accessLog struct {
+	logger  AccessLogger
+	privacy AccessLogPrivacy
+}
+
+func newAccessLog(logger AccessLogger, privacy AccessLogPrivacy) *accessLog {
+	if privacy.HashUsers && len(privacy.HashKey) == 0 {
+		privacy.HashKey = make([]byte, 32)
+		common.Must1(io.ReadFull(rand.Reader, privacy.HashKey))
+	}
+	return &accessLog{logger, privacy}
+}
+
+func (l *accessLog) log(start time.Time, user any, source M.Socksaddr, destination M.Socksaddr, command byte, security byte, stats *connStats, err error) {
+	counters := stats.snapshot(command, security, 0)
+	record := AccessRecord{
+		Start:        start,
+		Duration:     time.Since(start),
+		User:         l.formatUser(user),
+		Source:       l.formatSource(source),
+		Destination:  destination.String(),
+		Command:      command,
+		Security:     security,
+		BytesRead:    counters.BytesRead,
+		BytesWritten: counters.BytesWritten,
+		CloseReason:  AccessCloseNormal,
+	}
+	if err != nil && !E.IsClosedOrCanceled(err) {
+		record.CloseReason = err.Error()
+	}
+	l.logger.LogAccess(record)
+}
+
+func (l *accessLog) formatUser(user any) string {
+	name := fmt.Sprint(user)
+	if !l.privacy.HashUsers {
+		return name
+	}
+	userHash := hmac.New(sha256.New, l.privacy.HashKey)
+	common.Must1(userHash.Write([]byte(name)))
+	return hex.EncodeToString(userHash.Sum(nil)[:8])
+}
+
+func (l *accessLog) formatSource(source M.Socksaddr) string {
+	if !source.IsIP() {
+		return source.String()
+	}
+	address := source.Addr.Unmap()
+	bits := l.privacy.SourceIPv6Bits
+	if address.Is4() {
+		bits = l.privacy.SourceIPv4Bits
+	}
+	if bits <= 0 || bits >= address.BitLen() {
+		return source.String()
+	}
+	prefix, err := address.Prefix(bits)
+	if err != nil {
+		return source.String()
+	}
+	return prefix.String()
+}
@@ -5,16 +5,58 @@ import (
 	"encoding/binary"
 	"io"
 
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
 	N "github.com/sagernet/sing/common/network"
 )
 
+var ErrNonceExhausted = E.New("vmess: chunk nonce exhausted")
+
+// ReaderWithNonceLimit fails the stream with ErrNonceExhausted instead of
+// reusing the 16-bit chunk nonce once it wraps. Streams that negotiated
+// RequestOptionRekey switch keys instead and are not affected.
+func ReaderWithNonceLimit() ReaderOption {
+	return func(options *readerOptions) {
+		options.nonceLimit = true
+	}
+}
+
+// WriterWithNonceLimit is the writer counterpart of ReaderWithNonceLimit.
+func WriterWithNonceLimit() WriterOption {
+	return func(options *writerOptions) {
+		options.nonceLimit = true
+	}
+}
+
+func setNonceLimit(chain any) {
+	walkUpstream(chain, func(layer any) bool {
+		switch layer := layer.(type) {
+		case *AEADReader:
+			layer.nonceLimit = true
+		case *AEADWriter:
+			layer.nonceLimit = true
+		case *AEADChunkReader:
+			layer.nonceLimit = true
+		case *AEADChunkWriter:
+			layer.nonceLimit = true
+		case *statsReader, *statsWriter:
+			return false
+		}
+		return true
+	})
+}
+
 type AEADReader struct {
 	upstream   N.ExtendedReader
 	cipher     cipher.AEAD
 	nonce      []byte
 	nonceCount uint16
+	chunkIndex uint64
+	rekey      *aeadRekey
+	nonceLimit bool
+	stats      *connStats
 }
 
 func NewAEADReader(upstream io.Reader, cipher cipher.AEAD, nonce []byte) *AEADReader {
@@ -35,18 +77,118 @@ func NewChacha20Poly1305Reader(upstream io.Reader, key []byte, nonce []byte) *AE
 	return NewAEADReader(upstream, newChacha20Poly1305(GenerateChacha20Poly1305Key(key)), nonce)
 }
 
+// requestReservedRekeyShift places log2 of the rekey interval in the upper reserved nibble, zero rekeys at nonce wrap.
+const requestReservedRekeyShift = 4
+
+// ReaderWithRekeyInterval rekeys every chunks chunks instead of at nonce wrap when RequestOptionRekey is set.
+// The interval is rounded down to a power of two, from 2 up to 32768 chunks.
+func ReaderWithRekeyInterval(chunks int) ReaderOption {
+	return func(options *readerOptions) {
+		options.rekeyShift = rekeyIntervalShift(chunks)
+	}
+}
+
+// WriterWithRekeyInterval is the writer counterpart of ReaderWithRekeyInterval.
+func WriterWithRekeyInterval(chunks int) WriterOption {
+	return func(options *writerOptions) {
+		options.rekeyShift = rekeyIntervalShift(chunks)
+	}
+}
+
+func rekeyIntervalShift(chunks int) byte {
+	if chunks >= 1<<16 {
+		return 0
+	}
+	shift := byte(1)
+	for 1<<(shift+1) <= chunks {
+		shift++
+	}
+	return shift
+}
+
+func setRekeyShift(chain any, shift byte) {
+	walkUpstream(chain, func(layer any) bool {
+		var rekey *aeadRekey
+		switch layer := layer.(type) {
+		case *AEADReader:
+			rekey = layer.rekey
+		case *AEADWriter:
+			rekey = layer.rekey
+		case *AEADChunkReader:
+			rekey = layer.rekey
+		case *AEADChunkWriter:
+			rekey = layer.rekey
+		case *statsReader, *statsWriter:
+			return false
+		}
+		if rekey != nil {
+			rekey.shift = shift
+		}
+		return true
+	})
+}
+
+type aeadRekey struct {
+	key       []byte
+	newCipher func(key []byte) cipher.AEAD
+	shift     byte
+}
+
+func newAes128GcmRekey(key []byte) *aeadRekey {
+	return &aeadRekey{key: key, newCipher: newAesGcm}
+}
+
+func newChacha20Poly1305Rekey(key []byte) *aeadRekey {
+	return &aeadRekey{key: key, newCipher: newChacha20Poly1305FromKey}
+}
+
+func (k *aeadRekey) due(nonceCount uint16) bool {
+	if k.shift == 0 {
+		return nonceCount == 0
+	}
+	return nonceCount&(1<<k.shift-1) == 0
+}
+
+func (k *aeadRekey) next() cipher.AEAD {
+	k.key = KDF(k.key, KDFSaltConstVMessPayloadRekey)[:16]
+	return k.newCipher(k.key)
+}
+
+func (r *AEADReader) nextNonce() error {
+	if r.nonceLimit && r.nonceCount == 0 && r.chunkIndex > 0 && r.rekey == nil {
+		return ErrNonceExhausted
+	}
+	binary.BigEndian.PutUint16(r.nonce, r.nonceCount)
+	r.nonceCount += 1
+	r.chunkIndex += 1
+	return nil
+}
+
+func (r *AEADReader) chunkDone() {
+	if r.rekey != nil && r.rekey.due(r.nonceCount) {
+		r.cipher = r.rekey.next()
+	}
+}
+
 func (r *AEADReader) Read(p []byte) (n int, err error) {
 	n, err = r.upstream.Read(p)
 	if err != nil {
 		return
 	}
-	binary.BigEndian.PutUint16(r.nonce, r.nonceCount)
-	r.nonceCount += 1
+	err = r.nextNonce()
+	if err != nil {
+		return 0, err
+	}
 	_, err = r.cipher.Open(p[:0], r.nonce, p[:n], nil)
+	r.chunkDone()
 	if err != nil {
-		return
+		r.stats.chunkDecryptFailed()
+		return 0, &ErrChunkDecrypt{r.chunkIndex - 1, err}
 	}
 	n -= CipherOverhead
+	if n == 0 {
+		err = io.EOF
+	}
 	return
 }
 
@@ -55,13 +197,20 @@ func (r *AEADReader) ReadBuffer(buffer *buf.Buffer) error {
 	if err != nil {
 		return err
 	}
-	binary.BigEndian.PutUint16(r.nonce, r.nonceCount)
-	r.nonceCount += 1
-	_, err = r.cipher.Open(buffer.Index(0), r.nonce, buffer.Bytes(), nil)
+	err = r.nextNonce()
 	if err != nil {
 		return err
 	}
+	_, err = r.cipher.Open(buffer.Index(0), r.nonce, buffer.Bytes(), nil)
+	r.chunkDone()
+	if err != nil {
+		r.stats.chunkDecryptFailed()
+		return &ErrChunkDecrypt{r.chunkIndex - 1, err}
+	}
 	buffer.Truncate(buffer.Len() - CipherOverhead)
+	if buffer.IsEmpty() {
+		return io.EOF
+	}
 	return nil
 }
 
@@ -74,16 +223,22 @@ type AEADWriter struct {
 	cipher     cipher.AEAD
 	nonce      []byte
 	nonceCount uint16
+	rekey      *aeadRekey
+	nonceLimit bool
+	exhausted  bool
+	headroom   headroom
 }
 
 func NewAEADWriter(upstream io.Writer, cipher cipher.AEAD, nonce []byte) *AEADWriter {
 	writeNonce := make([]byte, cipher.NonceSize())
 	copy(writeNonce, nonce)
-	return &AEADWriter{
+	writer := &AEADWriter{
 		upstream: bufio.NewExtendedWriter(upstream),
 		cipher:   cipher,
 		nonce:    writeNonce,
 	}
+	writer.headroom = headroomOf(writer)
+	return writer
 }
 
 func NewAes128GcmWriter(upstream io.Writer, key []byte, nonce []byte) *AEADWriter {
@@ -95,28 +250,32 @@ func NewChacha20Poly1305Writer(upstream io.Writer, key []byte, nonce []byte) *AE
 }
 
 func (w *AEADWriter) Write(p []byte) (n int, err error) {
-	// TODO: fix stack buffer
-	return bufio.WriteBuffer(w, buf.As(p))
-	/*_buffer := buf.StackNewSize(len(p) + CipherOverhead)
-	defer common.KeepAlive(_buffer)
-	buffer := _buffer
-	defer buffer.Release()
-	binary.BigEndian.PutUint16(w.nonce, w.nonceCount)
-	w.nonceCount += 1
-	w.cipher.Seal(buffer.Index(0), w.nonce, p, nil)
-	buffer.Truncate(buffer.FreeLen())
-	_, err = w.upstream.Write(buffer.Bytes())
-	if err == nil {
-		n = len(p)
+	buffer := w.headroom.newBuffer(len(p))
+	common.Must1(buffer.Write(p))
+	err = w.WriteBuffer(buffer)
+	if err != nil {
+		return
 	}
-	return*/
+	return len(p), nil
 }
 
 func (w *AEADWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if w.exhausted {
+		buffer.Release()
+		return ErrNonceExhausted
+	}
+	buffer = w.headroom.ensure(buffer)
 	binary.BigEndian.PutUint16(w.nonce, w.nonceCount)
 	w.nonceCount += 1
 	w.cipher.Seal(buffer.Index(0), w.nonce, buffer.Bytes(), nil)
 	buffer.Extend(CipherOverhead)
+	if w.rekey != nil {
+		if w.rekey.due(w.nonceCount) {
+			w.cipher = w.rekey.next()
+		}
+	} else if w.nonceCount == 0 && w.nonceLimit {
+		w.exhausted = true
+	}
 	return w.upstream.WriteBuffer(buffer)
 }
 
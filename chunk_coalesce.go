@@ -0,0 +1,161 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+)
+
+type WriterOption func(options *writerOptions)
+
+type writerOptions struct {
+	coalesceDelay    time.Duration
+	uniformChunkSize int
+	commandKey       []byte
+	faultInjector    FaultInjector
+	chunkSize        int
+	nonceLimit       bool
+	rekeyShift       byte
+}
+
+func WriterWithCoalescing(delay time.Duration) WriterOption {
+	return func(options *writerOptions) {
+		options.coalesceDelay = delay
+	}
+}
+
+func newWriterOptions(options []WriterOption) writerOptions {
+	var writerOptions writerOptions
+	for _, option := range options {
+		option(&writerOptions)
+	}
+	return writerOptions
+}
+
+func (o writerOptions) apply(writer io.Writer) io.Writer {
+	if o.coalesceDelay > 0 {
+		coalescingWriter := NewCoalescingWriter(writer, o.coalesceDelay)
+		if o.chunkSize > 0 {
+			coalescingWriter.size = o.chunkSize
+		}
+		writer = coalescingWriter
+	}
+	return writer
+}
+
+type CoalescingWriter struct {
+	upstream io.Writer
+	delay    time.Duration
+	size     int
+	access   sync.Mutex
+	buffer   *buf.Buffer
+	timer    *time.Timer
+	err      error
+}
+
+func NewCoalescingWriter(upstream io.Writer, delay time.Duration) *CoalescingWriter {
+	return &CoalescingWriter{
+		upstream: upstream,
+		delay:    delay,
+		size:     WriteChunkSize,
+	}
+}
+
+func (w *CoalescingWriter) Write(p []byte) (n int, err error) {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.buffer == nil {
+		w.buffer = buf.NewSize(w.size)
+	}
+	if len(p) > w.buffer.FreeLen() {
+		err = w.flush()
+		if err != nil {
+			return
+		}
+		if len(p) >= w.buffer.FreeLen() {
+			return w.upstream.Write(p)
+		}
+	}
+	n = common.Must1(w.buffer.Write(p))
+	if w.buffer.FreeLen() == 0 {
+		err = w.flush()
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, w.flushAsync)
+	}
+	return
+}
+
+func (w *CoalescingWriter) WriteBuffer(buffer *buf.Buffer) error {
+	defer buffer.Release()
+	return common.Error(w.Write(buffer.Bytes()))
+}
+
+func (w *CoalescingWriter) flushAsync() {
+	w.access.Lock()
+	defer w.access.Unlock()
+	w.timer = nil
+	if w.err == nil {
+		w.err = w.flush()
+	}
+}
+
+func (w *CoalescingWriter) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.buffer == nil || w.buffer.IsEmpty() {
+		return nil
+	}
+	_, err := w.upstream.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+func (w *CoalescingWriter) Flush() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flush()
+}
+
+func (w *CoalescingWriter) Close() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	var err error
+	if w.err == nil {
+		err = w.flush()
+		w.err = io.ErrClosedPipe
+	}
+	if w.buffer != nil {
+		w.buffer.Release()
+		w.buffer = nil
+	}
+	return err
+}
+
+func (w *CoalescingWriter) Upstream() any {
+	return w.upstream
+}
+
+func flushCoalescingWriter(writer any) error {
+	if coalescingWriter, isCoalescing := writer.(*CoalescingWriter); isCoalescing {
+		return coalescingWriter.Flush()
+	}
+	return nil
+}
+
+func closeCoalescingWriter(writer any) error {
+	if coalescingWriter, isCoalescing := writer.(*CoalescingWriter); isCoalescing {
+		return coalescingWriter.Close()
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package vmess
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ChunkCodec frames must be unframed in the order they were framed, and none may be lost.
+type ChunkCodec struct {
+	chunkMasking  *shakeMask
+	globalPadding *shakeMask
+	paddingPolicy PaddingPolicy
+	hashAccess    sync.Mutex
+}
+
+func NewChunkCodec(chunkMasking sha3.ShakeHash, globalPadding sha3.ShakeHash) *ChunkCodec {
+	codec := &ChunkCodec{}
+	codec.chunkMasking, codec.globalPadding = newShakeMasks(chunkMasking, globalPadding)
+	return codec
+}
+
+func NewChunkCodecFromNonce(nonce []byte, option byte) *ChunkCodec {
+	var globalPadding sha3.ShakeHash
+	if option&RequestOptionGlobalPadding != 0 {
+		globalPadding = sha3.NewShake128()
+		common.Must1(globalPadding.Write(nonce))
+	}
+	var chunkMasking sha3.ShakeHash
+	if option&RequestOptionChunkMasking != 0 {
+		if globalPadding != nil {
+			chunkMasking = globalPadding
+		} else {
+			chunkMasking = sha3.NewShake128()
+			common.Must1(chunkMasking.Write(nonce))
+		}
+	}
+	return NewChunkCodec(chunkMasking, globalPadding)
+}
+
+func (c *ChunkCodec) SetPaddingPolicy(policy PaddingPolicy) {
+	c.paddingPolicy = policy
+}
+
+// HeaderLen is the length of the chunk header that EncodeLength fills and DecodeLength reads.
+func (c *ChunkCodec) HeaderLen() int {
+	if c.globalPadding != nil && c.paddingPolicy != nil {
+		return 2 + paddingHeaderLen
+	}
+	return 2
+}
+
+func (c *ChunkCodec) EncodeLength(header []byte, dataLen uint16) (paddingLen uint16, err error) {
+	if c.globalPadding == nil && c.chunkMasking == nil {
+		binary.BigEndian.PutUint16(header, dataLen)
+		return
+	}
+	c.hashAccess.Lock()
+	defer c.hashAccess.Unlock()
+	var hashCode, mask uint16
+	if c.globalPadding != nil {
+		hashCode = c.globalPadding.next()
+		paddingLen = hashCode % MaxPaddingSize
+	}
+	if c.chunkMasking != nil {
+		mask = c.chunkMasking.next()
+	}
+	length := dataLen
+	if len(header) > 2 {
+		paddingLen, err = policyPaddingLength(c.paddingPolicy, hashCode, int(dataLen))
+		if err != nil {
+			return
+		}
+		header[2] = byte(paddingLen) ^ byte(c.globalPadding.next())
+		length += paddingHeaderLen
+	}
+	binary.BigEndian.PutUint16(header, (length+paddingLen)^mask)
+	return
+}
+
+func (c *ChunkCodec) DecodeLength(header []byte) (dataLen int, paddingLen int, err error) {
+	length := int(binary.BigEndian.Uint16(header))
+	if c.globalPadding != nil || c.chunkMasking != nil {
+		c.hashAccess.Lock()
+		if c.globalPadding != nil {
+			paddingLen = int(c.globalPadding.next() % MaxPaddingSize)
+		}
+		if c.chunkMasking != nil {
+			length ^= int(c.chunkMasking.next())
+		}
+		if len(header) > 2 {
+			paddingLen = int(header[2] ^ byte(c.globalPadding.next()))
+			length -= paddingHeaderLen
+		}
+		c.hashAccess.Unlock()
+	}
+	dataLen = length - paddingLen
+	if paddingLen >= MaxPaddingSize {
+		err = E.Extend(ErrInvalidPaddingLength, "padding=", paddingLen)
+	} else if dataLen < 0 || dataLen > MaxChunkSize {
+		err = E.Extend(ErrInvalidChunkLength, "length=", length, ", padding=", paddingLen)
+	} else if dataLen == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+func (c *ChunkCodec) Frame(buffer *buf.Buffer) error {
+	dataLen := buffer.Len()
+	if dataLen > MaxChunkSize {
+		return E.Extend(ErrBadLengthChunk, "too large: ", dataLen)
+	}
+	if buffer.Start() < c.HeaderLen() || buffer.FreeLen() < c.RearHeadroom() {
+		return E.Extend(io.ErrShortBuffer, "chunk frame needs headroom")
+	}
+	paddingLen, err := c.EncodeLength(buffer.ExtendHeader(c.HeaderLen()), uint16(dataLen))
+	if err != nil {
+		return err
+	}
+	if paddingLen > 0 {
+		buffer.WriteRandom(int(paddingLen))
+	}
+	return nil
+}
+
+func (c *ChunkCodec) Unframe(buffer *buf.Buffer) error {
+	headerLen := c.HeaderLen()
+	if buffer.Len() < headerLen {
+		return E.Extend(ErrBadLengthChunk, "short frame: ", buffer.Len())
+	}
+	dataLen, paddingLen, err := c.DecodeLength(buffer.To(headerLen))
+	if err != nil {
+		return err
+	}
+	if headerLen+dataLen+paddingLen != buffer.Len() {
+		return E.Extend(ErrBadLengthChunk, "frame=", buffer.Len(), ", data=", dataLen, ", padding=", paddingLen)
+	}
+	buffer.Advance(headerLen)
+	buffer.Truncate(dataLen)
+	return nil
+}
+
+func (c *ChunkCodec) FrontHeadroom() int {
+	// a padding policy may be set after the chain above has sized its buffers
+	return 2 + paddingHeaderLen
+}
+
+func (c *ChunkCodec) RearHeadroom() int {
+	if c.globalPadding != nil {
+		return MaxPaddingSize
+	} else {
+		return 0
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"sync"
 
-	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -19,9 +18,17 @@ import (
 type AEADChunkReader struct {
 	upstream      io.Reader
 	cipher        cipher.AEAD
-	globalPadding sha3.ShakeHash
+	globalPadding *shakeMask
 	nonce         []byte
 	nonceCount    uint16
+	chunkIndex    uint64
+	rekey         *aeadRekey
+	nonceLimit    bool
+	lengthBuffer  [2 + paddingHeaderLen + CipherOverhead]byte
+	stats         *connStats
+	paddingPolicy PaddingPolicy
+	pending       pendingChunk
+	faults        *chunkFaults
 }
 
 func NewAEADChunkReader(upstream io.Reader, cipher cipher.AEAD, nonce []byte, globalPadding sha3.ShakeHash) *AEADChunkReader {
@@ -31,7 +38,7 @@ func NewAEADChunkReader(upstream io.Reader, cipher cipher.AEAD, nonce []byte, gl
 		upstream:      upstream,
 		cipher:        cipher,
 		nonce:         readNonce,
-		globalPadding: globalPadding,
+		globalPadding: newShakeMask(globalPadding),
 	}
 }
 
@@ -43,76 +50,147 @@ func NewChacha20Poly1305ChunkReader(upstream io.Reader, key []byte, nonce []byte
 	return NewAEADChunkReader(upstream, newChacha20Poly1305(GenerateChacha20Poly1305Key(KDF(key, "auth_len")[:16])), nonce, globalPadding)
 }
 
-func (r *AEADChunkReader) Read(p []byte) (n int, err error) {
-	if cap(p) < 2+CipherOverhead {
-		return 0, E.Extend(io.ErrShortBuffer, "AEAD chunk need ", 2+CipherOverhead)
+func newAuthenticatedLengthReader(upstream io.Reader, newCipher func(key []byte) cipher.AEAD, newRekey func(key []byte) *aeadRekey, requestKey []byte, requestNonce []byte, globalPadding sha3.ShakeHash, option byte) *AEADChunkReader {
+	lengthKey := KDF(requestKey, "auth_len")[:16]
+	reader := NewAEADChunkReader(upstream, newCipher(lengthKey), requestNonce, globalPadding)
+	if option&RequestOptionRekey != 0 {
+		reader.rekey = newRekey(lengthKey)
+	}
+	return reader
+}
+
+func (r *AEADChunkReader) readLength() (dataLen int, paddingLen int, err error) {
+	if dataLen, paddingLen, loaded := r.pending.take(); loaded {
+		return dataLen, paddingLen, nil
+	}
+	err = r.faults.readLength()
+	if err != nil {
+		return
 	}
-	_, err = io.ReadFull(r.upstream, p[:2+CipherOverhead])
+	lengthBuffer := r.lengthBuffer[:r.headerLen()]
+	_, err = io.ReadFull(r.upstream, lengthBuffer)
 	if err != nil {
 		return
 	}
+	if r.nonceLimit && r.nonceCount == 0 && r.chunkIndex > 0 && r.rekey == nil {
+		err = ErrNonceExhausted
+		return
+	}
 	binary.BigEndian.PutUint16(r.nonce, r.nonceCount)
 	r.nonceCount += 1
-	_, err = r.cipher.Open(p[:0], r.nonce, p[:2+CipherOverhead], nil)
+	r.chunkIndex += 1
+	_, err = r.cipher.Open(lengthBuffer[:0], r.nonce, lengthBuffer, nil)
+	if r.rekey != nil && r.rekey.due(r.nonceCount) {
+		r.cipher = r.rekey.next()
+	}
 	if err != nil {
+		r.stats.chunkDecryptFailed()
+		err = &ErrChunkDecrypt{r.chunkIndex - 1, err}
 		return
 	}
-	length := binary.BigEndian.Uint16(p[:2])
-	length += CipherOverhead
-	dataLen := int(length)
-	var paddingLen int
+	length := int(binary.BigEndian.Uint16(lengthBuffer)) + CipherOverhead
 	if r.globalPadding != nil {
-		var hashCode uint16
-		common.Must(binary.Read(r.globalPadding, binary.BigEndian, &hashCode))
-		paddingLen = int(hashCode % 64)
-		dataLen -= paddingLen
-	}
-	if dataLen < 0 {
-		err = E.Extend(ErrBadLengthChunk, "length=", length, ", padding=", paddingLen)
-		return
+		paddingLen = int(r.globalPadding.next() % MaxPaddingSize)
+		if r.paddingPolicy != nil {
+			paddingLen = int(lengthBuffer[2])
+		}
 	}
-	if dataLen == 0 {
+	dataLen = length - paddingLen
+	if paddingLen >= MaxPaddingSize {
+		err = E.Extend(ErrInvalidPaddingLength, "padding=", paddingLen)
+	} else if dataLen < 0 || dataLen > MaxChunkSize+CipherOverhead {
+		err = E.Extend(ErrInvalidChunkLength, "length=", length, ", padding=", paddingLen)
+	} else if dataLen == 0 {
 		err = io.EOF
+	}
+	return
+}
+
+func (r *AEADChunkReader) headerLen() int {
+	if r.globalPadding != nil && r.paddingPolicy != nil {
+		return 2 + paddingHeaderLen + CipherOverhead
+	}
+	return 2 + CipherOverhead
+}
+
+func (r *AEADChunkReader) discardPadding(dataLen int, paddingLen int) error {
+	_, err := io.CopyN(io.Discard, r.upstream, int64(paddingLen))
+	if err == nil {
+		r.stats.chunkRead(dataLen, paddingLen)
+	}
+	return err
+}
+
+func (r *AEADChunkReader) Read(p []byte) (n int, err error) {
+	dataLen, paddingLen, err := r.readLength()
+	if err != nil {
 		return
 	}
-	var readLen int
-	readLen = len(p)
-	if readLen > dataLen {
-		readLen = dataLen
-	} else if readLen < dataLen {
+	if len(p) < dataLen {
+		r.pending.keep(dataLen, paddingLen)
 		return 0, E.Extend(io.ErrShortBuffer, "AEAD chunk need ", dataLen)
 	}
-	n, err = io.ReadFull(r.upstream, p[:readLen])
+	n, err = io.ReadFull(r.upstream, p[:dataLen])
 	if err != nil {
 		return
 	}
-	_, err = io.CopyN(io.Discard, r.upstream, int64(paddingLen))
+	r.faults.readData(p[:n])
+	err = r.discardPadding(dataLen, paddingLen)
 	return
 }
 
+func (r *AEADChunkReader) ReadBuffer(buffer *buf.Buffer) error {
+	dataLen, paddingLen, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	if buffer.FreeLen() < dataLen {
+		r.pending.keep(dataLen, paddingLen)
+		return E.Extend(io.ErrShortBuffer, "AEAD chunk need ", dataLen)
+	}
+	_, err = buffer.ReadFullFrom(r.upstream, dataLen)
+	if err != nil {
+		return err
+	}
+	r.faults.readData(buffer.Bytes()[buffer.Len()-dataLen:])
+	return r.discardPadding(dataLen, paddingLen)
+}
+
 func (r *AEADChunkReader) Upstream() any {
 	return r.upstream
 }
 
 type AEADChunkWriter struct {
 	upstream      N.ExtendedWriter
+	vectorised    N.VectorisedWriter
 	cipher        cipher.AEAD
-	globalPadding sha3.ShakeHash
+	globalPadding *shakeMask
 	nonce         []byte
 	nonceCount    uint16
+	rekey         *aeadRekey
+	nonceLimit    bool
+	exhausted     bool
 	hashAccess    sync.Mutex
 	writeAccess   sync.Mutex
+	stats         *connStats
+	paddingPolicy PaddingPolicy
+	pacer         Pacer
+	faults        *chunkFaults
+	headroom      headroom
 }
 
 func NewAEADChunkWriter(upstream io.Writer, cipher cipher.AEAD, nonce []byte, globalPadding sha3.ShakeHash) *AEADChunkWriter {
 	writeNonce := make([]byte, cipher.NonceSize())
 	copy(writeNonce, nonce)
-	return &AEADChunkWriter{
+	writer := &AEADChunkWriter{
 		upstream:      bufio.NewExtendedWriter(upstream),
+		vectorised:    bufio.NewVectorisedWriter(upstream),
 		cipher:        cipher,
 		nonce:         writeNonce,
-		globalPadding: globalPadding,
+		globalPadding: newShakeMask(globalPadding),
 	}
+	writer.headroom = headroomOf(writer)
+	return writer
 }
 
 func NewAes128GcmChunkWriter(upstream io.Writer, key []byte, nonce []byte, globalPadding sha3.ShakeHash) *AEADChunkWriter {
@@ -123,66 +201,77 @@ func NewChacha20Poly1305ChunkWriter(upstream io.Writer, key []byte, nonce []byte
 	return NewAEADChunkWriter(upstream, newChacha20Poly1305(GenerateChacha20Poly1305Key(KDF(key, "auth_len")[:16])), nonce, globalPadding)
 }
 
-func (w *AEADChunkWriter) Write(p []byte) (n int, err error) {
-	dataLength := uint16(len(p))
-	var paddingLen uint16
+func newAuthenticatedLengthWriter(upstream io.Writer, newCipher func(key []byte) cipher.AEAD, newRekey func(key []byte) *aeadRekey, requestKey []byte, requestNonce []byte, globalPadding sha3.ShakeHash, option byte) *AEADChunkWriter {
+	lengthKey := KDF(requestKey, "auth_len")[:16]
+	writer := NewAEADChunkWriter(upstream, newCipher(lengthKey), requestNonce, globalPadding)
+	if option&RequestOptionRekey != 0 {
+		writer.rekey = newRekey(lengthKey)
+	}
+	return writer
+}
+
+func (w *AEADChunkWriter) headerLen() int {
+	if w.globalPadding != nil && w.paddingPolicy != nil {
+		return 2 + paddingHeaderLen + CipherOverhead
+	}
+	return 2 + CipherOverhead
+}
+
+func (w *AEADChunkWriter) nextPadding(dataLength int) (paddingLen uint16, err error) {
 	if w.globalPadding != nil {
 		w.hashAccess.Lock()
-		var hashCode uint16
-		common.Must(binary.Read(w.globalPadding, binary.BigEndian, &hashCode))
-		paddingLen = hashCode % MaxPaddingSize
-		dataLength += paddingLen
+		hashCode := w.globalPadding.next()
 		w.hashAccess.Unlock()
+		if w.paddingPolicy != nil {
+			return policyPaddingLength(w.paddingPolicy, hashCode, dataLength)
+		}
+		paddingLen = hashCode % MaxPaddingSize
 	}
-	dataLength -= CipherOverhead
-
-	lengthBuffer := buf.NewSize(2 + CipherOverhead)
-	binary.BigEndian.PutUint16(lengthBuffer.Extend(2), dataLength)
+	return
+}
 
+func (w *AEADChunkWriter) sealLength(lengthBuffer []byte, dataLength uint16, paddingLen uint16) error {
+	if w.exhausted {
+		return ErrNonceExhausted
+	}
+	binary.BigEndian.PutUint16(lengthBuffer, dataLength+paddingLen-CipherOverhead)
+	plainLen := len(lengthBuffer) - CipherOverhead
+	if plainLen > 2 {
+		lengthBuffer[2] = byte(paddingLen)
+	}
 	binary.BigEndian.PutUint16(w.nonce, w.nonceCount)
 	w.nonceCount += 1
-	w.cipher.Seal(lengthBuffer.Index(0), w.nonce, lengthBuffer.Bytes(), nil)
-	lengthBuffer.Extend(CipherOverhead)
-
-	w.writeAccess.Lock()
-	_, err = lengthBuffer.WriteTo(w.upstream)
-	if err != nil {
-		return
+	w.cipher.Seal(lengthBuffer[:0], w.nonce, lengthBuffer[:plainLen], nil)
+	if w.rekey != nil {
+		if w.rekey.due(w.nonceCount) {
+			w.cipher = w.rekey.next()
+		}
+	} else if w.nonceCount == 0 && w.nonceLimit {
+		w.exhausted = true
 	}
+	return nil
+}
 
-	lengthBuffer.Release()
-
-	n, err = w.upstream.Write(p)
+func (w *AEADChunkWriter) Write(p []byte) (n int, err error) {
+	err = w.WriteVectorised([]*buf.Buffer{buf.As(p)})
 	if err != nil {
 		return
 	}
-	if paddingLen > 0 {
-		_, err = io.CopyN(w.upstream, rand.Reader, int64(paddingLen))
-		if err != nil {
-			return
-		}
-	}
-	w.writeAccess.Unlock()
-	return
+	return len(p), nil
 }
 
 func (w *AEADChunkWriter) WriteBuffer(buffer *buf.Buffer) error {
+	buffer = w.headroom.ensure(buffer)
 	dataLength := uint16(buffer.Len())
-	var paddingLen uint16
-	if w.globalPadding != nil {
-		w.hashAccess.Lock()
-		var hashCode uint16
-		common.Must(binary.Read(w.globalPadding, binary.BigEndian, &hashCode))
-		paddingLen = hashCode % MaxPaddingSize
-		dataLength += paddingLen
-		w.hashAccess.Unlock()
+	headerLen := w.headerLen()
+	paddingLen, err := w.nextPadding(int(dataLength))
+	if err == nil {
+		err = w.sealLength(buffer.ExtendHeader(headerLen), dataLength, paddingLen)
+	}
+	if err != nil {
+		buffer.Release()
+		return err
 	}
-	dataLength -= CipherOverhead
-	lengthBuffer := buffer.ExtendHeader(2 + CipherOverhead)
-	binary.BigEndian.PutUint16(lengthBuffer, dataLength)
-	binary.BigEndian.PutUint16(w.nonce, w.nonceCount)
-	w.nonceCount += 1
-	w.cipher.Seal(lengthBuffer[:0], w.nonce, lengthBuffer[:2], nil)
 	if paddingLen > 0 {
 		_, err := buffer.ReadFullFrom(rand.Reader, int(paddingLen))
 		if err != nil {
@@ -190,11 +279,84 @@ func (w *AEADChunkWriter) WriteBuffer(buffer *buf.Buffer) error {
 			return err
 		}
 	}
-	return w.upstream.WriteBuffer(buffer)
+	chunk, faultErr := w.faults.writeChunk([]*buf.Buffer{buffer}, headerLen)
+	if chunk == nil {
+		return faultErr
+	}
+	buffer = chunk[0]
+	err = w.pace(buffer.Len())
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	err = w.upstream.WriteBuffer(buffer)
+	if err == nil {
+		err = faultErr
+	}
+	if err == nil {
+		w.stats.chunkWritten(int(dataLength), int(paddingLen))
+	}
+	return err
+}
+
+func (w *AEADChunkWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	dataLen := buf.LenMulti(buffers)
+	if dataLen > MaxChunkSize {
+		buf.ReleaseMulti(buffers)
+		return E.Extend(ErrBadLengthChunk, "too large: ", dataLen)
+	}
+	headerLen := w.headerLen()
+	paddingLen, err := w.nextPadding(dataLen)
+	if err != nil {
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	lengthBuffer := buf.NewSize(headerLen)
+	err = w.sealLength(lengthBuffer.Extend(headerLen), uint16(dataLen), paddingLen)
+	if err != nil {
+		lengthBuffer.Release()
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	chunk := make([]*buf.Buffer, 0, len(buffers)+2)
+	chunk = append(chunk, lengthBuffer)
+	chunk = append(chunk, buffers...)
+	if paddingLen > 0 {
+		padding := buf.NewSize(int(paddingLen))
+		padding.WriteRandom(int(paddingLen))
+		chunk = append(chunk, padding)
+	}
+	chunk, faultErr := w.faults.writeChunk(chunk, headerLen)
+	if chunk == nil {
+		return faultErr
+	}
+	err = w.pace(buf.LenMulti(chunk))
+	if err != nil {
+		buf.ReleaseMulti(chunk)
+		return err
+	}
+	w.writeAccess.Lock()
+	err = w.vectorised.WriteVectorised(chunk)
+	w.writeAccess.Unlock()
+	if err == nil {
+		err = faultErr
+	}
+	if err == nil {
+		w.stats.chunkWritten(dataLen, int(paddingLen))
+	}
+	return err
+}
+
+func (w *AEADChunkWriter) pace(length int) error {
+	if w.pacer == nil {
+		return nil
+	}
+	return w.pacer.Pace(length)
 }
 
 func (w *AEADChunkWriter) FrontHeadroom() int {
-	return 2 + CipherOverhead
+	// a padding policy may be set after the chain above has sized its buffers
+	return 2 + paddingHeaderLen + CipherOverhead
 }
 
 func (w *AEADChunkWriter) RearHeadroom() int {
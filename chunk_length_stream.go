@@ -15,203 +15,217 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
-var ErrBadLengthChunk = E.New("bad length chunk")
+var (
+	ErrBadLengthChunk     = E.New("bad length chunk")
+	ErrInvalidChunkLength = newCategoryError(ErrBadLengthChunk, "invalid chunk length")
+)
 
 type StreamChunkReader struct {
-	upstream      io.Reader
-	chunkMasking  sha3.ShakeHash
-	globalPadding sha3.ShakeHash
+	ChunkCodec
+	upstream     io.Reader
+	lengthBuffer [2 + paddingHeaderLen]byte
+	stats        *connStats
+	pending      pendingChunk
+	faults       *chunkFaults
 }
 
 func NewStreamChunkReader(upstream io.Reader, chunkMasking sha3.ShakeHash, globalPadding sha3.ShakeHash) *StreamChunkReader {
-	return &StreamChunkReader{
-		upstream:      upstream,
-		chunkMasking:  chunkMasking,
-		globalPadding: globalPadding,
-	}
+	reader := &StreamChunkReader{upstream: upstream}
+	reader.chunkMasking, reader.globalPadding = newShakeMasks(chunkMasking, globalPadding)
+	return reader
 }
 
-func (r *StreamChunkReader) Read(p []byte) (n int, err error) {
-	var length uint16
-	err = binary.Read(r.upstream, binary.BigEndian, &length)
+func (r *StreamChunkReader) readLength() (dataLen int, paddingLen int, err error) {
+	if dataLen, paddingLen, loaded := r.pending.take(); loaded {
+		return dataLen, paddingLen, nil
+	}
+	err = r.faults.readLength()
 	if err != nil {
 		return
 	}
-	var paddingLen int
-	if r.globalPadding != nil {
-		var hashCode uint16
-		common.Must(binary.Read(r.globalPadding, binary.BigEndian, &hashCode))
-		paddingLen = int(hashCode % 64)
-	}
-	if r.chunkMasking != nil {
-		var hashCode uint16
-		common.Must(binary.Read(r.chunkMasking, binary.BigEndian, &hashCode))
-		length ^= hashCode
-	}
-	dataLen := int(length)
-	if paddingLen > 0 {
-		dataLen -= paddingLen
-	}
-	if dataLen < 0 {
-		err = E.Extend(ErrBadLengthChunk, "length=", length, ", padding=", paddingLen)
+	lengthBuffer := r.lengthBuffer[:r.HeaderLen()]
+	_, err = io.ReadFull(r.upstream, lengthBuffer)
+	if err != nil {
 		return
 	}
-	if dataLen == 0 {
-		err = io.EOF
+	return r.DecodeLength(lengthBuffer)
+}
+
+func (r *StreamChunkReader) discardPadding(dataLen int, paddingLen int) error {
+	_, err := io.CopyN(io.Discard, r.upstream, int64(paddingLen))
+	if err == nil {
+		r.stats.chunkRead(dataLen, paddingLen)
+	}
+	return err
+}
+
+func (r *StreamChunkReader) Read(p []byte) (n int, err error) {
+	dataLen, paddingLen, err := r.readLength()
+	if err != nil {
 		return
 	}
-	var readLen int
-	readLen = len(p)
-	if readLen > dataLen {
-		readLen = dataLen
-	} else if readLen < dataLen {
+	if len(p) < dataLen {
+		r.pending.keep(dataLen, paddingLen)
 		return 0, E.Extend(io.ErrShortBuffer, "stream chunk need ", dataLen)
 	}
-	n, err = io.ReadFull(r.upstream, p[:readLen])
+	n, err = io.ReadFull(r.upstream, p[:dataLen])
 	if err != nil {
 		return
 	}
-	_, err = io.CopyN(io.Discard, r.upstream, int64(paddingLen))
+	r.faults.readData(p[:n])
+	err = r.discardPadding(dataLen, paddingLen)
 	return
 }
 
+func (r *StreamChunkReader) ReadBuffer(buffer *buf.Buffer) error {
+	dataLen, paddingLen, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	if buffer.FreeLen() < dataLen {
+		r.pending.keep(dataLen, paddingLen)
+		return E.Extend(io.ErrShortBuffer, "stream chunk need ", dataLen)
+	}
+	_, err = buffer.ReadFullFrom(r.upstream, dataLen)
+	if err != nil {
+		return err
+	}
+	r.faults.readData(buffer.Bytes()[buffer.Len()-dataLen:])
+	return r.discardPadding(dataLen, paddingLen)
+}
+
 func (r *StreamChunkReader) Upstream() any {
 	return r.upstream
 }
 
 type StreamChunkWriter struct {
-	upstream      N.ExtendedWriter
-	chunkMasking  sha3.ShakeHash
-	globalPadding sha3.ShakeHash
-	hashAccess    sync.Mutex
-	writeAccess   sync.Mutex
+	ChunkCodec
+	upstream    N.ExtendedWriter
+	vectorised  N.VectorisedWriter
+	writeAccess sync.Mutex
+	stats       *connStats
+	pacer       Pacer
+	faults      *chunkFaults
+	headroom    headroom
 }
 
 func NewStreamChunkWriter(upstream io.Writer, chunkMasking sha3.ShakeHash, globalPadding sha3.ShakeHash) *StreamChunkWriter {
-	return &StreamChunkWriter{
-		upstream:      bufio.NewExtendedWriter(upstream),
-		chunkMasking:  chunkMasking,
-		globalPadding: globalPadding,
+	writer := &StreamChunkWriter{
+		upstream:   bufio.NewExtendedWriter(upstream),
+		vectorised: bufio.NewVectorisedWriter(upstream),
 	}
+	writer.chunkMasking, writer.globalPadding = newShakeMasks(chunkMasking, globalPadding)
+	writer.headroom = headroomOf(writer)
+	return writer
 }
 
 func (w *StreamChunkWriter) Write(p []byte) (n int, err error) {
-	dataLen := uint16(len(p))
-	var paddingLen uint16
-	if w.globalPadding != nil || w.chunkMasking != nil {
-		w.hashAccess.Lock()
-		if w.globalPadding != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.globalPadding, binary.BigEndian, &hashCode))
-			paddingLen = hashCode % MaxPaddingSize
-			dataLen += paddingLen
-		}
-		if w.chunkMasking != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.chunkMasking, binary.BigEndian, &hashCode))
-			dataLen ^= hashCode
-		}
-		w.hashAccess.Unlock()
-	}
-	w.writeAccess.Lock()
-	err = binary.Write(w.upstream, binary.BigEndian, dataLen)
-	if err != nil {
-		return
-	}
-	n, err = w.upstream.Write(p)
+	err = w.WriteVectorised([]*buf.Buffer{buf.As(p)})
 	if err != nil {
 		return
 	}
-	if paddingLen > 0 {
-		_, err = io.CopyN(w.upstream, rand.Reader, int64(paddingLen))
-		if err != nil {
-			return
-		}
-	}
-	w.writeAccess.Unlock()
-	return
+	return len(p), nil
 }
 
 func (w *StreamChunkWriter) WriteBuffer(buffer *buf.Buffer) error {
-	dataLen := uint16(buffer.Len())
-	var paddingLen uint16
-	if w.globalPadding != nil || w.chunkMasking != nil {
-		w.hashAccess.Lock()
-		if w.globalPadding != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.globalPadding, binary.BigEndian, &hashCode))
-			paddingLen = hashCode % MaxPaddingSize
-			dataLen += paddingLen
-		}
-		if w.chunkMasking != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.chunkMasking, binary.BigEndian, &hashCode))
-			dataLen ^= hashCode
-		}
-		w.hashAccess.Unlock()
+	buffer = w.headroom.ensure(buffer)
+	dataLen := buffer.Len()
+	headerLen := w.HeaderLen()
+	paddingLen, err := w.EncodeLength(buffer.ExtendHeader(headerLen), uint16(dataLen))
+	if err != nil {
+		buffer.Release()
+		return err
 	}
-	binary.BigEndian.PutUint16(buffer.ExtendHeader(2), dataLen)
 	if paddingLen > 0 {
-		_, err := buffer.ReadFullFrom(rand.Reader, int(paddingLen))
+		_, err = buffer.ReadFullFrom(rand.Reader, int(paddingLen))
 		if err != nil {
 			buffer.Release()
 			return err
 		}
 	}
-	return w.upstream.WriteBuffer(buffer)
+	chunk, faultErr := w.faults.writeChunk([]*buf.Buffer{buffer}, headerLen)
+	if chunk == nil {
+		return faultErr
+	}
+	buffer = chunk[0]
+	err = w.pace(buffer.Len())
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	err = w.upstream.WriteBuffer(buffer)
+	if err == nil {
+		err = faultErr
+	}
+	if err == nil {
+		w.stats.chunkWritten(dataLen, int(paddingLen))
+	}
+	return err
+}
+
+func (w *StreamChunkWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	return w.writeChunk(nil, buffers)
 }
 
 func (w *StreamChunkWriter) WriteWithChecksum(checksum uint32, p []byte) (n int, err error) {
-	dataLen := uint16(4 + len(p))
-	var paddingLen uint16
-	if w.globalPadding != nil || w.chunkMasking != nil {
-		w.hashAccess.Lock()
-		if w.globalPadding != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.globalPadding, binary.BigEndian, &hashCode))
-			paddingLen = hashCode % MaxPaddingSize
-			dataLen += paddingLen
-		}
-		if w.chunkMasking != nil {
-			var hashCode uint16
-			common.Must(binary.Read(w.chunkMasking, binary.BigEndian, &hashCode))
-			dataLen ^= hashCode
-		}
-		w.hashAccess.Unlock()
-	}
-	w.writeAccess.Lock()
-	err = binary.Write(w.upstream, binary.BigEndian, dataLen)
+	var checksumBytes [4]byte
+	binary.BigEndian.PutUint32(checksumBytes[:], checksum)
+	err = w.writeChunk(checksumBytes[:], []*buf.Buffer{buf.As(p)})
 	if err != nil {
 		return
 	}
-	err = binary.Write(w.upstream, binary.BigEndian, checksum)
-	if err != nil {
-		return
+	return len(p), nil
+}
+
+func (w *StreamChunkWriter) writeChunk(prefix []byte, buffers []*buf.Buffer) error {
+	dataLen := len(prefix) + buf.LenMulti(buffers)
+	if dataLen > MaxChunkSize {
+		buf.ReleaseMulti(buffers)
+		return E.Extend(ErrBadLengthChunk, "too large: ", dataLen)
 	}
-	n, err = w.upstream.Write(p)
+	headerLen := w.HeaderLen()
+	header := buf.NewSize(headerLen + len(prefix))
+	paddingLen, err := w.EncodeLength(header.Extend(headerLen), uint16(dataLen))
 	if err != nil {
-		return
-	}
+		header.Release()
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	common.Must1(header.Write(prefix))
+	chunk := make([]*buf.Buffer, 0, len(buffers)+2)
+	chunk = append(chunk, header)
+	chunk = append(chunk, buffers...)
 	if paddingLen > 0 {
-		_, err = io.CopyN(w.upstream, rand.Reader, int64(paddingLen))
-		if err != nil {
-			return
-		}
+		padding := buf.NewSize(int(paddingLen))
+		padding.WriteRandom(int(paddingLen))
+		chunk = append(chunk, padding)
+	}
+	chunk, faultErr := w.faults.writeChunk(chunk, headerLen)
+	if chunk == nil {
+		return faultErr
 	}
+	err = w.pace(buf.LenMulti(chunk))
+	if err != nil {
+		buf.ReleaseMulti(chunk)
+		return err
+	}
+	w.writeAccess.Lock()
+	err = w.vectorised.WriteVectorised(chunk)
 	w.writeAccess.Unlock()
-	return
-}
-
-func (w *StreamChunkWriter) FrontHeadroom() int {
-	return 2
+	if err == nil {
+		err = faultErr
+	}
+	if err == nil {
+		w.stats.chunkWritten(dataLen, int(paddingLen))
+	}
+	return err
 }
 
-func (w *StreamChunkWriter) RearHeadroom() int {
-	if w.globalPadding != nil {
-		return MaxPaddingSize
-	} else {
-		return 0
+func (w *StreamChunkWriter) pace(length int) error {
+	if w.pacer == nil {
+		return nil
 	}
+	return w.pacer.Pace(length)
 }
 
 func (w *StreamChunkWriter) Upstream() any {
@@ -0,0 +1,42 @@
+package vmess
+
+import (
+	"encoding/binary"
+
+	"github.com/sagernet/sing/common"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const shakeMaskBlockSize = 168 * 4 // four blocks of the 168 byte SHAKE128 rate
+
+type shakeMask struct {
+	shake  sha3.ShakeHash
+	block  [shakeMaskBlockSize]byte
+	offset int
+}
+
+func newShakeMask(shake sha3.ShakeHash) *shakeMask {
+	if shake == nil {
+		return nil
+	}
+	return &shakeMask{shake: shake, offset: shakeMaskBlockSize}
+}
+
+func newShakeMasks(chunkMasking sha3.ShakeHash, globalPadding sha3.ShakeHash) (*shakeMask, *shakeMask) {
+	paddingMask := newShakeMask(globalPadding)
+	if chunkMasking != nil && chunkMasking == globalPadding {
+		return paddingMask, paddingMask
+	}
+	return newShakeMask(chunkMasking), paddingMask
+}
+
+func (m *shakeMask) next() uint16 {
+	if m.offset == shakeMaskBlockSize {
+		common.Must1(m.shake.Read(m.block[:]))
+		m.offset = 0
+	}
+	value := binary.BigEndian.Uint16(m.block[m.offset:])
+	m.offset += 2
+	return value
+}
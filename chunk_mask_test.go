@@ -0,0 +1,46 @@
+package vmess
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/sagernet/sing/common"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func newTestShake() sha3.ShakeHash {
+	shake := sha3.NewShake128()
+	common.Must1(shake.Write([]byte("vmess")))
+	return shake
+}
+
+func TestShakeMask(t *testing.T) {
+	mask := newShakeMask(newTestShake())
+	shake := newTestShake()
+	var value [2]byte
+	for i := 0; i < shakeMaskBlockSize; i++ {
+		common.Must1(shake.Read(value[:]))
+		if mask.next() != binary.BigEndian.Uint16(value[:]) {
+			t.Fatal("mask value ", i, " differs from the SHAKE128 stream")
+		}
+	}
+}
+
+func BenchmarkShakeMask(b *testing.B) {
+	mask := newShakeMask(newTestShake())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mask.next()
+	}
+}
+
+func BenchmarkShakeRead(b *testing.B) {
+	shake := newTestShake()
+	var value [2]byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		common.Must1(shake.Read(value[:]))
+		binary.BigEndian.Uint16(value[:])
+	}
+}
@@ -0,0 +1,164 @@
+package vmess
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type pipelinedChunk struct {
+	buffer *buf.Buffer
+	err    error
+}
+
+type PipelinedReader struct {
+	upstream     N.ExtendedReader
+	maxChunkSize int
+	chunks       chan pipelinedChunk
+	done         chan struct{}
+	startOnce    sync.Once
+	closeOnce    sync.Once
+	access       sync.Mutex
+	cache        *buf.Buffer
+	err          error
+	memory       *memoryAccount
+}
+
+func NewPipelinedReader(upstream io.Reader, maxChunkSize int, depth int) *PipelinedReader {
+	if depth < 1 {
+		depth = 1
+	}
+	return &PipelinedReader{
+		upstream:     bufio.NewExtendedReader(upstream),
+		maxChunkSize: maxChunkSize,
+		chunks:       make(chan pipelinedChunk, depth),
+		done:         make(chan struct{}),
+	}
+}
+
+func newChunkReader(upstream io.Reader, pipelineDepth int) io.Reader {
+	if pipelineDepth > 0 {
+		return NewPipelinedReader(upstream, ReadChunkSize, pipelineDepth)
+	}
+	return newTunedChunkReader(upstream, ReadChunkSize)
+}
+
+func (r *PipelinedReader) loop() {
+	for {
+		err := r.memory.wait()
+		if err != nil {
+			select {
+			case r.chunks <- pipelinedChunk{err: err}:
+			case <-r.done:
+			}
+			return
+		}
+		buffer := buf.NewSize(r.maxChunkSize)
+		err = r.upstream.ReadBuffer(buffer)
+		if errors.Is(err, io.ErrShortBuffer) && r.maxChunkSize < maxChunkReadSize {
+			buffer.Release()
+			buffer = buf.NewSize(maxChunkReadSize)
+			err = r.upstream.ReadBuffer(buffer)
+		}
+		if err != nil {
+			buffer.Release()
+			select {
+			case r.chunks <- pipelinedChunk{err: err}:
+			case <-r.done:
+			}
+			return
+		}
+		r.memory.hold(buffer.Len())
+		select {
+		case r.chunks <- pipelinedChunk{buffer: buffer}:
+		case <-r.done:
+			buffer.Release()
+			return
+		}
+	}
+}
+
+func (r *PipelinedReader) fillCache() error {
+	if r.cache != nil {
+		if !r.cache.IsEmpty() {
+			return nil
+		}
+		r.cache.Release()
+		r.cache = nil
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.startOnce.Do(func() {
+		go r.loop()
+	})
+	select {
+	case chunk := <-r.chunks:
+		if chunk.err != nil {
+			r.err = chunk.err
+			return chunk.err
+		}
+		r.cache = chunk.buffer
+		return nil
+	case <-r.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (r *PipelinedReader) Read(p []byte) (n int, err error) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	err = r.fillCache()
+	if err != nil {
+		return
+	}
+	n, err = r.cache.Read(p)
+	r.memory.release(n)
+	return
+}
+
+func (r *PipelinedReader) ReadBuffer(buffer *buf.Buffer) error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	err := r.fillCache()
+	if err != nil {
+		return err
+	}
+	n, err := buffer.Write(r.cache.Bytes())
+	r.cache.Advance(n)
+	r.memory.release(n)
+	return err
+}
+
+func (r *PipelinedReader) MTU() int {
+	return r.maxChunkSize
+}
+
+func (r *PipelinedReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.memory.close()
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.cache != nil {
+		r.cache.Release()
+		r.cache = nil
+	}
+	for {
+		select {
+		case chunk := <-r.chunks:
+			chunk.buffer.Release()
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *PipelinedReader) Upstream() any {
+	return r.upstream
+}
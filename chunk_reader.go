@@ -0,0 +1,207 @@
+package vmess
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	tunedChunkCacheMinSize = 2048
+	tunedChunkShrinkAfter  = 16
+)
+
+type ChunkReader struct {
+	upstream     N.ExtendedReader
+	maxChunkSize int
+	access       sync.Mutex
+	cache        *buf.Buffer
+	cacheSize    int
+	tuned        bool
+	smallChunks  int
+	closed       bool
+	memory       *memoryAccount
+}
+
+func NewChunkReader(upstream io.Reader, maxChunkSize int) *ChunkReader {
+	return &ChunkReader{
+		upstream:     bufio.NewExtendedReader(upstream),
+		maxChunkSize: maxChunkSize,
+		cacheSize:    maxChunkSize,
+	}
+}
+
+func newTunedChunkReader(upstream io.Reader, maxChunkSize int) *ChunkReader {
+	reader := NewChunkReader(upstream, maxChunkSize)
+	if maxChunkSize > tunedChunkCacheMinSize {
+		reader.cacheSize = tunedChunkCacheMinSize
+		reader.tuned = true
+	}
+	return reader
+}
+
+func (c *ChunkReader) ReadBuffer(buffer *buf.Buffer) error {
+	c.access.Lock()
+	direct := buffer.FreeLen() >= c.maxChunkSize && (c.cache == nil || c.cache.IsEmpty())
+	c.access.Unlock()
+	if direct {
+		err := c.memory.wait()
+		if err != nil {
+			return err
+		}
+		err = c.upstream.ReadBuffer(buffer)
+		if !errors.Is(err, io.ErrShortBuffer) {
+			return err
+		}
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	err := c.fillCache()
+	if err != nil {
+		return err
+	}
+	n, err := buffer.Write(c.cache.Bytes())
+	c.cache.Advance(n)
+	c.memory.release(n)
+	return err
+}
+
+func (c *ChunkReader) Read(p []byte) (n int, err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if len(p) >= c.maxChunkSize && !c.closed && (c.cache == nil || c.cache.IsEmpty()) {
+		// a full size chunk fits, so it is read and opened in place
+		err = c.memory.wait()
+		if err != nil {
+			return
+		}
+		n, err = c.upstream.Read(p)
+		if !errors.Is(err, io.ErrShortBuffer) {
+			return
+		}
+	}
+	err = c.fillCache()
+	if err != nil {
+		return
+	}
+	n, err = c.cache.Read(p)
+	c.memory.release(n)
+	return
+}
+
+func (c *ChunkReader) fillCache() error {
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	if c.cache != nil {
+		if !c.cache.IsEmpty() {
+			return nil
+		}
+		if c.cache.Cap() != c.cacheSize {
+			c.cache.Release()
+			c.cache = nil
+		}
+	}
+	err := c.memory.wait()
+	if err != nil {
+		return err
+	}
+	if c.cache == nil {
+		c.cache = buf.NewSize(c.cacheSize)
+	}
+	c.cache.FullReset()
+	err = c.upstream.ReadBuffer(c.cache)
+	if c.tuned && c.cacheSize < c.maxChunkSize && errors.Is(err, io.ErrShortBuffer) {
+		c.cache.Release()
+		c.cacheSize = c.maxChunkSize
+		c.smallChunks = 0
+		c.cache = buf.NewSize(c.cacheSize)
+		err = c.upstream.ReadBuffer(c.cache)
+	}
+	if c.cacheSize < maxChunkReadSize && errors.Is(err, io.ErrShortBuffer) {
+		// the peer writes larger chunks, keep their size until tuning shrinks it
+		c.cache.Release()
+		c.cacheSize = maxChunkReadSize
+		c.smallChunks = 0
+		c.cache = buf.NewSize(c.cacheSize)
+		err = c.upstream.ReadBuffer(c.cache)
+	}
+	if err != nil {
+		c.cache.Release()
+		c.cache = nil
+		return err
+	}
+	c.memory.hold(c.cache.Len())
+	if c.tuned {
+		c.tune(c.cache.Len())
+	}
+	return nil
+}
+
+func (c *ChunkReader) tune(chunkLen int) {
+	switch {
+	case chunkLen > c.cacheSize/2:
+		c.smallChunks = 0
+		if c.cacheSize < c.maxChunkSize {
+			c.cacheSize *= 2
+			if c.cacheSize > c.maxChunkSize {
+				c.cacheSize = c.maxChunkSize
+			}
+		}
+	case chunkLen <= c.cacheSize/4 && c.cacheSize > tunedChunkCacheMinSize:
+		c.smallChunks++
+		if c.smallChunks >= tunedChunkShrinkAfter {
+			c.smallChunks = 0
+			c.cacheSize /= 2
+			if c.cacheSize < tunedChunkCacheMinSize {
+				c.cacheSize = tunedChunkCacheMinSize
+			}
+		}
+	default:
+		c.smallChunks = 0
+	}
+}
+
+func (c *ChunkReader) MTU() int {
+	return c.maxChunkSize
+}
+
+func (c *ChunkReader) Close() error {
+	c.memory.close()
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.closed = true
+	if c.cache != nil {
+		c.cache.Release()
+		c.cache = nil
+	}
+	return nil
+}
+
+func (c *ChunkReader) Upstream() any {
+	return c.upstream
+}
+
+type pendingChunk struct {
+	loaded     bool
+	dataLen    int
+	paddingLen int
+}
+
+func (p *pendingChunk) keep(dataLen int, paddingLen int) {
+	p.loaded = true
+	p.dataLen = dataLen
+	p.paddingLen = paddingLen
+}
+
+func (p *pendingChunk) take() (dataLen int, paddingLen int, loaded bool) {
+	if !p.loaded {
+		return
+	}
+	p.loaded = false
+	return p.dataLen, p.paddingLen, true
+}
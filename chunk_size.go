@@ -0,0 +1,31 @@
+package vmess
+
+const (
+	MaxWriteChunkSize = 65535 - CipherOverhead - MaxPaddingSize
+	maxChunkReadSize  = 65535
+)
+
+func writeChunkSize(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	if size > MaxWriteChunkSize {
+		return MaxWriteChunkSize
+	}
+	return size
+}
+
+func WriterWithChunkSize(size int) WriterOption {
+	return func(options *writerOptions) {
+		options.chunkSize = writeChunkSize(size)
+	}
+}
+
+func setWriteChunkSize(writer any, size int) {
+	if size == 0 {
+		return
+	}
+	if splitWriter, isSplit := writer.(*chunkSplitWriter); isSplit {
+		splitWriter.maxChunkSize = size
+	}
+}
@@ -0,0 +1,100 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// chunkScratchSize fits a MaxWriteChunkSize chunk and the headroom of any writer chain.
+const chunkScratchSize = 65535 + 1024
+
+// chunkScratchPool shares sealing buffers between writers, wrapping a fresh slice would allocate on every write.
+var chunkScratchPool = sync.Pool{
+	New: func() any {
+		return buf.As(make([]byte, chunkScratchSize))
+	},
+}
+
+// chunkSplitWriter cuts writes into chunks of at most the write chunk size.
+type chunkSplitWriter struct {
+	upstream     N.ExtendedWriter
+	maxChunkSize int
+	sealInPlace  bool
+	headroom     headroom
+}
+
+func newChunkSplitWriter(upstream io.Writer, maxChunkSize int) *chunkSplitWriter {
+	_, sealInPlace := upstream.(*AEADWriter)
+	return &chunkSplitWriter{
+		upstream:     bufio.NewExtendedWriter(upstream),
+		maxChunkSize: maxChunkSize,
+		sealInPlace:  sealInPlace,
+		headroom:     headroomOf(upstream),
+	}
+}
+
+func (w *chunkSplitWriter) Write(p []byte) (n int, err error) {
+	if !w.sealInPlace {
+		for len(p) > 0 {
+			data := p
+			if len(data) > w.maxChunkSize {
+				data = data[:w.maxChunkSize]
+			}
+			var writeN int
+			writeN, err = w.upstream.Write(data)
+			n += writeN
+			if err != nil {
+				return
+			}
+			p = p[len(data):]
+		}
+		return
+	}
+	chunkSize := len(p)
+	if chunkSize > w.maxChunkSize {
+		chunkSize = w.maxChunkSize
+	}
+	var chunk *buf.Buffer
+	if scratchSize := w.headroom.front + chunkSize + w.headroom.rear; scratchSize <= chunkScratchSize {
+		chunk = chunkScratchPool.Get().(*buf.Buffer)
+		defer chunkScratchPool.Put(chunk)
+	} else {
+		chunk = buf.As(make([]byte, scratchSize))
+	}
+	for len(p) > 0 {
+		data := p
+		if len(data) > chunkSize {
+			data = data[:chunkSize]
+		}
+		chunk.Resize(w.headroom.front, 0)
+		common.Must1(chunk.Write(data))
+		err = w.upstream.WriteBuffer(chunk)
+		if err != nil {
+			return
+		}
+		n += len(data)
+		p = p[len(data):]
+	}
+	return
+}
+
+func (w *chunkSplitWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if buffer.Len() > w.maxChunkSize {
+		defer buffer.Release()
+		return common.Error(w.Write(buffer.Bytes()))
+	}
+	return w.upstream.WriteBuffer(buffer)
+}
+
+func (w *chunkSplitWriter) MTU() int {
+	return w.maxChunkSize
+}
+
+func (w *chunkSplitWriter) Upstream() any {
+	return w.upstream
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
 	N "github.com/sagernet/sing/common/network"
 )
 
@@ -24,12 +25,18 @@ func (r *StreamChecksumReader) Read(p []byte) (n int, err error) {
 	if err != nil {
 		return
 	}
+	if n < 4 {
+		return 0, E.Extend(ErrInvalidChunkLength, "checksum chunk length=", n)
+	}
 	hash := fnv.New32a()
 	common.Must1(hash.Write(p[4:n]))
 	if hash.Sum32() != binary.BigEndian.Uint32(p) {
 		return 0, ErrInvalidChecksum
 	}
 	n = copy(p, p[4:n])
+	if n == 0 {
+		err = io.EOF
+	}
 	return
 }
 
@@ -38,12 +45,18 @@ func (r *StreamChecksumReader) ReadBuffer(buffer *buf.Buffer) error {
 	if err != nil {
 		return err
 	}
+	if buffer.Len() < 4 {
+		return E.Extend(ErrInvalidChunkLength, "checksum chunk length=", buffer.Len())
+	}
 	hash := fnv.New32a()
 	common.Must1(hash.Write(buffer.From(4)))
 	if hash.Sum32() != binary.BigEndian.Uint32(buffer.To(4)) {
 		return ErrInvalidChecksum
 	}
 	buffer.Advance(4)
+	if buffer.IsEmpty() {
+		return io.EOF
+	}
 	return nil
 }
 
@@ -66,6 +79,8 @@ func (w *StreamChecksumWriter) Write(p []byte) (n int, err error) {
 }
 
 func (w *StreamChecksumWriter) WriteBuffer(buffer *buf.Buffer) error {
+	buffer = headroom{front: 4}.ensure(buffer)
+	defer buffer.Release()
 	hash := fnv.New32a()
 	common.Must1(hash.Write(buffer.Bytes()))
 	hash.Sum(buffer.ExtendHeader(4)[:0])
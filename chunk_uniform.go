@@ -0,0 +1,185 @@
+package vmess
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const UniformChunkMinSize = 64
+
+var ErrBadUniformChunk = E.New("vmess: bad uniform chunk")
+
+func uniformChunkSize(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	if size < UniformChunkMinSize {
+		return UniformChunkMinSize
+	}
+	if size > WriteChunkSize {
+		return WriteChunkSize
+	}
+	return size
+}
+
+type readerOptions struct {
+	uniformChunkSize int
+	commandKey       []byte
+	faultInjector    FaultInjector
+	nonceLimit       bool
+	rekeyShift       byte
+}
+
+type ReaderOption func(options *readerOptions)
+
+func ReaderWithUniformChunks(size int) ReaderOption {
+	return func(options *readerOptions) {
+		options.uniformChunkSize = uniformChunkSize(size)
+	}
+}
+
+func WriterWithUniformChunks(size int) WriterOption {
+	return func(options *writerOptions) {
+		options.uniformChunkSize = uniformChunkSize(size)
+	}
+}
+
+func hasChunkStream(security byte, option byte) bool {
+	return security != SecurityTypeZero && option&RequestOptionChunkStream != 0
+}
+
+type uniformChunkReader struct {
+	upstream N.ExtendedReader
+	size     int
+	cache    *buf.Buffer
+}
+
+func newUniformChunkReader(upstream io.Reader, size int) *uniformChunkReader {
+	return &uniformChunkReader{
+		upstream: bufio.NewExtendedReader(upstream),
+		size:     size,
+	}
+}
+
+func (r *uniformChunkReader) readChunk() error {
+	for r.cache == nil || r.cache.IsEmpty() {
+		if r.cache == nil {
+			r.cache = buf.New()
+		} else {
+			r.cache.Reset()
+		}
+		err := r.upstream.ReadBuffer(r.cache)
+		if err == nil && r.cache.IsEmpty() {
+			err = io.EOF
+		}
+		if err != nil {
+			r.release()
+			return err
+		}
+		if chunkLen := r.cache.Len(); chunkLen != r.size {
+			r.release()
+			return E.Extend(ErrBadUniformChunk, "length ", chunkLen)
+		}
+		dataLen := int(binary.BigEndian.Uint16(r.cache.To(2)))
+		if dataLen > r.size-2 {
+			r.release()
+			return E.Extend(ErrBadUniformChunk, "data length ", dataLen)
+		}
+		r.cache.Advance(2)
+		r.cache.Truncate(dataLen)
+	}
+	return nil
+}
+
+func (r *uniformChunkReader) release() {
+	if r.cache != nil {
+		r.cache.Release()
+		r.cache = nil
+	}
+}
+
+func (r *uniformChunkReader) Read(p []byte) (n int, err error) {
+	err = r.readChunk()
+	if err != nil {
+		return
+	}
+	n = copy(p, r.cache.Bytes())
+	r.cache.Advance(n)
+	return
+}
+
+func (r *uniformChunkReader) ReadBuffer(buffer *buf.Buffer) error {
+	err := r.readChunk()
+	if err != nil {
+		return err
+	}
+	n, _ := buffer.Write(r.cache.Bytes())
+	r.cache.Advance(n)
+	return nil
+}
+
+func (r *uniformChunkReader) Upstream() any {
+	return r.upstream
+}
+
+type uniformChunkWriter struct {
+	upstream N.ExtendedWriter
+	size     int
+	headroom headroom
+}
+
+func newUniformChunkWriter(upstream io.Writer, size int) *uniformChunkWriter {
+	return &uniformChunkWriter{
+		upstream: bufio.NewExtendedWriter(upstream),
+		size:     size,
+		headroom: headroomOf(upstream),
+	}
+}
+
+func (w *uniformChunkWriter) Write(p []byte) (n int, err error) {
+	// an empty chunk ends the stream and stays empty
+	if len(p) == 0 {
+		return w.upstream.Write(p)
+	}
+	for n < len(p) {
+		dataLen := len(p) - n
+		if dataLen > w.size-2 {
+			dataLen = w.size - 2
+		}
+		err = w.writeChunk(p[n : n+dataLen])
+		if err != nil {
+			return
+		}
+		n += dataLen
+	}
+	return
+}
+
+func (w *uniformChunkWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if buffer.IsEmpty() {
+		return w.upstream.WriteBuffer(buffer)
+	}
+	defer buffer.Release()
+	return common.Error(w.Write(buffer.Bytes()))
+}
+
+func (w *uniformChunkWriter) writeChunk(data []byte) error {
+	chunk := w.headroom.newBuffer(w.size)
+	binary.BigEndian.PutUint16(chunk.Extend(2), uint16(len(data)))
+	common.Must1(chunk.Write(data))
+	fill := chunk.Extend(w.size - 2 - len(data))
+	for i := range fill {
+		fill[i] = 0
+	}
+	return w.upstream.WriteBuffer(chunk)
+}
+
+func (w *uniformChunkWriter) Upstream() any {
+	return w.upstream
+}
@@ -1,15 +1,14 @@
 package vmess
 
 import (
+	"context"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
-	"hash/fnv"
 	"io"
-	mRand "math/rand"
 	"net"
 	"time"
 
@@ -19,18 +18,55 @@ import (
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/rw"
 
 	"github.com/gofrs/uuid/v5"
 )
 
+var (
+	ErrBadResponseHeader            = newCategoryError(ErrHeaderDecode, "bad response header")
+	ErrLegacyProtocolWithoutAlterId = E.New("legacy protocol requires alterId > 0")
+	ErrLegacyAuthenticatedLength    = E.New("authenticated length is not available with aes-128-cfb security")
+)
+
 type Client struct {
-	key                 [16]byte
-	security            byte
-	globalPadding       bool
-	authenticatedLength bool
-	time                TimeFunc
-	alterId             int
-	alterKey            [16]byte
+	key                  [16]byte
+	authIDCipher         cipher.Block
+	security             byte
+	disableChunkMasking  bool
+	disableHeaderPadding bool
+	globalPadding        bool
+	authenticatedLength  bool
+	time                 TimeFunc
+	random               io.Reader
+	alterId              int
+	alterKeys            [][16]byte
+	legacyProtocol       bool
+	writeCoalescing      time.Duration
+	tcpKeepAlivePeriod   time.Duration
+	responseTimeout      time.Duration
+	maxResponsePadding   int
+	pipelinedRead        int
+	chachaHeader         bool
+	rekey                bool
+	rekeyShift           byte
+	paddingPolicy        PaddingPolicy
+	pacer                Pacer
+	compression          bool
+	responseCommand      ResponseCommandCallback
+	sessionTickets       *sessionTicketCache
+	logger               Logger
+	uniformChunkSize     int
+	writeAggregation     int
+	responseVerifier     ResponseVerifier
+	recorder             *Recorder
+	commandKey           bool
+	faultInjector        FaultInjector
+	domainStrategy       DomainStrategy
+	domainResolver       DomainResolver
+	chunkSize            int
+	handshakeObserver    HandshakeObserver
+	packetFragment       bool
 }
 
 func NewClient(userId string, security string, alterId int, options ...ClientOption) (*Client, error) {
@@ -43,39 +79,76 @@ func NewClient(userId string, security string, alterId int, options ...ClientOpt
 	switch security {
 	case "auto":
 		rawSecurity = AutoSecurityType()
-	case "none", "zero":
+	case "none":
 		rawSecurity = SecurityTypeNone
+	case "zero":
+		rawSecurity = SecurityTypeZero
 	case "aes-128-cfb":
 		rawSecurity = SecurityTypeLegacy
 	case "aes-128-gcm":
 		rawSecurity = SecurityTypeAes128Gcm
 	case "chacha20-poly1305":
 		rawSecurity = SecurityTypeChacha20Poly1305
+	case "aes-256-gcm":
+		rawSecurity = SecurityTypeAes256Gcm
 	default:
 		return nil, E.Extend(ErrUnsupportedSecurityType, security)
 	}
+	key := Key(user)
 	client := &Client{
-		key:      Key(user),
-		security: rawSecurity,
-		time:     time.Now,
-		alterId:  alterId,
+		key:                key,
+		authIDCipher:       newAuthIDCipher(key),
+		security:           rawSecurity,
+		time:               time.Now,
+		random:             rand.Reader,
+		alterId:            alterId,
+		legacyProtocol:     alterId > 0,
+		maxResponsePadding: MaxPaddingSize,
 	}
 	if alterId > 0 {
-		client.alterKey = AlterId(user)
+		client.alterKeys = make([][16]byte, alterId)
+		currentId := user
+		for i := range client.alterKeys {
+			currentId = AlterId(currentId)
+			client.alterKeys[i] = currentId
+		}
 	}
 	for _, option := range options {
 		option(client)
 	}
+	if client.legacyProtocol && alterId == 0 {
+		return nil, ErrLegacyProtocolWithoutAlterId
+	}
+	if client.legacyProtocol && client.commandKey {
+		return nil, ErrLegacyCommandKey
+	}
+	if !isSupportedSecurity(client.security) {
+		return nil, E.Extend(ErrUnsupportedSecurityType, client.security)
+	}
+	if client.authenticatedLength && client.security == SecurityTypeLegacy {
+		return nil, ErrLegacyAuthenticatedLength
+	}
+	if client.legacyProtocol && client.logger != nil {
+		client.logger.WarnContext(context.Background(), "vmess: the legacy protocol is deprecated, use alterId 0 or ClientWithLegacyProtocol(false) to send AEAD headers")
+	}
 	return client, nil
 }
 
 func (c *Client) DialConn(upstream net.Conn, destination M.Socksaddr) (N.ExtendedConn, error) {
-	conn := &clientConn{c.dialRaw(upstream, CommandTCP, destination)}
-	return conn, conn.writeHandshake(nil)
+	return c.DialConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) (N.ExtendedConn, error) {
+	conn := &clientConn{c.dialRaw(ctx, upstream, CommandTCP, destination)}
+	return conn, conn.writeHandshakeContext(ctx, nil)
 }
 
 func (c *Client) DialEarlyConn(upstream net.Conn, destination M.Socksaddr) N.ExtendedConn {
-	return &clientConn{c.dialRaw(upstream, CommandTCP, destination)}
+	return c.DialEarlyConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialEarlyConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) N.ExtendedConn {
+	return &clientConn{c.dialRaw(ctx, upstream, CommandTCP, destination)}
 }
 
 type PacketConn interface {
@@ -84,17 +157,29 @@ type PacketConn interface {
 }
 
 func (c *Client) DialPacketConn(upstream net.Conn, destination M.Socksaddr) (PacketConn, error) {
-	conn := &clientPacketConn{clientConn{c.dialRaw(upstream, CommandUDP, destination)}, destination}
-	return conn, conn.writeHandshake(nil)
+	return c.DialPacketConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialPacketConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) (PacketConn, error) {
+	conn := &clientPacketConn{clientConn{c.dialRaw(ctx, upstream, CommandUDP, destination)}, destination}
+	return conn, conn.writeHandshakeContext(ctx, nil)
 }
 
 func (c *Client) DialEarlyPacketConn(upstream net.Conn, destination M.Socksaddr) PacketConn {
-	return &clientPacketConn{clientConn{c.dialRaw(upstream, CommandUDP, destination)}, destination}
+	return c.DialEarlyPacketConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialEarlyPacketConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) PacketConn {
+	return &clientPacketConn{clientConn{c.dialRaw(ctx, upstream, CommandUDP, destination)}, destination}
 }
 
 func (c *Client) DialXUDPPacketConn(upstream net.Conn, destination M.Socksaddr) (PacketConn, error) {
-	conn := &clientConn{c.dialRaw(upstream, CommandMux, destination)}
-	err := conn.writeHandshake(nil)
+	return c.DialXUDPPacketConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialXUDPPacketConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) (PacketConn, error) {
+	conn := &clientConn{c.dialRaw(ctx, upstream, CommandMux, destination)}
+	err := conn.writeHandshakeContext(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -102,15 +187,60 @@ func (c *Client) DialXUDPPacketConn(upstream net.Conn, destination M.Socksaddr)
 }
 
 func (c *Client) DialEarlyXUDPPacketConn(upstream net.Conn, destination M.Socksaddr) PacketConn {
-	return NewXUDPConn(&clientConn{c.dialRaw(upstream, CommandMux, destination)}, destination)
+	return c.DialEarlyXUDPPacketConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialEarlyXUDPPacketConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) PacketConn {
+	return NewXUDPConn(&clientConn{c.dialRaw(ctx, upstream, CommandMux, destination)}, destination)
+}
+
+func (c *Client) DialXUDPPacketConnWithGlobalID(upstream net.Conn, destination M.Socksaddr, globalID [XUDPGlobalIDLength]byte) (PacketConn, error) {
+	return c.DialXUDPPacketConnWithGlobalIDContext(context.Background(), upstream, destination, globalID)
+}
+
+func (c *Client) DialXUDPPacketConnWithGlobalIDContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr, globalID [XUDPGlobalIDLength]byte) (PacketConn, error) {
+	conn := &clientConn{c.dialRaw(ctx, upstream, CommandMux, destination)}
+	err := conn.writeHandshakeContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewXUDPConnWithGlobalID(conn, destination, globalID), nil
+}
+
+func (c *Client) DialEarlyXUDPPacketConnWithGlobalID(upstream net.Conn, destination M.Socksaddr, globalID [XUDPGlobalIDLength]byte) PacketConn {
+	return c.DialEarlyXUDPPacketConnWithGlobalIDContext(context.Background(), upstream, destination, globalID)
+}
+
+func (c *Client) DialEarlyXUDPPacketConnWithGlobalIDContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr, globalID [XUDPGlobalIDLength]byte) PacketConn {
+	return NewXUDPConnWithGlobalID(&clientConn{c.dialRaw(ctx, upstream, CommandMux, destination)}, destination, globalID)
+}
+
+// DialMuxConn opens a VMess mux connection as a bare stream for a sing-mux client session.
+func (c *Client) DialMuxConn(upstream net.Conn) (N.ExtendedConn, error) {
+	return c.DialMuxConnContext(context.Background(), upstream)
+}
+
+func (c *Client) DialMuxConnContext(ctx context.Context, upstream net.Conn) (N.ExtendedConn, error) {
+	conn := &clientConn{c.dialRaw(ctx, upstream, CommandMux, MuxDestination)}
+	return conn, conn.writeHandshakeContext(ctx, nil)
+}
+
+func (c *Client) DialEarlyMuxConn(upstream net.Conn) N.ExtendedConn {
+	return c.DialEarlyMuxConnContext(context.Background(), upstream)
+}
+
+func (c *Client) DialEarlyMuxConnContext(ctx context.Context, upstream net.Conn) N.ExtendedConn {
+	return &clientConn{c.dialRaw(ctx, upstream, CommandMux, MuxDestination)}
 }
 
 type rawClientConn struct {
 	*Client
 	net.Conn
+	ctx         context.Context
 	command     byte
 	security    byte
 	option      byte
+	reserved    byte
 	destination M.Socksaddr
 
 	requestKey     [16]byte
@@ -120,70 +250,137 @@ type rawClientConn struct {
 	readBuffer bool
 	reader     N.ExtendedReader
 	writer     N.ExtendedWriter
+
+	stats          *connStats
+	handshake      *handshakeMachine
+	handshakeStart time.Time
+	deadline       *writeDeadline
+	deadlines      *connDeadlines
+	batch          *packetBatchWriter
+	ticketed       bool
+	aggregate      *aggregateWriter
+	endpoint       M.Socksaddr
 }
 
-func (c *Client) dialRaw(upstream net.Conn, command byte, destination M.Socksaddr) rawClientConn {
+func (c *Client) dialRaw(ctx context.Context, upstream net.Conn, command byte, destination M.Socksaddr) rawClientConn {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	conn := rawClientConn{
 		Client:      c,
 		Conn:        upstream,
+		ctx:         detachedContext{ctx},
 		command:     command,
 		destination: destination,
+		stats:       &connStats{logger: c.logger, ctx: ctx, recording: c.recorder.open("client")},
+		deadline:    &writeDeadline{},
+		deadlines:   &connDeadlines{},
+		handshake:   newHandshakeMachine(ctx, &clientHandshakeTransitions, c.handshakeObserver),
 	}
-	common.Must1(io.ReadFull(rand.Reader, conn.requestKey[:]))
-	common.Must1(io.ReadFull(rand.Reader, conn.requestNonce[:]))
+	if c.tcpKeepAlivePeriod > 0 {
+		if tcpConn, isTCPConn := common.Cast[*net.TCPConn](upstream); isTCPConn {
+			_ = tcpConn.SetKeepAlive(true)
+			_ = tcpConn.SetKeepAlivePeriod(c.tcpKeepAlivePeriod)
+		}
+	}
+	common.Must1(io.ReadFull(c.random, conn.requestKey[:]))
+	common.Must1(io.ReadFull(c.random, conn.requestNonce[:]))
 
 	security := c.security
 	var option byte
 
 	switch security {
-	case SecurityTypeNone:
+	case SecurityTypeNone, SecurityTypeZero:
+		security = SecurityTypeNone
 		if command == CommandUDP {
 			option = RequestOptionChunkStream
 		}
 	case SecurityTypeLegacy:
 		option = RequestOptionChunkStream
-	case SecurityTypeAes128Gcm, SecurityTypeChacha20Poly1305:
-		option = RequestOptionChunkStream | RequestOptionChunkMasking
+	default:
+		option = RequestOptionChunkStream
+		if !c.disableChunkMasking {
+			option |= RequestOptionChunkMasking
+		}
 		if c.globalPadding {
 			option |= RequestOptionGlobalPadding
 		}
 		if c.authenticatedLength {
 			option |= RequestOptionAuthenticatedLength
 		}
+		if c.rekey {
+			option |= RequestOptionRekey
+		}
+	}
+
+	if c.compression && command == CommandTCP {
+		option |= RequestOptionCompression
+	}
+
+	if c.sessionTickets != nil && !c.legacyProtocol {
+		option |= requestOptionSessionTicket
 	}
 
 	if option&RequestOptionChunkStream != 0 && command == CommandTCP || command == CommandMux {
 		conn.readBuffer = true
 	}
 
+	if c.packetFragment && command == CommandUDP {
+		conn.reserved |= requestReservedPacketFragment
+	}
+	if c.paddingPolicy != nil {
+		conn.reserved |= requestReservedPaddingPolicy
+	}
+	if option&RequestOptionRekey != 0 {
+		conn.reserved |= c.rekeyShift << requestReservedRekeyShift
+	}
+
 	conn.security = security
 	conn.option = option
 	return conn
 }
 
+func (c *rawClientConn) HandshakeState() HandshakeState {
+	return c.handshake.State()
+}
+
 func (c *rawClientConn) NeedHandshake() bool {
 	return c.writer == nil
 }
 
 func (c *rawClientConn) writeHandshake(payload []byte) error {
-	paddingLen := mRand.Intn(16)
-
-	var headerLen int
-	headerLen += 1  // version
-	headerLen += 16 // request iv
-	headerLen += 16 // request key
-	headerLen += 1  // response header
-	headerLen += 1  // option
-	headerLen += 1  // padding<<4 || security
-	headerLen += 1  // reversed
-	headerLen += 1  // command
-	if c.command != CommandMux {
-		headerLen += AddressSerializer.AddrPortLen(c.destination)
-	}
-	headerLen += paddingLen
-	headerLen += 4 // fnv1a hash
-
-	if c.alterId > 0 {
+	return c.writeHandshakeContext(c.ctx, payload)
+}
+
+func (c *rawClientConn) writeHandshakeContext(ctx context.Context, payload []byte) error {
+	err := c.handshake.failure()
+	if err != nil {
+		return err
+	}
+	err = c.resolveDestination(ctx)
+	if err == nil {
+		c.handshakeStart = time.Now()
+		err = handshakeContext(ctx, c.Conn, c.deadlines, func() error {
+			return c.writeRequest(payload)
+		})
+	}
+	if err != nil {
+		c.handshake.fail(err)
+	}
+	return err
+}
+
+func (c *rawClientConn) writeRequest(payload []byte) error {
+	var paddingLen [1]byte
+	if !c.disableHeaderPadding {
+		common.Must1(io.ReadFull(c.random, paddingLen[:]))
+	}
+	request := c.requestHeader(int(paddingLen[0] & 0x0F))
+	c.stats.trace("vmess: write request command=", request.Command, " security=", request.Security, " option=", request.Option, " destination=", request.Destination, " padding=", request.PaddingLength, " legacy=", c.legacyProtocol)
+	c.stats.recordRequest(request.Command, request.Security, request.Option, request.Destination, request.PaddingLength, c.legacyProtocol)
+	headerLen := request.Len()
+
+	if c.legacyProtocol {
 		var requestLen int
 		requestLen += 16 // alter id
 		requestLen += headerLen
@@ -191,13 +388,16 @@ func (c *rawClientConn) writeHandshake(payload []byte) error {
 		requestBuffer := buf.NewSize(requestLen)
 		defer requestBuffer.Release()
 
-		timestamp := uint64(c.time().Unix())
-		idHash := hmac.New(md5.New, c.alterKey[:])
+		timestamp := uint64(request.Timestamp.Unix())
+		var alterIndex [2]byte
+		common.Must1(io.ReadFull(c.random, alterIndex[:]))
+		alterKey := c.alterKeys[int(binary.BigEndian.Uint16(alterIndex[:]))%len(c.alterKeys)]
+		idHash := hmac.New(md5.New, alterKey[:])
 		common.Must(binary.Write(idHash, binary.BigEndian, timestamp))
 		idHash.Sum(requestBuffer.Extend(md5.Size)[:0])
 
 		headerBuffer := buf.With(requestBuffer.Extend(headerLen))
-		c.encodeHeader(headerBuffer, paddingLen)
+		request.encode(headerBuffer, c.random)
 
 		timeHash := md5.New()
 		common.Must(binary.Write(timeHash, binary.BigEndian, timestamp))
@@ -207,78 +407,80 @@ func (c *rawClientConn) writeHandshake(payload []byte) error {
 		newAesStream(c.key[:], timeHash.Sum(nil), cipher.NewCFBEncrypter).XORKeyStream(headerBuffer.Bytes(), headerBuffer.Bytes())
 
 		var writer io.Writer
-		var bufferedWriter *bufio.BufferedWriter
-		var err error
+		var earlyWriter *handshakeWriter
 		if len(payload) > 0 {
-			bufferedWriter = bufio.NewBufferedWriter(c.Conn, buf.New())
-			_, err = bufferedWriter.Write(requestBuffer.Bytes())
-			writer = bufferedWriter
+			earlyWriter = newHandshakeWriter(c.Conn)
+			writer = earlyWriter
 		} else {
 			writer = c.Conn
-			_, err = c.Conn.Write(requestBuffer.Bytes())
 		}
+		err := c.handshake.transition(HandshakeStateRequestSent)
 		if err != nil {
 			return err
 		}
-		c.writer = bufio.NewExtendedWriter(CreateWriter(writer, nil, c.requestKey[:], c.requestNonce[:], c.requestKey[:], c.requestNonce[:], c.security, c.option))
+		_, err = writer.Write(requestBuffer.Bytes())
+		if err != nil {
+			return err
+		}
+		c.writer = bufio.NewExtendedWriter(CreateWriter(c.connWriter(writer), nil, c.requestKey[:], c.requestNonce[:], c.requestKey[:], c.requestNonce[:], c.security, c.option, c.writerOptions()...))
+		c.stats.attach(c.writer)
+		setPaddingPolicy(c.writer, c.paddingPolicy)
+		setPacer(c.writer, c.pacer)
 		if len(payload) > 0 {
-			_, err = c.writer.Write(payload)
+			err = c.writeEarlyPayload(payload)
 			if err != nil {
 				return err
 			}
-			err = bufferedWriter.Fallthrough()
+			err = flushCoalescingWriter(c.writer)
+			if err != nil {
+				return err
+			}
+			err = earlyWriter.flush()
 			if err != nil {
 				return err
 			}
 		}
 	} else {
-		const headerLenBufferLen = 2 + CipherOverhead
-
-		var requestLen int
-		requestLen += 16 // auth id
-		requestLen += headerLenBufferLen
-		requestLen += 8 // connection nonce
-		requestLen += headerLen + CipherOverhead
-
-		requestBuffer := buf.NewSize(requestLen)
+		requestBuffer := buf.NewSize(request.sealedLen())
 		defer requestBuffer.Release()
-
-		AuthID(c.key, c.time(), requestBuffer)
-		authId := requestBuffer.Bytes()
-
-		headerLenBuffer := buf.With(requestBuffer.Extend(headerLenBufferLen))
-		connectionNonce := requestBuffer.WriteRandom(8)
-
-		common.Must(binary.Write(headerLenBuffer, binary.BigEndian, uint16(headerLen)))
-		lengthKey := KDF(c.key[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)[:16]
-		lengthNonce := KDF(c.key[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
-		newAesGcm(lengthKey).Seal(headerLenBuffer.Index(0), lengthNonce, headerLenBuffer.Bytes(), authId)
-
-		headerBuffer := buf.With(requestBuffer.Extend(headerLen + CipherOverhead))
-		c.encodeHeader(headerBuffer, paddingLen)
-		headerKey := KDF(c.key[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)[:16]
-		headerNonce := KDF(c.key[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
-		newAesGcm(headerKey).Seal(headerBuffer.Index(0), headerNonce, headerBuffer.Bytes(), authId)
+		if ticket := c.sessionTickets.take(c.time()); ticket != nil {
+			request.sealTicket(ticket, c.random, requestBuffer)
+			c.ticketed = true
+			c.stats.trace("vmess: resume with session ticket")
+		} else {
+			request.seal(c.key, c.authIDCipher, c.chachaHeader, c.random, requestBuffer)
+		}
 
 		var writer io.Writer
-		var bufferedWriter *bufio.BufferedWriter
+		var earlyWriter *handshakeWriter
 		if len(payload) > 0 {
-			bufferedWriter = bufio.NewBufferedWriter(c.Conn, buf.New())
-			writer = bufferedWriter
+			earlyWriter = newHandshakeWriter(c.Conn)
+			writer = earlyWriter
 		} else {
 			writer = c.Conn
 		}
-		_, err := writer.Write(requestBuffer.Bytes())
+		err := c.handshake.transition(HandshakeStateRequestSent)
 		if err != nil {
 			return err
 		}
-		c.writer = bufio.NewExtendedWriter(CreateWriter(writer, nil, c.requestKey[:], c.requestNonce[:], c.requestKey[:], c.requestNonce[:], c.security, c.option))
+		_, err = writer.Write(requestBuffer.Bytes())
+		if err != nil {
+			return err
+		}
+		c.writer = bufio.NewExtendedWriter(CreateWriter(c.connWriter(writer), nil, c.requestKey[:], c.requestNonce[:], c.requestKey[:], c.requestNonce[:], c.security, c.option, c.writerOptions()...))
+		c.stats.attach(c.writer)
+		setPaddingPolicy(c.writer, c.paddingPolicy)
+		setPacer(c.writer, c.pacer)
 		if len(payload) > 0 {
-			_, err = c.writer.Write(payload)
+			err = c.writeEarlyPayload(payload)
+			if err != nil {
+				return err
+			}
+			err = flushCoalescingWriter(c.writer)
 			if err != nil {
 				return err
 			}
-			err = bufferedWriter.Fallthrough()
+			err = earlyWriter.flush()
 			if err != nil {
 				return err
 			}
@@ -287,56 +489,105 @@ func (c *rawClientConn) writeHandshake(payload []byte) error {
 	return nil
 }
 
-func (c *rawClientConn) encodeHeader(headerBuffer *buf.Buffer, paddingLen int) {
-	common.Must(headerBuffer.WriteByte(Version))
-	common.Must1(headerBuffer.Write(c.requestNonce[:]))
+func (c *rawClientConn) writeEarlyPayload(payload []byte) error {
+	if c.command == CommandUDP {
+		return writePacket(c.writer, buf.As(payload), c.fragmentPackets())
+	}
+	return common.Error(c.writer.Write(payload))
+}
 
-	common.Must1(headerBuffer.Write(c.requestKey[:]))
-	c.responseHeader = headerBuffer.WriteRandom(1)[0]
-	common.Must(headerBuffer.WriteByte(c.option))
-	common.Must(headerBuffer.WriteByte(byte(paddingLen<<4) | c.security))
-	common.Must(headerBuffer.WriteZero())
-	common.Must(headerBuffer.WriteByte(c.command))
-	if c.command != CommandMux {
-		common.Must(AddressSerializer.WriteAddrPort(headerBuffer, c.destination))
+func (c *rawClientConn) fragmentPackets() bool {
+	return c.reserved&requestReservedPacketFragment != 0
+}
+
+func (c *rawClientConn) HandshakeSuccess() error {
+	if c.writer == nil {
+		return c.writeHandshake(nil)
 	}
-	if paddingLen > 0 {
-		headerBuffer.Extend(paddingLen)
+	return nil
+}
+
+func (c *rawClientConn) requestHeader(paddingLen int) *RequestHeader {
+	var responseHeader [1]byte
+	common.Must1(io.ReadFull(c.random, responseHeader[:]))
+	c.responseHeader = responseHeader[0]
+	return &RequestHeader{
+		Timestamp:      c.time(),
+		RequestKey:     c.requestKey,
+		RequestNonce:   c.requestNonce,
+		ResponseHeader: c.responseHeader,
+		Option:         c.option,
+		Security:       c.security,
+		Reserved:       c.reserved,
+		Command:        c.command,
+		Destination:    c.destination,
+		PaddingLength:  paddingLen,
 	}
-	headerHash := fnv.New32a()
-	common.Must1(headerHash.Write(headerBuffer.Bytes()))
-	headerHash.Sum(headerBuffer.Extend(4)[:0])
 }
 
 func (c *rawClientConn) readResponse() error {
-	if c.alterId > 0 {
+	return c.readResponseContext(c.ctx)
+}
+
+func (c *rawClientConn) readResponseContext(ctx context.Context) error {
+	err := c.handshake.failure()
+	if err != nil {
+		return err
+	}
+	if c.responseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.responseTimeout)
+		defer cancel()
+	}
+	err = handshakeContext(ctx, c.Conn, c.deadlines, c.readResponseHeader)
+	if err != nil {
+		c.handshake.fail(err)
+		return err
+	}
+	c.stats.handshakeDone(c.handshakeStart)
+	return c.handshake.transition(HandshakeStateEstablished)
+}
+
+func (c *rawClientConn) readResponseHeader() error {
+	if c.legacyProtocol {
 		responseKey := md5.Sum(c.requestKey[:])
 		responseIv := md5.Sum(c.requestNonce[:])
 
-		headerReader := NewStreamReader(c.Conn, responseKey[:], responseIv[:])
+		upstream := newStatsReader(c.Conn, c.stats)
+		headerReader := NewStreamReader(upstream, responseKey[:], responseIv[:])
 		response := buf.NewSize(4)
 		defer response.Release()
-		_, err := response.ReadFullFrom(headerReader, response.FreeLen())
+		n, err := response.ReadFullFrom(headerReader, response.FreeLen())
 		if err != nil {
-			return err
+			return interruptedHandshake(err, n, 4)
 		}
 
+		err = c.verifyResponse(response.Bytes())
+		if err != nil {
+			return err
+		}
 		if response.Byte(0) != c.responseHeader {
-			return E.New("bad response header")
+			return ErrBadResponseHeader
 		}
+		c.stats.trace("vmess: read response option=", response.Byte(1), " command=", response.Byte(2), " command length=", response.Byte(3))
+		c.stats.recordResponse(response.Byte(1), response.Byte(2), int(response.Byte(3)), 0)
 		cmdLen := response.Byte(3)
 		if cmdLen > 0 {
-			_, err = io.CopyN(io.Discard, c.Conn, int64(cmdLen))
+			command := make([]byte, cmdLen)
+			n, err = io.ReadFull(headerReader, command)
 			if err != nil {
-				return err
+				return interruptedHandshake(err, 4+n, 4+int(cmdLen))
 			}
+			c.handleResponseCommand(response.Byte(2), command)
 		}
 
-		reader := CreateReader(c.Conn, headerReader, c.requestKey[:], c.requestNonce[:], responseKey[:], responseIv[:], c.security, c.option)
+		reader := CreateReader(upstream, headerReader, c.requestKey[:], c.requestNonce[:], responseKey[:], responseIv[:], c.security, c.option, c.readerOptions()...)
 		if c.readBuffer {
-			reader = bufio.NewChunkReader(reader, ReadChunkSize)
+			reader = newChunkReader(reader, c.pipelinedRead)
 		}
 		c.reader = bufio.NewExtendedReader(reader)
+		c.stats.attach(c.reader)
+		setPaddingPolicy(c.reader, c.paddingPolicy)
 	} else {
 		_responseKey := sha256.Sum256(c.requestKey[:])
 		responseKey := _responseKey[:16]
@@ -350,14 +601,18 @@ func (c *rawClientConn) readResponse() error {
 		headerLenBuffer := buf.NewSize(2 + CipherOverhead)
 		defer headerLenBuffer.Release()
 
-		_, err := headerLenBuffer.ReadFullFrom(c.Conn, headerLenBuffer.FreeLen())
+		n, err := headerLenBuffer.ReadFullFrom(c.Conn, headerLenBuffer.FreeLen())
 		if err != nil {
+			err = interruptedHandshake(err, n, 2+CipherOverhead)
+			if c.ticketed {
+				return wrapCategoryError(ErrSessionTicketRejected, err, "read response")
+			}
 			return err
 		}
 
 		_, err = headerLenCipher.Open(headerLenBuffer.Index(0), headerLenNonce, headerLenBuffer.Bytes(), nil)
 		if err != nil {
-			return err
+			return wrapCategoryError(ErrHeaderDecode, err, "open response header length")
 		}
 
 		var headerLen uint16
@@ -365,6 +620,9 @@ func (c *rawClientConn) readResponse() error {
 		if err != nil {
 			return err
 		}
+		if headerLen < 4 || int(headerLen) > 4+255+c.maxResponsePadding {
+			return E.Extend(ErrBadResponseHeader, "length ", headerLen)
+		}
 
 		headerKey := KDF(responseKey, KDFSaltConstAEADRespHeaderPayloadKey)[:16]
 		headerNonce := KDF(responseNonce, KDFSaltConstAEADRespHeaderPayloadIV)[:12]
@@ -373,49 +631,221 @@ func (c *rawClientConn) readResponse() error {
 		headerBuffer := buf.NewSize(int(headerLen) + CipherOverhead)
 		defer headerBuffer.Release()
 
-		_, err = headerBuffer.ReadFullFrom(c.Conn, headerBuffer.FreeLen())
+		n, err = headerBuffer.ReadFullFrom(c.Conn, headerBuffer.FreeLen())
 		if err != nil {
-			return err
+			return interruptedHandshake(err, 2+CipherOverhead+n, 2+CipherOverhead+int(headerLen)+CipherOverhead)
 		}
 
 		_, err = headerCipher.Open(headerBuffer.Index(0), headerNonce, headerBuffer.Bytes(), nil)
 		if err != nil {
-			return err
+			return wrapCategoryError(ErrHeaderDecode, err, "open response header")
 		}
 		headerBuffer.Truncate(int(headerLen))
+		err = c.verifyResponse(headerBuffer.Bytes())
+		if err != nil {
+			return err
+		}
+		if headerBuffer.Byte(0) != c.responseHeader || 4+int(headerBuffer.Byte(3)) > headerBuffer.Len() {
+			return ErrBadResponseHeader
+		}
+		c.stats.trace("vmess: read response option=", headerBuffer.Byte(1), " command=", headerBuffer.Byte(2), " command length=", headerBuffer.Byte(3), " padding=", headerBuffer.Len()-4-int(headerBuffer.Byte(3)))
+		c.stats.recordResponse(headerBuffer.Byte(1), headerBuffer.Byte(2), int(headerBuffer.Byte(3)), headerBuffer.Len()-4-int(headerBuffer.Byte(3)))
+		if cmdLen := int(headerBuffer.Byte(3)); cmdLen > 0 {
+			c.handleResponseCommand(headerBuffer.Byte(2), append([]byte(nil), headerBuffer.Range(4, 4+cmdLen)...))
+		}
 
-		reader := CreateReader(c.Conn, nil, c.requestKey[:], c.requestNonce[:], responseKey, responseNonce, c.security, c.option)
+		reader := CreateReader(newStatsReader(c.Conn, c.stats), nil, c.requestKey[:], c.requestNonce[:], responseKey, responseNonce, c.security, c.option, c.readerOptions()...)
 		if c.readBuffer {
-			reader = bufio.NewChunkReader(reader, ReadChunkSize)
+			reader = newChunkReader(reader, c.pipelinedRead)
 		}
 		c.reader = bufio.NewExtendedReader(reader)
+		c.stats.attach(c.reader)
+		setPaddingPolicy(c.reader, c.paddingPolicy)
 	}
 	return nil
 }
 
+func (c *rawClientConn) handleResponseCommand(command byte, content []byte) {
+	if command == 0 {
+		return
+	}
+	// like v2ray, a command failing its checksum is dropped without
+	// failing the connection
+	responseCommand, loaded := parseResponseCommand(command, content)
+	if !loaded {
+		return
+	}
+	if command == responseCommandSessionTicket && c.sessionTickets != nil {
+		if ticket, loaded := parseSessionTicket(responseCommand.Payload, c.time()); loaded {
+			c.sessionTickets.store(ticket)
+		}
+		return
+	}
+	if c.responseCommand != nil {
+		c.responseCommand(responseCommand)
+	}
+}
+
+func (c *rawClientConn) connWriter(upstream io.Writer) io.Writer {
+	if c.command != CommandUDP && c.writeAggregation > 0 {
+		c.aggregate = newAggregateWriter(upstream, c.writeAggregation)
+		upstream = c.aggregate
+	}
+	var writer io.Writer = newDeadlineWriter(upstream, c.deadline)
+	if c.command == CommandUDP {
+		c.batch = newPacketBatchWriter(writer)
+		writer = c.batch
+	}
+	return newStatsWriter(writer, c.stats)
+}
+
+func (c *rawClientConn) writerOptions() []WriterOption {
+	var options []WriterOption
+	if c.command == CommandTCP && c.writeCoalescing > 0 {
+		options = append(options, WriterWithCoalescing(c.writeCoalescing))
+	}
+	if c.command != CommandUDP && c.uniformChunkSize > 0 {
+		options = append(options, WriterWithUniformChunks(c.uniformChunkSize))
+	}
+	if c.security == SecurityTypeAes256Gcm {
+		options = append(options, WriterWithCommandKey(c.key[:]))
+	}
+	if c.faultInjector != nil {
+		options = append(options, WriterWithFaultInjector(c.faultInjector))
+	}
+	if c.command != CommandUDP && c.chunkSize > 0 {
+		options = append(options, WriterWithChunkSize(c.chunkSize))
+	}
+	if shift := c.reserved >> requestReservedRekeyShift; shift > 0 {
+		options = append(options, WriterWithRekeyInterval(1<<shift))
+	}
+	return options
+}
+
+func (c *rawClientConn) readerOptions() []ReaderOption {
+	var options []ReaderOption
+	if c.command != CommandUDP && c.uniformChunkSize > 0 {
+		options = append(options, ReaderWithUniformChunks(c.uniformChunkSize))
+	}
+	if c.security == SecurityTypeAes256Gcm {
+		options = append(options, ReaderWithCommandKey(c.key[:]))
+	}
+	if c.faultInjector != nil {
+		options = append(options, ReaderWithFaultInjector(c.faultInjector))
+	}
+	if shift := c.reserved >> requestReservedRekeyShift; shift > 0 {
+		options = append(options, ReaderWithRekeyInterval(1<<shift))
+	}
+	return options
+}
+
 func (c *rawClientConn) Close() error {
 	return common.Close(
+		common.Closer(func() error {
+			return closeCoalescingWriter(c.writer)
+		}),
 		c.Conn,
 		c.reader,
 	)
 }
 
+func (c *rawClientConn) CloseWrite() error {
+	if c.writer == nil {
+		err := c.writeHandshake(nil)
+		if err != nil {
+			return err
+		}
+	}
+	err := writeEndOfStream(c.writer, c.option)
+	if err != nil {
+		return err
+	}
+	return rw.CloseWrite(c.Conn)
+}
+
+func (c *rawClientConn) CloseRead() error {
+	switch reader := c.reader.(type) {
+	case *ChunkReader, *PipelinedReader:
+		common.Close(reader)
+	}
+	return rw.CloseRead(c.Conn)
+}
+
+func (c *rawClientConn) Stats() ConnStats {
+	return c.stats.snapshot(c.command, c.security, c.option)
+}
+
 func (c *rawClientConn) FrontHeadroom() int {
-	return MaxFrontHeadroom
+	if c.writer != nil {
+		return 0
+	}
+	return MaxFrontHeadroom + N.CalculateFrontHeadroom(c.Conn)
 }
 
 func (c *rawClientConn) RearHeadroom() int {
-	return MaxRearHeadroom
+	if c.writer != nil {
+		return 0
+	}
+	return MaxRearHeadroom + N.CalculateRearHeadroom(c.Conn)
 }
 
 func (c *rawClientConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
 
+func (c *rawClientConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	c.deadlines.setRead(t)
+	c.deadlines.setWrite(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *rawClientConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.setRead(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *rawClientConn) SetWriteDeadline(t time.Time) error {
+	c.deadline.set(t)
+	c.deadlines.setWrite(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
 func (c *rawClientConn) Upstream() any {
 	return c.Conn
 }
 
+func (c *rawClientConn) Endpoint() M.Socksaddr {
+	if c.endpoint.IsValid() {
+		return c.endpoint
+	}
+	return M.SocksaddrFromNet(c.Conn.RemoteAddr())
+}
+
+func (c *rawClientConn) setEndpoint(server M.Socksaddr) {
+	c.endpoint = server
+}
+
+func (c *rawClientConn) transparent() bool {
+	return c.command == CommandTCP && c.security == SecurityTypeNone && c.option&RequestOptionChunkStream == 0 && c.option&RequestOptionCompression == 0
+}
+
+func (c *rawClientConn) ReaderReplaceable() bool {
+	return c.reader != nil && c.transparent()
+}
+
+func (c *rawClientConn) WriterReplaceable() bool {
+	return c.writer != nil && c.transparent()
+}
+
+func (c *rawClientConn) UpstreamReader() any {
+	return c.reader
+}
+
+func (c *rawClientConn) UpstreamWriter() any {
+	return c.writer
+}
+
 type clientConn struct {
 	rawClientConn
 }
@@ -438,7 +868,7 @@ func (c *clientConn) Write(p []byte) (n int, err error) {
 		}
 		return
 	}
-	return c.writer.Write(p)
+	return c.aggregate.write(c.writer, p)
 }
 
 func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
@@ -453,9 +883,10 @@ func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
 
 func (c *clientConn) WriteBuffer(buffer *buf.Buffer) error {
 	if c.writer == nil {
+		defer buffer.Release()
 		return c.writeHandshake(buffer.Bytes())
 	}
-	return c.writer.WriteBuffer(buffer)
+	return c.aggregate.writeBuffer(c.writer, buffer)
 }
 
 /*func (c *clientConn) ReadFrom(r io.Reader) (n int64, err error) {
@@ -490,22 +921,38 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 			return
 		}
 	}
-	n, err = c.reader.Read(p)
+	buffer := buf.With(p)
+	err = readPacket(c.reader, buffer, c.fragmentPackets())
 	if err != nil {
 		return
 	}
+	n = copy(p, buffer.Bytes())
 	addr = c.destination.UDPAddr()
 	return
 }
 
+func (c *clientPacketConn) checkDestination(destination M.Socksaddr) error {
+	if destination.IsValid() && destination.Unwrap() != c.destination.Unwrap() {
+		return E.Extend(ErrPacketDestination, destination, ", expected ", c.destination)
+	}
+	return nil
+}
+
 func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	err = c.checkDestination(M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
 	if c.writer == nil {
-		err = c.writeHandshake(nil)
-		if err != nil {
-			return
-		}
+		err = c.writeHandshake(p)
+	} else {
+		err = writePacket(c.writer, buf.As(p), c.fragmentPackets())
 	}
-	return c.writer.Write(p)
+	if err != nil {
+		return
+	}
+	n = len(p)
+	return
 }
 
 func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
@@ -515,7 +962,7 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksad
 			return
 		}
 	}
-	err = c.reader.ReadBuffer(buffer)
+	err = readPacket(c.reader, buffer, c.fragmentPackets())
 	if err != nil {
 		return
 	}
@@ -524,12 +971,34 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksad
 }
 
 func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	err := c.checkDestination(destination)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
 	if c.writer == nil {
-		err := c.writeHandshake(nil)
+		defer buffer.Release()
+		return c.writeHandshake(buffer.Bytes())
+	}
+	return writePacket(c.writer, buffer, c.fragmentPackets())
+}
+
+func (c *clientPacketConn) WriteMultiPacket(buffers []*buf.Buffer, destination M.Socksaddr) error {
+	if len(buffers) == 0 {
+		return nil
+	}
+	err := c.checkDestination(destination)
+	if err != nil {
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	if c.writer == nil {
+		err = c.WritePacket(buffers[0], destination)
 		if err != nil {
-			buffer.Release()
+			buf.ReleaseMulti(buffers[1:])
 			return err
 		}
+		buffers = buffers[1:]
 	}
-	return c.writer.WriteBuffer(buffer)
+	return writeMultiPacket(c.writer, c.batch, buffers, c.fragmentPackets())
 }
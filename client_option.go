@@ -1,16 +1,49 @@
 package vmess
 
+import (
+	"io"
+	"time"
+)
+
 type ClientOption func(*Client)
 
 func ClientWithGlobalPadding() ClientOption {
+	return ClientWithGlobalPaddingEnabled(true)
+}
+
+func ClientWithAuthenticatedLength() ClientOption {
+	return ClientWithAuthenticatedLengthEnabled(true)
+}
+
+// ClientWithHeaderPadding(false) sends request headers without the random padding v2fly clients add.
+func ClientWithHeaderPadding(enabled bool) ClientOption {
 	return func(client *Client) {
-		client.globalPadding = true
+		client.disableHeaderPadding = !enabled
 	}
 }
 
-func ClientWithAuthenticatedLength() ClientOption {
+func ClientWithChunkMasking(enabled bool) ClientOption {
+	return func(client *Client) {
+		client.disableChunkMasking = !enabled
+	}
+}
+
+func ClientWithGlobalPaddingEnabled(enabled bool) ClientOption {
+	return func(client *Client) {
+		client.globalPadding = enabled
+	}
+}
+
+func ClientWithAuthenticatedLengthEnabled(enabled bool) ClientOption {
+	return func(client *Client) {
+		client.authenticatedLength = enabled
+	}
+}
+
+// ClientWithSecurity selects a security id added with RegisterSecurity.
+func ClientWithSecurity(id byte) ClientOption {
 	return func(client *Client) {
-		client.authenticatedLength = true
+		client.security = id
 	}
 }
 
@@ -19,3 +52,172 @@ func ClientWithTimeFunc(timeFunc TimeFunc) ClientOption {
 		client.time = timeFunc
 	}
 }
+
+func ClientWithRandom(random io.Reader) ClientOption {
+	return func(client *Client) {
+		client.random = random
+	}
+}
+
+func ClientWithWriteCoalescing(delay time.Duration) ClientOption {
+	return func(client *Client) {
+		client.writeCoalescing = delay
+	}
+}
+
+// ClientWithTCPKeepAlive enables TCP keepalive probes on a *net.TCPConn upstream, nothing is sent in-band.
+func ClientWithTCPKeepAlive(period time.Duration) ClientOption {
+	return func(client *Client) {
+		client.tcpKeepAlivePeriod = period
+	}
+}
+
+func ClientWithResponseTimeout(timeout time.Duration) ClientOption {
+	return func(client *Client) {
+		client.responseTimeout = timeout
+	}
+}
+
+func ClientWithMaxResponsePadding(length int) ClientOption {
+	return func(client *Client) {
+		client.maxResponsePadding = length
+	}
+}
+
+func ClientWithPipelinedRead(depth int) ClientOption {
+	return func(client *Client) {
+		client.pipelinedRead = depth
+	}
+}
+
+func ClientWithChacha20Poly1305Header() ClientOption {
+	return func(client *Client) {
+		client.chachaHeader = true
+	}
+}
+
+func ClientWithRekey() ClientOption {
+	return func(client *Client) {
+		client.rekey = true
+	}
+}
+
+// ClientWithRekeyInterval enables rekey and asks both sides to rekey every chunks chunks, see ReaderWithRekeyInterval.
+func ClientWithRekeyInterval(chunks int) ClientOption {
+	return func(client *Client) {
+		client.rekey = true
+		client.rekeyShift = rekeyIntervalShift(chunks)
+	}
+}
+
+func ClientWithPaddingPolicy(policy PaddingPolicy) ClientOption {
+	return func(client *Client) {
+		client.paddingPolicy = policy
+	}
+}
+
+func ClientWithPacer(pacer Pacer) ClientOption {
+	return func(client *Client) {
+		client.pacer = pacer
+	}
+}
+
+// Deprecated: the legacy header is only accepted by servers that still allow alterId users.
+func ClientWithLegacyProtocol(enabled bool) ClientOption {
+	return func(client *Client) {
+		client.legacyProtocol = enabled
+	}
+}
+
+func ClientWithCompression() ClientOption {
+	return func(client *Client) {
+		client.compression = true
+	}
+}
+
+func ClientWithSessionTickets() ClientOption {
+	return func(client *Client) {
+		client.sessionTickets = &sessionTicketCache{}
+	}
+}
+
+func ClientWithResponseCommandCallback(callback ResponseCommandCallback) ClientOption {
+	return func(client *Client) {
+		client.responseCommand = callback
+	}
+}
+
+func ClientWithResponseVerifier(verifier ResponseVerifier) ClientOption {
+	return func(client *Client) {
+		client.responseVerifier = verifier
+	}
+}
+
+func ClientWithRecorder(recorder *Recorder) ClientOption {
+	return func(client *Client) {
+		client.recorder = recorder
+	}
+}
+
+func ClientWithCommandKey(key [16]byte) ClientOption {
+	return func(client *Client) {
+		client.key = key
+		client.authIDCipher = newAuthIDCipher(key)
+		client.commandKey = true
+	}
+}
+
+func ClientWithFaultInjector(injector FaultInjector) ClientOption {
+	return func(client *Client) {
+		client.faultInjector = injector
+	}
+}
+
+func ClientWithDomainStrategy(strategy DomainStrategy) ClientOption {
+	return func(client *Client) {
+		client.domainStrategy = strategy
+	}
+}
+
+func ClientWithDomainResolver(resolver DomainResolver) ClientOption {
+	return func(client *Client) {
+		client.domainResolver = resolver
+	}
+}
+
+func ClientWithChunkSize(size int) ClientOption {
+	return func(client *Client) {
+		client.chunkSize = writeChunkSize(size)
+	}
+}
+
+func ClientWithHandshakeObserver(observer HandshakeObserver) ClientOption {
+	return func(client *Client) {
+		client.handshakeObserver = observer
+	}
+}
+
+func ClientWithLogger(logger Logger) ClientOption {
+	return func(client *Client) {
+		client.logger = logger
+	}
+}
+
+func ClientWithUniformChunks(size int) ClientOption {
+	return func(client *Client) {
+		client.uniformChunkSize = uniformChunkSize(size)
+	}
+}
+
+func ClientWithWriteAggregation(size int) ClientOption {
+	return func(client *Client) {
+		client.writeAggregation = writeAggregationSize(size)
+	}
+}
+
+// ClientWithPacketFragmentation splits UDP datagrams larger than one chunk, the server must support it too.
+func ClientWithPacketFragmentation() ClientOption {
+	return func(client *Client) {
+		client.packetFragment = true
+	}
+}
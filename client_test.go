@@ -0,0 +1,115 @@
+package vmess
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type warnLogger struct {
+	logger.ContextLogger
+	warnings int
+}
+
+func (l *warnLogger) WarnContext(ctx context.Context, args ...any) {
+	l.warnings++
+}
+
+func TestLegacyProtocolWarning(t *testing.T) {
+	for _, test := range []struct {
+		alterId  int
+		options  []ClientOption
+		warnings int
+	}{
+		{0, nil, 0},
+		{1, nil, 1},
+		{1, []ClientOption{ClientWithLegacyProtocol(false)}, 0},
+	} {
+		warnings := &warnLogger{ContextLogger: logger.NOP()}
+		_, err := NewClient(testUserID, "aes-128-gcm", test.alterId, append(test.options, ClientWithLogger(warnings))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warnings.warnings != test.warnings {
+			t.Fatal("alterId=", test.alterId, ": expected ", test.warnings, " warnings, got ", warnings.warnings)
+		}
+	}
+}
+
+type serviceDialer struct {
+	service *Service[int]
+}
+
+func (d *serviceDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	upstream, _ := serveTestConn(d.service)
+	return upstream, nil
+}
+
+func (d *serviceDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, os.ErrInvalid
+}
+
+var _ N.Dialer = (*serviceDialer)(nil)
+
+type destinationHandler struct {
+	echoHandler
+	destinations chan M.Socksaddr
+}
+
+func (h *destinationHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.destinations <- metadata.Destination
+	return h.echoHandler.NewConnection(ctx, conn, metadata)
+}
+
+func (h *destinationHandler) NewMuxConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error {
+	return h.NewConnection(ctx, conn, metadata)
+}
+
+func TestDialMux(t *testing.T) {
+	handler := &destinationHandler{destinations: make(chan M.Socksaddr, 1)}
+	service := newTestService(t, &echoHandler{}, ServiceWithMuxHandler(handler))
+	client := newTestClient(t, testUserID)
+	outbound, err := NewOutbound(&serviceDialer{service}, M.ParseSocksaddr("127.0.0.1:443"), testUserID, "aes-128-gcm", 0, PacketEncodingNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		dial func() (net.Conn, error)
+	}{
+		{"DialMuxConn", func() (net.Conn, error) {
+			upstream, _ := serveTestConn(service)
+			return client.DialMuxConn(upstream)
+		}},
+		{"DialEarlyMuxConn", func() (net.Conn, error) {
+			upstream, _ := serveTestConn(service)
+			return client.DialEarlyMuxConn(upstream), nil
+		}},
+		{"Outbound.DialMux", func() (net.Conn, error) {
+			return outbound.DialMux(context.Background())
+		}},
+	} {
+		conn, err := test.dial()
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		_, err = conn.Write([]byte("mux"))
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		_, err = io.ReadFull(conn, make([]byte, 3))
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		if destination := <-handler.destinations; destination != MuxDestination {
+			t.Fatal(test.name, ": mux handler got destination ", destination)
+		}
+		conn.Close()
+	}
+}
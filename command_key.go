@@ -0,0 +1,31 @@
+package vmess
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var (
+	ErrInvalidCommandKey = E.New("vmess: invalid command key")
+	ErrLegacyCommandKey  = E.New("vmess: legacy protocol requires a user id")
+)
+
+// ParseCommandKey reads a command key as 32 hex digits or as base64 in either alphabet, padded or not.
+func ParseCommandKey(key string) (commandKey [16]byte, err error) {
+	if len(key) == hex.EncodedLen(len(commandKey)) {
+		_, err = hex.Decode(commandKey[:], []byte(key))
+		if err == nil {
+			return
+		}
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, decodeErr := encoding.DecodeString(key)
+		if decodeErr == nil && len(decoded) == len(commandKey) {
+			copy(commandKey[:], decoded)
+			return commandKey, nil
+		}
+	}
+	return commandKey, E.Extend(ErrInvalidCommandKey, "not 16 bytes of hex or base64")
+}
@@ -0,0 +1,34 @@
+package vmess
+
+var ErrCommandRejected = newCategoryError(ErrAuthFailed, "command rejected")
+
+type CommandMask byte
+
+const (
+	CommandMaskTCP CommandMask = 1 << iota
+	CommandMaskUDP
+	CommandMaskMux
+	CommandMaskAll = CommandMaskTCP | CommandMaskUDP | CommandMaskMux
+)
+
+// CommandRestrictedUserStore limits each user to the request commands in the returned mask, zero allows all.
+type CommandRestrictedUserStore[U comparable] interface {
+	UserStore[U]
+	AllowedCommands(user U) CommandMask
+}
+
+func (m CommandMask) Allows(command byte) bool {
+	if m == 0 {
+		return true
+	}
+	switch command {
+	case CommandTCP:
+		return m&CommandMaskTCP != 0
+	case CommandUDP:
+		return m&CommandMaskUDP != 0
+	case CommandMux:
+		return m&CommandMaskMux != 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,110 @@
+package vmess
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type compressWriter struct {
+	upstream N.ExtendedWriter
+	access   sync.Mutex
+	buffer   bytes.Buffer
+	deflate  *flate.Writer
+}
+
+func newCompressWriter(upstream io.Writer) *compressWriter {
+	writer := &compressWriter{upstream: bufio.NewExtendedWriter(upstream)}
+	writer.deflate = common.Must1(flate.NewWriter(&writer.buffer, flate.BestSpeed))
+	return writer
+}
+
+func (w *compressWriter) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return w.upstream.Write(p)
+	}
+	w.access.Lock()
+	defer w.access.Unlock()
+	w.buffer.Reset()
+	_, err = w.deflate.Write(p)
+	if err == nil {
+		err = w.deflate.Flush()
+	}
+	if err != nil {
+		return
+	}
+	for compressed := w.buffer.Bytes(); len(compressed) > 0; {
+		chunkLen := len(compressed)
+		if chunkLen > WriteChunkSize {
+			chunkLen = WriteChunkSize
+		}
+		_, err = w.upstream.Write(compressed[:chunkLen])
+		if err != nil {
+			return
+		}
+		compressed = compressed[chunkLen:]
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if buffer.IsEmpty() {
+		return w.upstream.WriteBuffer(buffer)
+	}
+	defer buffer.Release()
+	return common.Error(w.Write(buffer.Bytes()))
+}
+
+func (w *compressWriter) Upstream() any {
+	return w.upstream
+}
+
+type compressReader struct {
+	upstream io.Reader
+	source   *eofReader
+	inflate  io.ReadCloser
+}
+
+func newCompressReader(upstream io.Reader) *compressReader {
+	// the inflater reads in small slices, chunk readers want the whole chunk
+	source := &eofReader{upstream: newTunedChunkReader(upstream, ReadChunkSize)}
+	return &compressReader{
+		upstream: upstream,
+		source:   source,
+		inflate:  flate.NewReader(source),
+	}
+}
+
+func (r *compressReader) Read(p []byte) (n int, err error) {
+	n, err = r.inflate.Read(p)
+	// the deflate stream is never finished, a clean end of the chunk
+	// stream between two flushes is the end of the payload
+	if errors.Is(err, io.ErrUnexpectedEOF) && r.source.eof {
+		err = io.EOF
+	}
+	return
+}
+
+func (r *compressReader) Upstream() any {
+	return r.upstream
+}
+
+type eofReader struct {
+	upstream io.Reader
+	eof      bool
+}
+
+func (r *eofReader) Read(p []byte) (n int, err error) {
+	n, err = r.upstream.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return
+}
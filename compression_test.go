@@ -0,0 +1,104 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible vmess payload "), 8192)
+	service := newTestService(t, &echoHandler{})
+	for _, security := range []string{"aes-128-gcm", "chacha20-poly1305", "none", "zero"} {
+		for _, test := range []struct {
+			name    string
+			options []ClientOption
+		}{
+			{"plain", nil},
+			{"padding", []ClientOption{ClientWithGlobalPadding(), ClientWithAuthenticatedLength()}},
+			{"coalescing", []ClientOption{ClientWithWriteCoalescing(time.Millisecond)}},
+		} {
+			name := security + " " + test.name
+			client, err := NewClient(testUserID, security, 0, append(test.options, ClientWithCompression())...)
+			if err != nil {
+				t.Fatal(name, ": ", err)
+			}
+			upstream, done := serveTestConn(service)
+			recorder := &recordConn{Conn: upstream}
+			conn, err := client.DialConn(recorder, M.ParseSocksaddr("example.com:80"))
+			if err != nil {
+				t.Fatal(name, ": ", err)
+			}
+			go func() {
+				for i := 0; i < len(payload); i += 4096 {
+					conn.Write(payload[i : i+4096])
+				}
+			}()
+			received := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, received)
+			if err != nil {
+				t.Fatal(name, ": ", err)
+			}
+			if !bytes.Equal(received, payload) {
+				t.Fatal(name, ": payload mismatch")
+			}
+			if written := len(recorder.bytes()); written > len(payload)/4 {
+				t.Fatal(name, ": ", written, " bytes sent for ", len(payload), " compressible bytes")
+			}
+			conn.Close()
+			<-done
+		}
+	}
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	service := newTestService(t, &echoHandler{})
+	service.SetSecurityPolicy(func(user int, security byte, option byte) bool {
+		return option&RequestOptionCompression == 0
+	})
+	payload := bytes.Repeat([]byte("vmess"), 1024)
+
+	upstream, done := serveTestConn(service)
+	go newTestClient(t, testUserID, ClientWithCompression()).DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	err := waitHandshake(t, "compressed", done)
+	upstream.Close()
+	if !errors.Is(err, ErrSecurityRejected) {
+		t.Fatal("compressed request accepted by a service refusing compression: ", err)
+	}
+
+	upstream, _ = serveTestConn(service)
+	recorder := &recordConn{Conn: upstream}
+	conn, err := newTestClient(t, testUserID).DialConn(recorder, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write(payload)
+	received := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) || len(recorder.bytes()) < len(payload) {
+		t.Fatal("uncompressed fallback failed")
+	}
+
+	var stream bytes.Buffer
+	key := bytes.Repeat([]byte{1}, 16)
+	nonce := bytes.Repeat([]byte{2}, 16)
+	option := byte(RequestOptionChunkStream)
+	writer := CreateWriter(&stream, nil, key, nonce, key, nonce, SecurityTypeAes128Gcm, option|RequestOptionCompression)
+	_, err = writer.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := newChunkReader(CreateReader(&stream, nil, key, nonce, key, nonce, SecurityTypeAes128Gcm, option), 0)
+	received, _ = io.ReadAll(reader)
+	if bytes.Equal(received, payload) {
+		t.Fatal("compressed stream read as plaintext without the option")
+	}
+}
@@ -0,0 +1,104 @@
+package vmess
+
+import (
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrInvalidConfig = E.New("vmess: invalid config")
+
+type ClientConfig struct {
+	UserID              string
+	CommandKey          string
+	Security            string
+	AlterID             int
+	GlobalPadding       bool
+	AuthenticatedLength bool
+	DisableChunkMasking bool
+}
+
+func NewClientWithConfig(config ClientConfig, options ...ClientOption) (*Client, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	security := config.Security
+	if security == "" {
+		security = "auto"
+	}
+	configOptions := []ClientOption{
+		ClientWithGlobalPaddingEnabled(config.GlobalPadding),
+		ClientWithAuthenticatedLengthEnabled(config.AuthenticatedLength),
+		ClientWithChunkMasking(!config.DisableChunkMasking),
+	}
+	if config.CommandKey != "" {
+		commandKey, err := ParseCommandKey(config.CommandKey)
+		if err != nil {
+			return nil, E.Cause(err, "parse command key")
+		}
+		configOptions = append(configOptions, ClientWithCommandKey(commandKey))
+	}
+	return NewClient(config.UserID, security, config.AlterID, append(configOptions, options...)...)
+}
+
+func (c ClientConfig) validate() error {
+	if c.UserID == "" && c.CommandKey == "" {
+		return E.Extend(ErrInvalidConfig, "missing user id")
+	}
+	if c.UserID != "" && c.CommandKey != "" {
+		return E.Extend(ErrInvalidConfig, "both user id and command key")
+	}
+	if c.AlterID < 0 || c.AlterID > 65535 {
+		return E.Extend(ErrInvalidConfig, "alter id out of range: ", c.AlterID)
+	}
+	return nil
+}
+
+type ServiceConfig struct {
+	TimeTolerance           time.Duration
+	LegacyHeader            bool
+	DisableHeaderProtection bool
+	UDPTimeout              time.Duration
+	UDPMaxSessions          int
+}
+
+func NewServiceWithConfig[U comparable](handler Handler, config ServiceConfig, options ...ServiceOption) (*Service[U], error) {
+	if handler == nil {
+		return nil, E.Extend(ErrInvalidConfig, "missing handler")
+	}
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	var configOptions []ServiceOption
+	if config.TimeTolerance > 0 {
+		configOptions = append(configOptions, ServiceWithTimeTolerance(config.TimeTolerance))
+	}
+	if config.LegacyHeader {
+		configOptions = append(configOptions, ServiceWithLegacyHeader())
+	}
+	if config.DisableHeaderProtection {
+		configOptions = append(configOptions, ServiceWithDisableHeaderProtection())
+	}
+	if config.UDPTimeout > 0 {
+		configOptions = append(configOptions, ServiceWithUDPTimeout(config.UDPTimeout))
+	}
+	if config.UDPMaxSessions > 0 {
+		configOptions = append(configOptions, ServiceWithUDPMaxSessions(config.UDPMaxSessions))
+	}
+	return NewService[U](handler, append(configOptions, options...)...), nil
+}
+
+func (c ServiceConfig) validate() error {
+	if c.TimeTolerance < 0 {
+		return E.Extend(ErrInvalidConfig, "negative time tolerance: ", c.TimeTolerance)
+	}
+	if c.UDPTimeout < 0 {
+		return E.Extend(ErrInvalidConfig, "negative udp timeout: ", c.UDPTimeout)
+	}
+	if c.UDPMaxSessions < 0 {
+		return E.Extend(ErrInvalidConfig, "negative udp session limit: ", c.UDPMaxSessions)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package vmess
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// writeDeadline keeps the first upstream write error and returns it for every later write.
+type writeDeadline struct {
+	deadline int64
+	access   sync.Mutex
+	err      error
+}
+
+func (d *writeDeadline) set(t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(&d.deadline, 0)
+	} else {
+		atomic.StoreInt64(&d.deadline, t.UnixNano())
+	}
+}
+
+func (d *writeDeadline) check() error {
+	d.access.Lock()
+	err := d.err
+	d.access.Unlock()
+	if err != nil {
+		return err
+	}
+	deadline := atomic.LoadInt64(&d.deadline)
+	if deadline != 0 && time.Now().UnixNano() >= deadline {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (d *writeDeadline) fail(err error) error {
+	d.access.Lock()
+	defer d.access.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+	return d.err
+}
+
+type deadlineWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	deadline   *writeDeadline
+}
+
+func newDeadlineWriter(upstream io.Writer, deadline *writeDeadline) *deadlineWriter {
+	return &deadlineWriter{bufio.NewExtendedWriter(upstream), bufio.NewVectorisedWriter(upstream), deadline}
+}
+
+func (w *deadlineWriter) Write(p []byte) (n int, err error) {
+	err = w.deadline.check()
+	if err != nil {
+		return
+	}
+	n, err = w.upstream.Write(p)
+	if err != nil {
+		err = w.deadline.fail(err)
+	}
+	return
+}
+
+func (w *deadlineWriter) WriteBuffer(buffer *buf.Buffer) error {
+	err := w.deadline.check()
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	err = w.upstream.WriteBuffer(buffer)
+	if err != nil {
+		return w.deadline.fail(err)
+	}
+	return nil
+}
+
+func (w *deadlineWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	err := w.deadline.check()
+	if err != nil {
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	err = w.vectorised.WriteVectorised(buffers)
+	if err != nil {
+		return w.deadline.fail(err)
+	}
+	return nil
+}
+
+func (w *deadlineWriter) Upstream() any {
+	return w.upstream
+}
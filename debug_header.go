@@ -0,0 +1,184 @@
+package vmess
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+type HeaderStage uint8
+
+const (
+	HeaderStageAuthID HeaderStage = iota
+	HeaderStageLength
+	HeaderStageHeader
+	HeaderStageVersion
+	HeaderStageCommand
+	HeaderStageDestination
+	HeaderStagePadding
+	HeaderStageChecksum
+)
+
+func (s HeaderStage) String() string {
+	switch s {
+	case HeaderStageAuthID:
+		return "auth id"
+	case HeaderStageLength:
+		return "length aead"
+	case HeaderStageHeader:
+		return "header aead"
+	case HeaderStageVersion:
+		return "version"
+	case HeaderStageCommand:
+		return "command"
+	case HeaderStageDestination:
+		return "destination"
+	case HeaderStagePadding:
+		return "padding bounds"
+	case HeaderStageChecksum:
+		return "checksum"
+	default:
+		return F.ToString("unknown stage ", uint8(s))
+	}
+}
+
+// HeaderIssue offsets index the raw request through HeaderStageHeader and the decrypted header after it.
+type HeaderIssue struct {
+	Stage  HeaderStage
+	Offset int
+	Length int
+	Err    error
+}
+
+func (i HeaderIssue) Error() string {
+	return F.ToString(i.Stage, " at ", i.Offset, "+", i.Length, ": ", i.Err)
+}
+
+type HeaderReport struct {
+	Issues       []HeaderIssue
+	Timestamp    time.Time
+	ChachaHeader bool
+	HeaderLength int
+	Header       []byte
+	Request      *RequestHeader
+	Consumed     int
+}
+
+func (r *HeaderReport) OK() bool {
+	return len(r.Issues) == 0 && r.Request != nil
+}
+
+func (r *HeaderReport) Err() error {
+	if len(r.Issues) == 0 {
+		return nil
+	}
+	return E.Errors(common.Map(r.Issues, func(it HeaderIssue) error {
+		return it
+	})...)
+}
+
+func (r *HeaderReport) fail(stage HeaderStage, offset int, length int, err error) {
+	r.Issues = append(r.Issues, HeaderIssue{stage, offset, length, err})
+}
+
+func DebugDecodeHeader(key [16]byte, request []byte) *HeaderReport {
+	const headerLenBufferLen = 2 + CipherOverhead
+	const nonceIndex = 16 + headerLenBufferLen
+	const headerIndex = nonceIndex + 8
+
+	report := &HeaderReport{}
+	if len(request) < headerIndex {
+		report.fail(HeaderStageAuthID, 0, headerIndex, E.Extend(io.ErrUnexpectedEOF, "have ", len(request)))
+		return report
+	}
+	authId := request[:16]
+	var decodedId [16]byte
+	newAuthIDCipher(key).Decrypt(decodedId[:], authId)
+	report.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(decodedId[:])), 0)
+	if checksum := crc32.ChecksumIEEE(decodedId[:12]); checksum != binary.BigEndian.Uint32(decodedId[12:]) {
+		report.fail(HeaderStageAuthID, 12, 4, E.New("crc32 mismatch: computed ", checksum, ", decoded ", binary.BigEndian.Uint32(decodedId[12:])))
+	}
+
+	connectionNonce := request[nonceIndex:headerIndex]
+	lengthKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)
+	lengthNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
+	lengthBuffer, chachaHeader, err := openHeaderLength(lengthKey, lengthNonce, request[16:nonceIndex], authId, true)
+	if err != nil {
+		report.fail(HeaderStageLength, 16, headerLenBufferLen, err)
+		return report
+	}
+	report.ChachaHeader = chachaHeader
+	report.HeaderLength = int(binary.BigEndian.Uint16(lengthBuffer))
+
+	sealedLen := report.HeaderLength + CipherOverhead
+	if len(request) < headerIndex+sealedLen {
+		report.fail(HeaderStageHeader, headerIndex, sealedLen, E.Extend(io.ErrUnexpectedEOF, "have ", len(request)-headerIndex))
+		return report
+	}
+	headerKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)
+	headerNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
+	header, err := newHeaderAEAD(headerKey, chachaHeader).Open(nil, headerNonce, request[headerIndex:headerIndex+sealedLen], authId)
+	if err != nil {
+		report.fail(HeaderStageHeader, headerIndex, sealedLen, err)
+		return report
+	}
+	report.Header = header
+	report.Consumed = headerIndex + sealedLen
+	report.Request = debugParseHeader(report, header)
+	if report.Request != nil {
+		report.Request.Timestamp = report.Timestamp
+	}
+	return report
+}
+
+func debugParseHeader(report *HeaderReport, header []byte) *RequestHeader {
+	if len(header) < 38+4 {
+		report.fail(HeaderStageHeader, 0, len(header), E.Extend(io.ErrShortBuffer, "need at least ", 38+4))
+		return nil
+	}
+	if header[0] != Version {
+		report.fail(HeaderStageVersion, 0, 1, E.New("expected ", Version, ", got ", header[0]))
+	}
+	request := &RequestHeader{
+		ResponseHeader: header[33],
+		Option:         header[34],
+		PaddingLength:  int(header[35] >> 4),
+		Security:       header[35] & 0x0F,
+		Command:        header[37],
+	}
+	copy(request.RequestNonce[:], header[1:17])
+	copy(request.RequestKey[:], header[17:33])
+	switch request.Command {
+	case CommandTCP, CommandUDP, CommandMux:
+	default:
+		report.fail(HeaderStageCommand, 37, 1, E.New("unknown command ", request.Command))
+	}
+	offset := 38
+	if request.Command != CommandMux {
+		headerReader := bytes.NewReader(header[offset : len(header)-4])
+		destination, err := AddressSerializer.ReadAddrPort(headerReader)
+		if err != nil {
+			report.fail(HeaderStageDestination, offset, len(header)-4-offset, err)
+			return request
+		}
+		request.Destination = destination
+		offset = len(header) - 4 - headerReader.Len()
+	}
+	checksumIndex := len(header) - 4
+	if remaining := checksumIndex - offset; remaining != request.PaddingLength {
+		report.fail(HeaderStagePadding, offset, remaining, E.New("declared ", request.PaddingLength, ", found ", remaining))
+	}
+	headerHash := fnv.New32a()
+	common.Must1(headerHash.Write(header[:checksumIndex]))
+	if checksum := headerHash.Sum32(); checksum != binary.BigEndian.Uint32(header[checksumIndex:]) {
+		report.fail(HeaderStageChecksum, checksumIndex, 4, E.New("fnv1a mismatch: computed ", checksum, ", decoded ", binary.BigEndian.Uint32(header[checksumIndex:])))
+	}
+	return request
+}
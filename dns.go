@@ -0,0 +1,40 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const DNSTimeout = 10 * time.Second
+
+func (c *Client) DialDNS(ctx context.Context, upstream net.Conn, destination M.Socksaddr, message []byte) (*buf.Buffer, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DNSTimeout)
+		defer cancel()
+	}
+	conn := c.dialRaw(ctx, upstream, CommandUDP, destination)
+	conn.option &^= RequestOptionChunkMasking | RequestOptionGlobalPadding
+	defer conn.Close()
+	err := conn.writeHandshakeContext(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.readResponseContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := buf.NewSize(65535)
+	err = handshakeContext(ctx, upstream, conn.deadlines, func() error {
+		return readPacket(conn.reader, response, conn.fragmentPackets())
+	})
+	if err != nil {
+		response.Release()
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,72 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type DomainStrategy byte
+
+const (
+	DomainStrategyRemote DomainStrategy = iota
+	DomainStrategyLocal
+	DomainStrategyPreferIPv4
+	DomainStrategyPreferIPv6
+)
+
+type DomainResolver func(ctx context.Context, domain string) ([]netip.Addr, error)
+
+type domainStrategyKey struct{}
+
+func ContextWithDomainStrategy(ctx context.Context, strategy DomainStrategy) context.Context {
+	return context.WithValue(ctx, domainStrategyKey{}, strategy)
+}
+
+func DomainStrategyFromContext(ctx context.Context) (DomainStrategy, bool) {
+	strategy, loaded := ctx.Value(domainStrategyKey{}).(DomainStrategy)
+	return strategy, loaded
+}
+
+func (c *rawClientConn) resolveDestination(ctx context.Context) error {
+	if c.command != CommandTCP && c.command != CommandUDP || !c.destination.IsFqdn() || IsUDPMultiplexDestination(c.destination) {
+		return nil
+	}
+	strategy := c.domainStrategy
+	if contextStrategy, loaded := DomainStrategyFromContext(ctx); loaded {
+		strategy = contextStrategy
+	}
+	if strategy == DomainStrategyRemote {
+		return nil
+	}
+	var addresses []netip.Addr
+	var err error
+	if c.domainResolver != nil {
+		addresses, err = c.domainResolver(ctx, c.destination.Fqdn)
+	} else {
+		addresses, err = net.DefaultResolver.LookupNetIP(ctx, "ip", c.destination.Fqdn)
+	}
+	if err != nil {
+		return E.Cause(err, "resolve ", c.destination.Fqdn)
+	}
+	if len(addresses) == 0 {
+		return E.New("resolve ", c.destination.Fqdn, ": empty result")
+	}
+	address := addresses[0]
+	for _, candidate := range addresses {
+		candidate = candidate.Unmap()
+		if strategy == DomainStrategyPreferIPv4 && candidate.Is4() || strategy == DomainStrategyPreferIPv6 && candidate.Is6() {
+			address = candidate
+			break
+		}
+	}
+	c.destination = M.SocksaddrFrom(address.Unmap(), c.destination.Port)
+	return nil
+}
+
+func (c *rawServerConn) RequestDestination() M.Socksaddr {
+	return c.rawDestination
+}
@@ -0,0 +1,119 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const DefaultEndpointDelay = 300 * time.Millisecond
+
+var ErrNoEndpoints = E.New("vmess: no server endpoints")
+
+type endpointAttempt struct {
+	conn   net.Conn
+	server M.Socksaddr
+	err    error
+}
+
+type endpointHandshake func(ctx context.Context, upstream net.Conn) (net.Conn, error)
+
+func raceEndpoints(ctx context.Context, dialer N.Dialer, servers []M.Socksaddr, delay time.Duration, handshake endpointHandshake) (net.Conn, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if delay <= 0 {
+		delay = DefaultEndpointDelay
+	}
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan endpointAttempt, len(servers))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var next, pending int
+	startNext := func() {
+		go dialEndpoint(ctx, raceCtx, dialer, servers[next], handshake, results)
+		next++
+		pending++
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+	startNext()
+	var errors []error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				errors = append(errors, E.Cause(result.err, "endpoint ", result.server))
+				if next < len(servers) {
+					startNext()
+				}
+				continue
+			}
+			cancel()
+			go closeEndpointAttempts(results, pending)
+			return result.conn, nil
+		case <-timer.C:
+			if next < len(servers) {
+				startNext()
+			}
+		}
+	}
+	return nil, E.Errors(errors...)
+}
+
+func dialEndpoint(ctx context.Context, raceCtx context.Context, dialer N.Dialer, server M.Socksaddr, handshake endpointHandshake, results chan<- endpointAttempt) {
+	upstream, err := dialer.DialContext(raceCtx, N.NetworkTCP, server)
+	if err != nil {
+		results <- endpointAttempt{server: server, err: err}
+		return
+	}
+	// the conn outlives the race, so the handshake runs with the caller's
+	// context and a cancelled attempt is stopped by closing its upstream
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-raceCtx.Done():
+			upstream.Close()
+		case <-done:
+		}
+	}()
+	conn, err := handshake(ctx, upstream)
+	close(done)
+	<-stopped
+	if err == nil && raceCtx.Err() != nil {
+		conn.Close()
+		err = raceCtx.Err()
+	}
+	if err != nil {
+		upstream.Close()
+		results <- endpointAttempt{server: server, err: err}
+		return
+	}
+	if endpointConn, loaded := common.Cast[interface{ setEndpoint(server M.Socksaddr) }](conn); loaded {
+		endpointConn.setEndpoint(server)
+	}
+	results <- endpointAttempt{conn: conn, server: server}
+}
+
+func closeEndpointAttempts(results <-chan endpointAttempt, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		if result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package vmess
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+func isProbeError(err error) bool {
+	return errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrHeaderDecode) || errors.Is(err, ErrReplay)
+}
+
+func (s *Service[U]) delayError() {
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(s.errorJitter))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.done:
+	}
+}
@@ -0,0 +1,59 @@
+package vmess
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+var (
+	ErrAuthFailed   = E.New("vmess: authentication failed")
+	ErrHeaderDecode = E.New("vmess: header decode failed")
+)
+
+type categoryError struct {
+	category error
+	message  string
+	cause    error
+}
+
+func newCategoryError(category error, message string) error {
+	return &categoryError{category: category, message: message}
+}
+
+func wrapCategoryError(category error, cause error, message ...any) error {
+	if cause == nil {
+		return nil
+	}
+	return &categoryError{category: category, message: F.ToString(message...), cause: cause}
+}
+
+func (e *categoryError) Error() string {
+	if e.cause == nil {
+		return e.message
+	}
+	return e.message + ": " + e.cause.Error()
+}
+
+func (e *categoryError) Is(target error) bool {
+	return target == e.category
+}
+
+func (e *categoryError) Unwrap() error {
+	if e.cause == nil {
+		return e.category
+	}
+	return e.cause
+}
+
+type ErrChunkDecrypt struct {
+	Index uint64
+	Cause error
+}
+
+func (e *ErrChunkDecrypt) Error() string {
+	return F.ToString("vmess: decrypt chunk ", e.Index, ": ", e.Cause)
+}
+
+func (e *ErrChunkDecrypt) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,175 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const FallbackReplayLimit = 64 * 1024
+
+// FallbackDialer redials once through the fallback client when the primary one is rejected.
+type FallbackDialer struct {
+	dialer   N.Dialer
+	server   M.Socksaddr
+	primary  *Client
+	fallback *Client
+}
+
+func NewFallbackDialer(dialer N.Dialer, server M.Socksaddr, primary *Client, fallback *Client) *FallbackDialer {
+	return &FallbackDialer{dialer, server, primary, fallback}
+}
+
+func (d *FallbackDialer) DialConn(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	upstream, err := d.dialer.DialContext(ctx, N.NetworkTCP, d.server)
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackConn{
+		ctx:         ctx,
+		dialer:      d,
+		destination: destination,
+		conn:        d.primary.DialEarlyConnContext(ctx, upstream, destination),
+	}, nil
+}
+
+type fallbackConn struct {
+	access        sync.Mutex
+	ctx           context.Context
+	dialer        *FallbackDialer
+	destination   M.Socksaddr
+	conn          net.Conn
+	pending       [][]byte
+	pendingLen    int
+	done          bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *fallbackConn) current() net.Conn {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.conn
+}
+
+func (c *fallbackConn) Read(p []byte) (n int, err error) {
+	for {
+		conn := c.current()
+		n, err = conn.Read(p)
+		if n > 0 || err == nil {
+			c.verified()
+			return
+		}
+		if !c.retry(conn, err) {
+			return
+		}
+	}
+}
+
+func (c *fallbackConn) verified() {
+	c.access.Lock()
+	c.done = true
+	c.pending = nil
+	c.access.Unlock()
+}
+
+func (c *fallbackConn) retry(conn net.Conn, err error) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if conn != c.conn {
+		return true
+	}
+	if c.done || !isFallbackRejection(err) {
+		return false
+	}
+	c.done = true
+	pending := c.pending
+	c.pending = nil
+	upstream, err := c.dialer.dialer.DialContext(c.ctx, N.NetworkTCP, c.dialer.server)
+	if err != nil {
+		return false
+	}
+	fallbackConn := c.dialer.fallback.DialEarlyConnContext(c.ctx, upstream, c.destination)
+	fallbackConn.SetReadDeadline(c.readDeadline)
+	fallbackConn.SetWriteDeadline(c.writeDeadline)
+	for _, payload := range pending {
+		_, err = fallbackConn.Write(payload)
+		if err != nil {
+			fallbackConn.Close()
+			return false
+		}
+	}
+	c.conn.Close()
+	c.conn = fallbackConn
+	return true
+}
+
+func isFallbackRejection(err error) bool {
+	var interrupted *ErrHandshakeInterrupted
+	return errors.Is(err, ErrHeaderDecode) || errors.Is(err, ErrSessionTicketRejected) || errors.As(err, &interrupted)
+}
+
+func (c *fallbackConn) Write(p []byte) (n int, err error) {
+	c.access.Lock()
+	conn := c.conn
+	var replayable bool
+	if !c.done {
+		if c.pendingLen+len(p) > FallbackReplayLimit {
+			c.done = true
+			c.pending = nil
+		} else {
+			c.pending = append(c.pending, append([]byte(nil), p...))
+			c.pendingLen += len(p)
+			replayable = true
+		}
+	}
+	c.access.Unlock()
+	n, err = conn.Write(p)
+	if err != nil && replayable && c.current() != conn {
+		return len(p), nil
+	}
+	return
+}
+
+func (c *fallbackConn) Close() error {
+	return c.current().Close()
+}
+
+func (c *fallbackConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *fallbackConn) RemoteAddr() net.Addr {
+	return c.current().RemoteAddr()
+}
+
+func (c *fallbackConn) SetDeadline(t time.Time) error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *fallbackConn) SetReadDeadline(t time.Time) error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *fallbackConn) SetWriteDeadline(t time.Time) error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *fallbackConn) Upstream() any {
+	return c.current()
+}
@@ -0,0 +1,89 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type fallbackTestDialer struct {
+	conns chan net.Conn
+}
+
+func (d *fallbackTestDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	return <-d.conns, nil
+}
+
+func (d *fallbackTestDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+func TestFallbackAfterServerClose(t *testing.T) {
+	rejecting, rejectingServer := net.Pipe()
+	go func() {
+		rejectingServer.Read(make([]byte, 4096))
+		rejectingServer.Close()
+	}()
+	accepting, _ := serveTestConn(newTestService(t, &echoHandler{}))
+	dialer := &fallbackTestDialer{conns: make(chan net.Conn, 2)}
+	dialer.conns <- rejecting
+	dialer.conns <- accepting
+
+	primary := newTestClient(t, "00000000-0000-0000-0000-000000000000")
+	fallback := newTestClient(t, testUserID)
+	conn, err := NewFallbackDialer(dialer, M.ParseSocksaddr("127.0.0.1:443"), primary, fallback).DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 5)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "hello" {
+		t.Fatal("unexpected response ", string(response))
+	}
+}
+
+func TestFallbackWriteDeadline(t *testing.T) {
+	stuck, stuckServer := net.Pipe()
+	defer stuckServer.Close()
+	dialer := &fallbackTestDialer{conns: make(chan net.Conn, 1)}
+	dialer.conns <- stuck
+
+	client := newTestClient(t, testUserID)
+	conn, err := NewFallbackDialer(dialer, M.ParseSocksaddr("127.0.0.1:443"), client, client).DialConn(context.Background(), M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	err = conn.SetWriteDeadline(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("unexpected write error ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write deadline not applied to a stuck write")
+	}
+}
@@ -0,0 +1,145 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrFaultInjected = E.New("vmess: fault injected")
+
+type FaultPoint struct {
+	Write bool
+	Index uint64
+}
+
+type Fault struct {
+	Delay    time.Duration
+	Corrupt  bool
+	Truncate bool
+}
+
+// FaultInjector returns the fault to apply to each length chunk read or written, for tests of the error paths.
+type FaultInjector interface {
+	InjectFault(point FaultPoint) Fault
+}
+
+type FaultInjectorFunc func(point FaultPoint) Fault
+
+func (f FaultInjectorFunc) InjectFault(point FaultPoint) Fault {
+	return f(point)
+}
+
+func ReaderWithFaultInjector(injector FaultInjector) ReaderOption {
+	return func(options *readerOptions) {
+		options.faultInjector = injector
+	}
+}
+
+func WriterWithFaultInjector(injector FaultInjector) WriterOption {
+	return func(options *writerOptions) {
+		options.faultInjector = injector
+	}
+}
+
+func setFaultInjector(chain any, injector FaultInjector) {
+	if injector == nil {
+		return
+	}
+	walkUpstream(chain, func(layer any) bool {
+		switch layer := layer.(type) {
+		case *StreamChunkReader:
+			layer.faults = &chunkFaults{injector: injector}
+		case *StreamChunkWriter:
+			layer.faults = &chunkFaults{injector: injector, write: true}
+		case *AEADChunkReader:
+			layer.faults = &chunkFaults{injector: injector}
+		case *AEADChunkWriter:
+			layer.faults = &chunkFaults{injector: injector, write: true}
+		case *statsReader, *statsWriter:
+			return false
+		}
+		return true
+	})
+}
+
+type chunkFaults struct {
+	access   sync.Mutex
+	injector FaultInjector
+	write    bool
+	index    uint64
+	corrupt  bool
+	err      error
+}
+
+func (f *chunkFaults) next() Fault {
+	fault := f.injector.InjectFault(FaultPoint{Write: f.write, Index: f.index})
+	f.index++
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	return fault
+}
+
+func (f *chunkFaults) readLength() error {
+	if f == nil {
+		return nil
+	}
+	if f.err != nil {
+		return f.err
+	}
+	fault := f.next()
+	if fault.Truncate {
+		f.err = io.ErrUnexpectedEOF
+		return f.err
+	}
+	f.corrupt = fault.Corrupt
+	return nil
+}
+
+func (f *chunkFaults) readData(data []byte) {
+	if f == nil || !f.corrupt {
+		return
+	}
+	f.corrupt = false
+	if len(data) > 0 {
+		data[0] ^= 0xff
+	}
+}
+
+// writeChunk returns the chunk to write in place of the given one, nil writes nothing.
+func (f *chunkFaults) writeChunk(chunk []*buf.Buffer, headerLen int) ([]*buf.Buffer, error) {
+	if f == nil {
+		return chunk, nil
+	}
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.err != nil {
+		buf.ReleaseMulti(chunk)
+		return nil, f.err
+	}
+	fault := f.next()
+	if !fault.Corrupt && !fault.Truncate {
+		return chunk, nil
+	}
+	merged := buf.NewSize(buf.LenMulti(chunk))
+	for _, buffer := range chunk {
+		common.Must1(merged.Write(buffer.Bytes()))
+	}
+	buf.ReleaseMulti(chunk)
+	if fault.Truncate {
+		merged.Truncate(1)
+		f.err = ErrFaultInjected
+		return []*buf.Buffer{merged}, f.err
+	}
+	if merged.Len() > headerLen {
+		merged.Bytes()[headerLen] ^= 0xff
+	} else {
+		merged.Bytes()[merged.Len()-1] ^= 0xff
+	}
+	return []*buf.Buffer{merged}, nil
+}
@@ -5,7 +5,14 @@ go 1.18
 require (
 	github.com/gofrs/uuid/v5 v5.0.0
 	github.com/sagernet/sing v0.2.9
+	github.com/sagernet/sing-mux v0.1.2
 	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
 )
 
-require golang.org/x/sys v0.10.0 // indirect
+require (
+	github.com/hashicorp/yamux v0.1.1 // indirect
+	github.com/sagernet/smux v0.0.0-20230312102458-337ec2a5af37 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+)
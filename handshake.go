@@ -0,0 +1,109 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+type connDeadlines struct {
+	access sync.Mutex
+	read   time.Time
+	write  time.Time
+}
+
+func (d *connDeadlines) setRead(t time.Time) {
+	d.access.Lock()
+	d.read = t
+	d.access.Unlock()
+}
+
+func (d *connDeadlines) setWrite(t time.Time) {
+	d.access.Lock()
+	d.write = t
+	d.access.Unlock()
+}
+
+func (d *connDeadlines) load() (read time.Time, write time.Time) {
+	if d == nil {
+		return
+	}
+	d.access.Lock()
+	defer d.access.Unlock()
+	return d.read, d.write
+}
+
+func earlierDeadline(deadline time.Time, other time.Time) time.Time {
+	if other.IsZero() || deadline.Before(other) {
+		return deadline
+	}
+	return other
+}
+
+// The caller's deadlines are put back once the handshake is done, nil clears them.
+func handshakeContext(ctx context.Context, conn net.Conn, deadlines *connDeadlines, handshake func() error) error {
+	if ctx == nil {
+		return handshake()
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline && ctx.Done() == nil {
+		return handshake()
+	}
+	if hasDeadline {
+		readDeadline, writeDeadline := deadlines.load()
+		err := conn.SetReadDeadline(earlierDeadline(deadline, readDeadline))
+		if err != nil {
+			return err
+		}
+		err = conn.SetWriteDeadline(earlierDeadline(deadline, writeDeadline))
+		if err != nil {
+			return err
+		}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	err := handshake()
+	close(stop)
+	<-stopped
+	readDeadline, writeDeadline := deadlines.load()
+	_ = conn.SetReadDeadline(readDeadline)
+	_ = conn.SetWriteDeadline(writeDeadline)
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return E.Cause(ctxErr, "vmess handshake")
+	}
+	return err
+}
+
+// detachedContext keeps the values of a dial context but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
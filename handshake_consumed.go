@@ -0,0 +1,56 @@
+package vmess
+
+import (
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+)
+
+// ErrHandshakeRejected holds every byte read from the conn before the service rejected the handshake.
+type ErrHandshakeRejected struct {
+	Cause    error
+	Consumed []byte
+}
+
+func newHandshakeRejected(cause error, consumed []byte) error {
+	if len(consumed) == 0 {
+		return cause
+	}
+	return &ErrHandshakeRejected{cause, append([]byte(nil), consumed...)}
+}
+
+func (e *ErrHandshakeRejected) Error() string {
+	return e.Cause.Error()
+}
+
+func (e *ErrHandshakeRejected) Unwrap() error {
+	return e.Cause
+}
+
+func (e *ErrHandshakeRejected) Conn(conn net.Conn) net.Conn {
+	buffer := buf.NewSize(len(e.Consumed))
+	common.Must1(buffer.Write(e.Consumed))
+	return bufio.NewCachedConn(conn, buffer)
+}
+
+// retainReader copies what the legacy header reader takes from the conn into the request buffer.
+type retainReader struct {
+	buffer   *buf.Buffer
+	upstream io.Reader
+	retain   bool
+}
+
+func (r *retainReader) Read(p []byte) (n int, err error) {
+	if !r.retain || r.buffer.FreeLen() == 0 {
+		return r.upstream.Read(p)
+	}
+	if len(p) > r.buffer.FreeLen() {
+		p = p[:r.buffer.FreeLen()]
+	}
+	n, err = r.upstream.Read(p)
+	copy(r.buffer.Extend(n), p[:n])
+	return
+}
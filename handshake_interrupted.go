@@ -0,0 +1,31 @@
+package vmess
+
+import (
+	"errors"
+	"io"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+// ErrHandshakeInterrupted reports how much of the response header arrived before the server closed the conn.
+type ErrHandshakeInterrupted struct {
+	Received int
+	Expected int
+	Cause    error
+}
+
+func (e *ErrHandshakeInterrupted) Error() string {
+	return F.ToString("vmess: handshake interrupted after ", e.Received, " of ", e.Expected, " response header bytes: ", e.Cause)
+}
+
+func (e *ErrHandshakeInterrupted) Unwrap() error {
+	return e.Cause
+}
+
+func interruptedHandshake(err error, received int, expected int) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || E.IsClosed(err) {
+		return &ErrHandshakeInterrupted{Received: received, Expected: expected, Cause: err}
+	}
+	return err
+}
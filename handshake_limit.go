@@ -0,0 +1,68 @@
+package vmess
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var ErrTooManyHandshakes = E.New("vmess: too many concurrent handshakes")
+
+type HandshakeEvictHandler = func(source M.Socksaddr, inflight int)
+
+// handshakeLimiter caps the handshakes a source address may have in flight.
+type handshakeLimiter struct {
+	access   sync.Mutex
+	limit    int
+	inflight map[netip.Addr]int
+	evict    HandshakeEvictHandler
+}
+
+func newHandshakeLimiter(limit int, evict HandshakeEvictHandler) *handshakeLimiter {
+	return &handshakeLimiter{
+		limit:    limit,
+		inflight: make(map[netip.Addr]int),
+		evict:    evict,
+	}
+}
+
+func (l *handshakeLimiter) acquire(conn net.Conn, source M.Socksaddr) (release func(), acquired bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	if !source.IsIP() {
+		source = M.SocksaddrFromNet(conn.RemoteAddr())
+		if !source.IsIP() {
+			return func() {}, true
+		}
+	}
+	addr := source.Addr.Unmap()
+	l.access.Lock()
+	inflight := l.inflight[addr]
+	if inflight >= l.limit {
+		l.access.Unlock()
+		if l.evict != nil {
+			l.evict(source, inflight)
+		}
+		return nil, false
+	}
+	l.inflight[addr] = inflight + 1
+	l.access.Unlock()
+	var released bool
+	return func() {
+		if released {
+			return
+		}
+		released = true
+		l.access.Lock()
+		if l.inflight[addr] <= 1 {
+			delete(l.inflight, addr)
+		} else {
+			l.inflight[addr]--
+		}
+		l.access.Unlock()
+	}, true
+}
@@ -0,0 +1,122 @@
+package vmess
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// HandshakeState reports how far the handshake of a conn has come, Failed is final and keeps the error.
+type HandshakeState uint32
+
+const (
+	HandshakeStateIdle HandshakeState = iota
+	HandshakeStateAuthenticating
+	HandshakeStateReadingRequest
+	HandshakeStateValidatingRequest
+	HandshakeStateRequestAccepted
+	HandshakeStateRequestSent
+	HandshakeStateEstablished
+	HandshakeStateFailed
+)
+
+func (s HandshakeState) String() string {
+	switch s {
+	case HandshakeStateIdle:
+		return "idle"
+	case HandshakeStateAuthenticating:
+		return "authenticating"
+	case HandshakeStateReadingRequest:
+		return "reading request"
+	case HandshakeStateValidatingRequest:
+		return "validating request"
+	case HandshakeStateRequestAccepted:
+		return "request accepted"
+	case HandshakeStateRequestSent:
+		return "request sent"
+	case HandshakeStateEstablished:
+		return "established"
+	case HandshakeStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type HandshakeObserver func(ctx context.Context, from HandshakeState, to HandshakeState, err error)
+
+type handshakeTransitions [HandshakeStateFailed + 1]uint32
+
+func (t *handshakeTransitions) allows(from HandshakeState, to HandshakeState) bool {
+	return t[from]&(1<<to) != 0
+}
+
+var serverHandshakeTransitions = handshakeTransitions{
+	HandshakeStateIdle:              1 << HandshakeStateAuthenticating,
+	HandshakeStateAuthenticating:    1<<HandshakeStateReadingRequest | 1<<HandshakeStateFailed,
+	HandshakeStateReadingRequest:    1<<HandshakeStateValidatingRequest | 1<<HandshakeStateFailed,
+	HandshakeStateValidatingRequest: 1<<HandshakeStateRequestAccepted | 1<<HandshakeStateFailed,
+	HandshakeStateRequestAccepted:   1<<HandshakeStateEstablished | 1<<HandshakeStateFailed,
+}
+
+var clientHandshakeTransitions = handshakeTransitions{
+	HandshakeStateIdle:        1<<HandshakeStateRequestSent | 1<<HandshakeStateFailed,
+	HandshakeStateRequestSent: 1<<HandshakeStateEstablished | 1<<HandshakeStateFailed,
+}
+
+type handshakeMachine struct {
+	ctx         context.Context
+	transitions *handshakeTransitions
+	observer    HandshakeObserver
+	access      sync.Mutex
+	state       uint32
+	err         error
+}
+
+func newHandshakeMachine(ctx context.Context, transitions *handshakeTransitions, observer HandshakeObserver) *handshakeMachine {
+	return &handshakeMachine{ctx: ctx, transitions: transitions, observer: observer}
+}
+
+func (m *handshakeMachine) State() HandshakeState {
+	return HandshakeState(atomic.LoadUint32(&m.state))
+}
+
+func (m *handshakeMachine) transition(to HandshakeState) error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	return m.set(to, nil)
+}
+
+func (m *handshakeMachine) fail(err error) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.err != nil || m.State() == HandshakeStateEstablished {
+		return
+	}
+	if m.set(HandshakeStateFailed, err) == nil {
+		m.err = err
+	}
+}
+
+func (m *handshakeMachine) failure() error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.err
+}
+
+func (m *handshakeMachine) set(to HandshakeState, err error) error {
+	from := m.State()
+	if !m.transitions.allows(from, to) {
+		return E.New("vmess: invalid handshake transition from ", from, " to ", to)
+	}
+	atomic.StoreUint32(&m.state, uint32(to))
+	if m.observer != nil {
+		m.observer(m.ctx, from, to, err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package vmess
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type handshakeTransition struct {
+	from HandshakeState
+	to   HandshakeState
+	err  error
+}
+
+type handshakeRecorder struct {
+	access      sync.Mutex
+	transitions []handshakeTransition
+}
+
+func (r *handshakeRecorder) observe(ctx context.Context, from HandshakeState, to HandshakeState, err error) {
+	r.access.Lock()
+	r.transitions = append(r.transitions, handshakeTransition{from, to, err})
+	r.access.Unlock()
+}
+
+func (r *handshakeRecorder) take() []handshakeTransition {
+	r.access.Lock()
+	defer r.access.Unlock()
+	transitions := r.transitions
+	r.transitions = nil
+	return transitions
+}
+
+func (r *handshakeRecorder) expect(t *testing.T, name string, states ...HandshakeState) error {
+	transitions := r.take()
+	if len(transitions) != len(states)-1 {
+		t.Fatal(name, ": expected ", len(states)-1, " transitions, got ", transitions)
+	}
+	for i, transition := range transitions {
+		if transition.from != states[i] || transition.to != states[i+1] {
+			t.Fatal(name, ": transition ", i, " is ", transition.from, " -> ", transition.to, ", expected ", states[i], " -> ", states[i+1])
+		}
+	}
+	return transitions[len(transitions)-1].err
+}
+
+func waitHandshake(t *testing.T, name string, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal(name, ": handshake not finished")
+		return nil
+	}
+}
+
+func TestHandshakeStates(t *testing.T) {
+	server := &handshakeRecorder{}
+	service := newTestService(t, &echoHandler{}, ServiceWithHandshakeObserver(server.observe))
+
+	client := &handshakeRecorder{}
+	upstream, done := serveTestConn(service)
+	recorder := &recordConn{Conn: upstream}
+	conn, err := newTestClient(t, testUserID, ClientWithHandshakeObserver(client.observe)).DialConn(recorder, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitHandshake(t, "accepted", done)
+	server.expect(t, "accepted", HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateReadingRequest, HandshakeStateValidatingRequest, HandshakeStateRequestAccepted, HandshakeStateEstablished)
+	client.expect(t, "accepted", HandshakeStateIdle, HandshakeStateRequestSent, HandshakeStateEstablished)
+
+	replayed, done := serveTestConn(service)
+	go replayed.Write(recorder.bytes())
+	err = waitHandshake(t, "replay", done)
+	replayed.Close()
+	if !errors.Is(err, ErrReplay) {
+		t.Fatal("replay: ", err)
+	}
+	err = server.expect(t, "replay", HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateFailed)
+	if !errors.Is(err, ErrReplay) {
+		t.Fatal("replay: observed ", err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		userID      string
+		options     []ClientOption
+		destination string
+		target      error
+		states      []HandshakeState
+	}{
+		{
+			name:        "unknown user",
+			userID:      "d7c5d6f4-5c0b-4bd4-a1a6-1e6a1bb4a4a0",
+			destination: "example.com:80",
+			target:      ErrBadRequest,
+			states:      []HandshakeState{HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateFailed},
+		},
+		{
+			name:   "bad timestamp",
+			userID: testUserID,
+			options: []ClientOption{ClientWithTimeFunc(func() time.Time {
+				return time.Now().Add(-time.Hour)
+			})},
+			destination: "example.com:80",
+			target:      ErrBadTimestamp,
+			states:      []HandshakeState{HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateFailed},
+		},
+		{
+			name:        "malformed mux",
+			userID:      testUserID,
+			destination: "v9.mux.cool:9527",
+			target:      ErrHeaderDecode,
+			states:      []HandshakeState{HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateReadingRequest, HandshakeStateValidatingRequest, HandshakeStateFailed},
+		},
+	} {
+		upstream, done := serveTestConn(service)
+		go newTestClient(t, test.userID, test.options...).DialConn(upstream, M.ParseSocksaddr(test.destination))
+		err = waitHandshake(t, test.name, done)
+		upstream.Close()
+		if !errors.Is(err, test.target) {
+			t.Fatal(test.name, ": ", err)
+		}
+		err = server.expect(t, test.name, test.states...)
+		if !errors.Is(err, test.target) {
+			t.Fatal(test.name, ": observed ", err)
+		}
+	}
+}
+
+func TestHandshakeInvalidTransition(t *testing.T) {
+	recorder := &handshakeRecorder{}
+	handshake := newHandshakeMachine(context.Background(), &serverHandshakeTransitions, recorder.observe)
+	for _, state := range []HandshakeState{HandshakeStateAuthenticating, HandshakeStateReadingRequest, HandshakeStateValidatingRequest, HandshakeStateRequestAccepted, HandshakeStateEstablished} {
+		err := handshake.transition(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := handshake.transition(HandshakeStateEstablished)
+	if err == nil {
+		t.Fatal("repeated transition to ", HandshakeStateEstablished, " accepted")
+	}
+	handshake.fail(io.EOF)
+	if handshake.State() != HandshakeStateEstablished || handshake.failure() != nil {
+		t.Fatal("established handshake failed: ", handshake.State(), " ", handshake.failure())
+	}
+	recorder.expect(t, "invalid transition", HandshakeStateIdle, HandshakeStateAuthenticating, HandshakeStateReadingRequest, HandshakeStateValidatingRequest, HandshakeStateRequestAccepted, HandshakeStateEstablished)
+}
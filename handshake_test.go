@@ -0,0 +1,171 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func TestHandshakeAfterDialContext(t *testing.T) {
+	service := newTestService(t, &echoHandler{})
+	client := newTestClient(t, testUserID, ClientWithResponseTimeout(5*time.Second))
+	for _, early := range []bool{true, false} {
+		upstream, _ := serveTestConn(service)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var conn net.Conn
+		if early {
+			conn = client.DialEarlyConnContext(ctx, upstream, M.ParseSocksaddr("example.com:80"))
+		} else {
+			var err error
+			conn, err = client.DialConnContext(ctx, upstream, M.ParseSocksaddr("example.com:80"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		cancel()
+		err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal("early=", early, " write: ", err)
+		}
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		if err != nil {
+			t.Fatal("early=", early, " read: ", err)
+		}
+		_, err = conn.Read(make([]byte, 5))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("early=", early, " read deadline not kept: ", err)
+		}
+		conn.Close()
+	}
+}
+
+type v2flyCapture struct {
+	Name        string
+	AlterID     int
+	Security    byte
+	Option      byte
+	Padding     int
+	Timestamp   int64
+	Destination string
+	Payload     []byte
+	Request     []byte
+}
+
+type requestHandler struct {
+	echoHandler
+	requests chan []byte
+}
+
+func (h *requestHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	defer conn.Close()
+	request, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	h.requests <- append([]byte(metadata.Destination.String()+" "), request...)
+	return nil
+}
+
+func TestV2flyRequests(t *testing.T) {
+	content, err := os.ReadFile("testdata/v2fly_requests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captures []v2flyCapture
+	err = json.Unmarshal(content, &captures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, capture := range captures {
+		var recording bytes.Buffer
+		handler := &requestHandler{requests: make(chan []byte, 1)}
+		service := NewService[int](handler, ServiceWithLegacyHeader(), ServiceWithRecorder(NewRecorder(&recording)), ServiceWithTimeFunc(func() time.Time {
+			return time.Unix(capture.Timestamp, 0)
+		}))
+		err = service.UpdateUsers([]int{1}, []string{testUserID}, []int{capture.AlterID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream, done := serveTestConn(service)
+		go io.Copy(io.Discard, upstream)
+		_, err = upstream.Write(capture.Request)
+		if err != nil {
+			t.Fatal(capture.Name, ": ", err)
+		}
+		err = <-done
+		upstream.Close()
+		service.Close()
+		if err != nil {
+			t.Fatal(capture.Name, ": ", err)
+		}
+		if request := <-handler.requests; string(request) != capture.Destination+" "+string(capture.Payload) {
+			t.Fatal(capture.Name, ": got request ", string(request))
+		}
+		events, err := ReadRecording(&recording)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if events[0].Event != RecordRequest || events[0].Padding != capture.Padding || events[0].Option != capture.Option || events[0].Security != capture.Security || events[0].Legacy != (capture.AlterID > 0) {
+			t.Fatal(capture.Name, ": recorded ", events[0])
+		}
+	}
+}
+
+func TestHeaderPadding(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var recording bytes.Buffer
+		service := newTestService(t, &echoHandler{}, ServiceWithRecorder(NewRecorder(&recording)))
+		random := sha3.NewShake128()
+		common.Must1(random.Write([]byte("header padding")))
+		client := newTestClient(t, testUserID, ClientWithHeaderPadding(enabled), ClientWithRandom(random))
+		for i := 0; i < 32; i++ {
+			upstream, done := serveTestConn(service)
+			conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.Write([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			<-done
+		}
+		events, err := ReadRecording(&recording)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paddings := make(map[int]bool)
+		for _, event := range events {
+			if event.Event == RecordRequest {
+				paddings[event.Padding] = true
+			}
+		}
+		if enabled && len(paddings) < 8 || !enabled && (len(paddings) != 1 || !paddings[0]) {
+			t.Fatal("header padding enabled=", enabled, ": got padding lengths ", paddings)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package vmess
+
+import "sync/atomic"
+
+var ErrHandshakeQueueFull = newCategoryError(ErrTooManyHandshakes, "handshake queue full")
+
+const (
+	handshakeTaskQueued = iota
+	handshakeTaskRunning
+	handshakeTaskCancelled
+)
+
+type handshakeTask struct {
+	state int32
+	run   func() error
+	err   error
+	done  chan struct{}
+}
+
+type handshakeWorkers struct {
+	workers int
+	tasks   chan *handshakeTask
+}
+
+func newHandshakeWorkers(workers int, queue int) *handshakeWorkers {
+	if queue < 0 {
+		queue = 0
+	}
+	return &handshakeWorkers{
+		workers: workers,
+		tasks:   make(chan *handshakeTask, queue),
+	}
+}
+
+func (w *handshakeWorkers) start(done <-chan struct{}) {
+	if w == nil {
+		return
+	}
+	for i := 0; i < w.workers; i++ {
+		go w.loop(done)
+	}
+}
+
+func (w *handshakeWorkers) loop(done <-chan struct{}) {
+	for {
+		select {
+		case task := <-w.tasks:
+			if atomic.CompareAndSwapInt32(&task.state, handshakeTaskQueued, handshakeTaskRunning) {
+				task.err = task.run()
+				close(task.done)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (w *handshakeWorkers) run(done <-chan struct{}, run func() error) error {
+	if w == nil {
+		return run()
+	}
+	task := &handshakeTask{run: run, done: make(chan struct{})}
+	select {
+	case w.tasks <- task:
+	default:
+		return ErrHandshakeQueueFull
+	}
+	select {
+	case <-task.done:
+		return task.err
+	case <-done:
+		// a task already picked up still uses the request buffer
+		if atomic.CompareAndSwapInt32(&task.state, handshakeTaskQueued, handshakeTaskCancelled) {
+			return ErrServiceClosed
+		}
+		<-task.done
+		return task.err
+	}
+}
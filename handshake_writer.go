@@ -0,0 +1,84 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type handshakeWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	access     sync.Mutex
+	pending    []*buf.Buffer
+	flushed    bool
+}
+
+func newHandshakeWriter(upstream io.Writer) *handshakeWriter {
+	return &handshakeWriter{
+		upstream:   bufio.NewExtendedWriter(upstream),
+		vectorised: bufio.NewVectorisedWriter(upstream),
+	}
+}
+
+func (w *handshakeWriter) collect(buffers ...*buf.Buffer) bool {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.flushed {
+		return false
+	}
+	for _, buffer := range buffers {
+		pending := buf.NewSize(buffer.Len())
+		common.Must1(pending.Write(buffer.Bytes()))
+		buffer.Release()
+		w.pending = append(w.pending, pending)
+	}
+	return true
+}
+
+func (w *handshakeWriter) flush() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	pending := w.pending
+	w.pending = nil
+	w.flushed = true
+	if len(pending) == 0 {
+		return nil
+	}
+	return w.vectorised.WriteVectorised(pending)
+}
+
+func (w *handshakeWriter) Write(p []byte) (n int, err error) {
+	w.access.Lock()
+	if !w.flushed {
+		buffer := buf.NewSize(len(p))
+		common.Must1(buffer.Write(p))
+		w.pending = append(w.pending, buffer)
+		w.access.Unlock()
+		return len(p), nil
+	}
+	w.access.Unlock()
+	return w.upstream.Write(p)
+}
+
+func (w *handshakeWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if w.collect(buffer) {
+		return nil
+	}
+	return w.upstream.WriteBuffer(buffer)
+}
+
+func (w *handshakeWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	if w.collect(buffers...) {
+		return nil
+	}
+	return w.vectorised.WriteVectorised(buffers)
+}
+
+func (w *handshakeWriter) Upstream() any {
+	return w.upstream
+}
@@ -0,0 +1,235 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/rw"
+)
+
+var ErrBadChecksum = newCategoryError(ErrHeaderDecode, "bad header checksum")
+
+type RequestHeader struct {
+	Timestamp      time.Time
+	RequestKey     [16]byte
+	RequestNonce   [16]byte
+	ResponseHeader byte
+	Option         byte
+	Security       byte
+	Reserved       byte
+	Command        byte
+	Destination    M.Socksaddr
+	PaddingLength  int
+}
+
+func (h *RequestHeader) Len() int {
+	var headerLen int
+	headerLen += 1  // version
+	headerLen += 16 // request iv
+	headerLen += 16 // request key
+	headerLen += 1  // response header
+	headerLen += 1  // option
+	headerLen += 1  // padding<<4 || security
+	headerLen += 1  // reversed
+	headerLen += 1  // command
+	if h.Command != CommandMux {
+		headerLen += AddressSerializer.AddrPortLen(h.Destination)
+	}
+	headerLen += h.PaddingLength
+	headerLen += 4 // fnv1a hash
+	return headerLen
+}
+
+func (h *RequestHeader) encode(headerBuffer *buf.Buffer, random io.Reader) {
+	common.Must(headerBuffer.WriteByte(Version))
+	common.Must1(headerBuffer.Write(h.RequestNonce[:]))
+	common.Must1(headerBuffer.Write(h.RequestKey[:]))
+	common.Must(headerBuffer.WriteByte(h.ResponseHeader))
+	common.Must(headerBuffer.WriteByte(h.Option))
+	common.Must(headerBuffer.WriteByte(byte(h.PaddingLength<<4) | h.Security))
+	common.Must(headerBuffer.WriteByte(h.Reserved))
+	common.Must(headerBuffer.WriteByte(h.Command))
+	if h.Command != CommandMux {
+		common.Must(AddressSerializer.WriteAddrPort(headerBuffer, h.Destination))
+	}
+	if h.PaddingLength > 0 {
+		common.Must1(headerBuffer.ReadFullFrom(random, h.PaddingLength))
+	}
+	headerHash := fnv.New32a()
+	common.Must1(headerHash.Write(headerBuffer.Bytes()))
+	headerHash.Sum(headerBuffer.Extend(4)[:0])
+}
+
+func (h *RequestHeader) sealedLen() int {
+	var requestLen int
+	requestLen += 16 // auth id
+	requestLen += 2 + CipherOverhead
+	requestLen += 8 // connection nonce
+	requestLen += h.Len() + CipherOverhead
+	return requestLen
+}
+
+func (h *RequestHeader) seal(key [16]byte, authIDCipher cipher.Block, chachaHeader bool, random io.Reader, requestBuffer *buf.Buffer) {
+	const headerLenBufferLen = 2 + CipherOverhead
+
+	headerLen := h.Len()
+	authID(authIDCipher, h.Timestamp, random, requestBuffer)
+	authId := requestBuffer.To(16)
+
+	headerLenBuffer := buf.With(requestBuffer.Extend(headerLenBufferLen))
+	connectionNonce := requestBuffer.Extend(8)
+	common.Must1(io.ReadFull(random, connectionNonce))
+
+	common.Must(binary.Write(headerLenBuffer, binary.BigEndian, uint16(headerLen)))
+	lengthKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)
+	lengthNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
+	newHeaderAEAD(lengthKey, chachaHeader).Seal(headerLenBuffer.Index(0), lengthNonce, headerLenBuffer.Bytes(), authId)
+
+	headerBuffer := buf.With(requestBuffer.Extend(headerLen + CipherOverhead))
+	h.encode(headerBuffer, random)
+	headerKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)
+	headerNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
+	newHeaderAEAD(headerKey, chachaHeader).Seal(headerBuffer.Index(0), headerNonce, headerBuffer.Bytes(), authId)
+}
+
+func EncodeRequestHeader(key [16]byte, request *RequestHeader, writer io.Writer) error {
+	return encodeRequestHeader(key, request, false, writer)
+}
+
+func EncodeChacha20Poly1305RequestHeader(key [16]byte, request *RequestHeader, writer io.Writer) error {
+	return encodeRequestHeader(key, request, true, writer)
+}
+
+func encodeRequestHeader(key [16]byte, request *RequestHeader, chachaHeader bool, writer io.Writer) error {
+	if request.Timestamp.IsZero() {
+		request.Timestamp = time.Now()
+	}
+	requestBuffer := buf.NewSize(request.sealedLen())
+	defer requestBuffer.Release()
+	request.seal(key, newAuthIDCipher(key), chachaHeader, rand.Reader, requestBuffer)
+	return common.Error(writer.Write(requestBuffer.Bytes()))
+}
+
+func DecodeRequestHeader(key [16]byte, reader io.Reader) (*RequestHeader, error) {
+	const headerLenBufferLen = 2 + CipherOverhead
+
+	requestBuffer := buf.NewSize(16 + headerLenBufferLen + 8)
+	defer requestBuffer.Release()
+	_, err := requestBuffer.ReadFullFrom(reader, requestBuffer.FreeLen())
+	if err != nil {
+		return nil, err
+	}
+	authId := requestBuffer.To(16)
+	var decodedId [16]byte
+	newAuthIDCipher(key).Decrypt(decodedId[:], authId)
+	if checkAuthID(&decodedId) != 1 {
+		return nil, ErrBadRequest
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(decodedId[:])), 0)
+
+	const nonceIndex = 16 + headerLenBufferLen
+	connectionNonce := requestBuffer.Range(nonceIndex, nonceIndex+8)
+	lengthKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)
+	lengthNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
+	lengthBuffer, chachaHeader, err := openHeaderLength(lengthKey, lengthNonce, requestBuffer.Range(16, nonceIndex), authId, true)
+	if err != nil {
+		return nil, err
+	}
+	headerLength := int(binary.BigEndian.Uint16(lengthBuffer))
+
+	headerBuffer := buf.NewSize(headerLength + CipherOverhead)
+	defer headerBuffer.Release()
+	_, err = headerBuffer.ReadFullFrom(reader, headerBuffer.FreeLen())
+	if err != nil {
+		return nil, err
+	}
+	headerKey := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)
+	headerNonce := KDF(key[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
+	header, err := newHeaderAEAD(headerKey, chachaHeader).Open(headerBuffer.Index(0), headerNonce, headerBuffer.Bytes(), authId)
+	if err != nil {
+		return nil, wrapCategoryError(ErrHeaderDecode, err, "open header")
+	}
+	request, err := parseRequestHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	request.Timestamp = timestamp
+	return request, nil
+}
+
+func newHeaderAEAD(key []byte, chachaHeader bool) cipher.AEAD {
+	if chachaHeader {
+		return newChacha20Poly1305(key)
+	}
+	return newAesGcm(key[:16])
+}
+
+func openHeaderLength(key []byte, nonce []byte, sealed []byte, authId []byte, tryChacha bool) (length []byte, chachaHeader bool, err error) {
+	length, err = newAesGcm(key[:16]).Open(nil, nonce, sealed, authId)
+	if err != nil && tryChacha {
+		var chachaErr error
+		length, chachaErr = newChacha20Poly1305(key).Open(nil, nonce, sealed, authId)
+		if chachaErr == nil {
+			return length, true, nil
+		}
+	}
+	if err != nil {
+		return nil, false, wrapCategoryError(ErrHeaderDecode, err, "open header length")
+	}
+	return
+}
+
+func parseRequestHeader(header []byte) (*RequestHeader, error) {
+	if len(header) < 38+4 {
+		return nil, E.Extend(ErrBadHeader, io.ErrShortBuffer)
+	}
+	if header[0] != Version {
+		return nil, E.Extend(ErrBadVersion, header[0])
+	}
+	request := &RequestHeader{
+		ResponseHeader: header[33],
+		Option:         header[34],
+		PaddingLength:  int(header[35] >> 4),
+		Security:       header[35] & 0x0F,
+		Reserved:       header[36],
+		Command:        header[37],
+	}
+	copy(request.RequestNonce[:], header[1:17])
+	copy(request.RequestKey[:], header[17:33])
+	switch request.Command {
+	case CommandTCP, CommandUDP, CommandMux:
+	default:
+		return nil, E.Extend(ErrBadHeader, "unknown command: ", request.Command)
+	}
+	headerReader := bytes.NewReader(header[38:])
+	if request.Command != CommandMux {
+		destination, err := AddressSerializer.ReadAddrPort(headerReader)
+		if err != nil {
+			return nil, wrapCategoryError(ErrHeaderDecode, err, "read destination")
+		}
+		request.Destination = destination
+	}
+	err := rw.SkipN(headerReader, request.PaddingLength)
+	if err != nil {
+		return nil, E.Extend(ErrBadHeader, "bad padding")
+	}
+	if headerReader.Len() != 4 {
+		return nil, E.Extend(ErrBadHeader, "bad header length")
+	}
+	checksumIndex := len(header) - 4
+	headerHash := fnv.New32a()
+	common.Must1(headerHash.Write(header[:checksumIndex]))
+	if headerHash.Sum32() != binary.BigEndian.Uint32(header[checksumIndex:]) {
+		return nil, ErrBadChecksum
+	}
+	return request, nil
+}
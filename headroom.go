@@ -0,0 +1,33 @@
+package vmess
+
+import (
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// headroom is the room a writer and the chain below it need around each buffer.
+type headroom struct {
+	front int
+	rear  int
+}
+
+func headroomOf(writer any) headroom {
+	return headroom{N.CalculateFrontHeadroom(writer), N.CalculateRearHeadroom(writer)}
+}
+
+func (h headroom) newBuffer(size int) *buf.Buffer {
+	buffer := buf.NewSize(h.front + size + h.rear)
+	buffer.Resize(h.front, 0)
+	return buffer
+}
+
+func (h headroom) ensure(buffer *buf.Buffer) *buf.Buffer {
+	if buffer.Start() >= h.front && buffer.FreeLen() >= h.rear {
+		return buffer
+	}
+	newBuffer := h.newBuffer(buffer.Len())
+	common.Must1(newBuffer.Write(buffer.Bytes()))
+	buffer.Release()
+	return newBuffer
+}
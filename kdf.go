@@ -1,30 +1,269 @@
 package vmess
 
 import (
-	"crypto/hmac"
 	"crypto/sha256"
+	"encoding"
 	"hash"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+)
+
+var (
+	kdfRoot  = newKDFLevel(nil, []byte(KDFSaltConstVMessAEADKDF))
+	kdfSalts = newKDFSalts(
+		KDFSaltConstAuthIDEncryptionKey,
+		KDFSaltConstAEADRespHeaderLenKey,
+		KDFSaltConstAEADRespHeaderLenIV,
+		KDFSaltConstAEADRespHeaderPayloadKey,
+		KDFSaltConstAEADRespHeaderPayloadIV,
+		KDFSaltConstVMessHeaderPayloadAEADKey,
+		KDFSaltConstVMessHeaderPayloadAEADIV,
+		KDFSaltConstVMessHeaderPayloadLengthAEADKey,
+		KDFSaltConstVMessHeaderPayloadLengthAEADIV,
+		KDFSaltConstVMessPayloadRekey,
+		KDFSaltConstVMessAes256GcmKey,
+		"auth_len",
+	)
 )
 
+type kdfSalt struct {
+	level    *kdfLevel
+	derivers sync.Pool
+}
+
 func KDF(key []byte, salt string, path ...[]byte) []byte {
-	hmacCreator := &hMacCreator{value: []byte(KDFSaltConstVMessAEADKDF)}
-	hmacCreator = &hMacCreator{value: []byte(salt), parent: hmacCreator}
-	for _, v := range path {
-		hmacCreator = &hMacCreator{value: v, parent: hmacCreator}
+	cached, loaded := kdfSalts[salt]
+	if !loaded {
+		return NewKDFDeriver(salt).Derive(make([]byte, 0, sha256.Size), key, path...)
+	}
+	deriver := cached.derivers.Get().(*KDFDeriver)
+	defer cached.derivers.Put(deriver)
+	return deriver.Derive(make([]byte, 0, sha256.Size), key, path...)
+}
+
+// newKDFSalts prebuilds the salts of this package, any other salt is built per deriver and never kept.
+func newKDFSalts(salts ...string) map[string]*kdfSalt {
+	cache := make(map[string]*kdfSalt, len(salts))
+	for _, salt := range salts {
+		cached := &kdfSalt{level: newKDFLevel(kdfRoot, []byte(salt))}
+		cached.derivers.New = func() any {
+			return &KDFDeriver{base: cached.level}
+		}
+		cache[salt] = cached
+	}
+	return cache
+}
+
+// KDFDeriver is not safe for concurrent use, KDF takes one from a pool kept per salt.
+type KDFDeriver struct {
+	base *kdfLevel
+	path []kdfPathLevel
+	tops []*kdfNode
+}
+
+type kdfPathLevel struct {
+	ipad    [sha256.BlockSize]byte
+	opad    [sha256.BlockSize]byte
+	keySum  [sha256.Size]byte
+	keyNode *kdfNode
+}
+
+// kdfNode is a plain SHA-256 when sha is set, otherwise an HMAC over a shared level or path level ref-1.
+type kdfNode struct {
+	sha   hash.Hash
+	level *kdfLevel
+	ref   int
+	inner *kdfNode
+	outer *kdfNode
+	sum   [sha256.Size]byte
+}
+
+func NewKDFDeriver(salt string) *KDFDeriver {
+	if cached, loaded := kdfSalts[salt]; loaded {
+		return &KDFDeriver{base: cached.level}
+	}
+	return &KDFDeriver{base: newKDFLevel(kdfRoot, []byte(salt))}
+}
+
+func (d *KDFDeriver) Derive(dst []byte, key []byte, path ...[]byte) []byte {
+	for len(d.path) < len(path) {
+		d.path = append(d.path, kdfPathLevel{})
+		d.tops = append(d.tops, nil)
+	}
+	if len(d.tops) == len(path) {
+		d.tops = append(d.tops, nil)
+	}
+	for i, element := range path {
+		level := &d.path[i]
+		if len(element) > sha256.BlockSize {
+			keyNode := kdfChild(&level.keyNode)
+			d.reset(keyNode, i)
+			keyNode.write(element)
+			element = d.sum(keyNode, level.keySum[:0])
+		}
+		level.ipad = [sha256.BlockSize]byte{}
+		copy(level.ipad[:], element)
+		level.opad = level.ipad
+		for j := range level.ipad {
+			level.ipad[j] ^= 0x36
+			level.opad[j] ^= 0x5c
+		}
+	}
+	top := kdfChild(&d.tops[len(path)])
+	d.reset(top, len(path))
+	top.write(key)
+	return d.sum(top, dst)
+}
+
+func kdfChild(node **kdfNode) *kdfNode {
+	if *node == nil {
+		*node = &kdfNode{}
+	}
+	return *node
+}
+
+func (d *KDFDeriver) reset(node *kdfNode, ref int) {
+	if ref == 0 {
+		node.level = d.base
+		kdfChild(&node.inner).restore(d.base.inner)
+		return
+	}
+	node.level = nil
+	node.ref = ref
+	inner := kdfChild(&node.inner)
+	d.reset(inner, ref-1)
+	inner.write(d.path[ref-1].ipad[:])
+}
+
+func (d *KDFDeriver) sum(node *kdfNode, b []byte) []byte {
+	if node.sha != nil {
+		return node.sha.Sum(b)
+	}
+	innerSum := d.sum(node.inner, node.sum[:0])
+	outer := kdfChild(&node.outer)
+	if node.level != nil {
+		outer.restore(node.level.outer)
+	} else {
+		d.reset(outer, node.ref-1)
+		outer.write(d.path[node.ref-1].opad[:])
+	}
+	outer.write(innerSum)
+	return d.sum(outer, b)
+}
+
+func (n *kdfNode) restore(state kdfHash) {
+	switch state := state.(type) {
+	case *kdfSHA256:
+		if n.sha == nil {
+			n.sha = sha256.New()
+		}
+		common.Must(n.sha.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.frozen))
+	case *kdfHMAC:
+		n.level = state.level
+		kdfChild(&n.inner).restore(state.inner)
 	}
-	hmacf := hmacCreator.Create()
-	hmacf.Write(key)
-	return hmacf.Sum(nil)
 }
 
-type hMacCreator struct {
-	parent *hMacCreator
-	value  []byte
+func (n *kdfNode) write(p []byte) {
+	for n.sha == nil {
+		n = n.inner
+	}
+	common.Must1(n.sha.Write(p))
 }
 
-func (h *hMacCreator) Create() hash.Hash {
-	if h.parent == nil {
-		return hmac.New(sha256.New, h.value)
+type kdfHash interface {
+	hash.Hash
+	clone() kdfHash
+	freeze()
+}
+
+type kdfLevel struct {
+	inner kdfHash
+	outer kdfHash
+}
+
+func newKDFLevel(parent *kdfLevel, key []byte) *kdfLevel {
+	if len(key) > sha256.BlockSize {
+		keyHash := parent.New()
+		common.Must1(keyHash.Write(key))
+		key = keyHash.Sum(nil)
+	}
+	var ipad, opad [sha256.BlockSize]byte
+	copy(ipad[:], key)
+	copy(opad[:], key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
 	}
-	return hmac.New(h.parent.Create, h.value)
+	level := &kdfLevel{
+		inner: parent.New(),
+		outer: parent.New(),
+	}
+	common.Must1(level.inner.Write(ipad[:]))
+	common.Must1(level.outer.Write(opad[:]))
+	level.inner.freeze()
+	level.outer.freeze()
+	return level
+}
+
+func (l *kdfLevel) New() kdfHash {
+	if l == nil {
+		return &kdfSHA256{Hash: sha256.New()}
+	}
+	return &kdfHMAC{l, l.inner.clone()}
+}
+
+type kdfSHA256 struct {
+	hash.Hash
+	frozen []byte
+}
+
+func (h *kdfSHA256) clone() kdfHash {
+	state := h.frozen
+	if state == nil {
+		state = common.Must1(h.Hash.(encoding.BinaryMarshaler).MarshalBinary())
+	}
+	cloned := sha256.New()
+	common.Must(cloned.(encoding.BinaryUnmarshaler).UnmarshalBinary(state))
+	return &kdfSHA256{Hash: cloned}
+}
+
+func (h *kdfSHA256) freeze() {
+	h.frozen = common.Must1(h.Hash.(encoding.BinaryMarshaler).MarshalBinary())
+}
+
+type kdfHMAC struct {
+	level *kdfLevel
+	inner kdfHash
+}
+
+func (h *kdfHMAC) Write(p []byte) (n int, err error) {
+	return h.inner.Write(p)
+}
+
+func (h *kdfHMAC) Sum(b []byte) []byte {
+	outer := h.level.outer.clone()
+	common.Must1(outer.Write(h.inner.Sum(nil)))
+	return outer.Sum(b)
+}
+
+func (h *kdfHMAC) Reset() {
+	h.inner = h.level.inner.clone()
+}
+
+func (h *kdfHMAC) Size() int {
+	return sha256.Size
+}
+
+func (h *kdfHMAC) BlockSize() int {
+	return sha256.BlockSize
+}
+
+func (h *kdfHMAC) freeze() {
+	h.inner.freeze()
+}
+
+func (h *kdfHMAC) clone() kdfHash {
+	return &kdfHMAC{h.level, h.inner.clone()}
 }
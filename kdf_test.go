@@ -0,0 +1,98 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"testing"
+)
+
+func referenceKDF(key []byte, salt string, path ...[]byte) []byte {
+	newHash := func() hash.Hash {
+		return hmac.New(sha256.New, []byte(KDFSaltConstVMessAEADKDF))
+	}
+	for _, element := range append([][]byte{[]byte(salt)}, path...) {
+		parent, element := newHash, element
+		newHash = func() hash.Hash {
+			return hmac.New(parent, element)
+		}
+	}
+	hmacHash := newHash()
+	hmacHash.Write(key)
+	return hmacHash.Sum(nil)
+}
+
+func testKDFBytes(length int, seed byte) []byte {
+	value := make([]byte, length)
+	for i := range value {
+		value[i] = seed + byte(i)*7
+	}
+	return value
+}
+
+func TestKDF(t *testing.T) {
+	salts := []string{KDFSaltConstAuthIDEncryptionKey, "auth_len", "uncached salt", string(testKDFBytes(100, 1))}
+	deriver := NewKDFDeriver(KDFSaltConstVMessHeaderPayloadAEADKey)
+	cachedSalts := len(kdfSalts)
+	for _, keyLen := range []int{0, 16, 64, 65, 200} {
+		key := testKDFBytes(keyLen, 2)
+		for depth := 0; depth <= 4; depth++ {
+			var path [][]byte
+			for i := 0; i < depth; i++ {
+				path = append(path, testKDFBytes([]int{8, 16, 64, 65, 128}[i], byte(i)))
+			}
+			for _, salt := range salts {
+				if !bytes.Equal(KDF(key, salt, path...), referenceKDF(key, salt, path...)) {
+					t.Fatal("KDF mismatch: key ", keyLen, " bytes, depth ", depth, ", salt ", len(salt), " bytes")
+				}
+			}
+			if !bytes.Equal(deriver.Derive(nil, key, path...), referenceKDF(key, KDFSaltConstVMessHeaderPayloadAEADKey, path...)) {
+				t.Fatal("KDFDeriver mismatch: key ", keyLen, " bytes, depth ", depth)
+			}
+		}
+	}
+	if len(kdfSalts) != cachedSalts {
+		t.Fatal("salt cache grew from ", cachedSalts, " to ", len(kdfSalts))
+	}
+}
+
+func BenchmarkKDF(b *testing.B) {
+	key := testKDFBytes(16, 1)
+	authId := testKDFBytes(16, 2)
+	nonce := testKDFBytes(8, 3)
+	for _, implementation := range []struct {
+		name string
+		kdf  func(key []byte, salt string, path ...[]byte) []byte
+	}{
+		{"reference", referenceKDF},
+		{"memoized", KDF},
+	} {
+		b.Run(implementation.name+"/header", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				implementation.kdf(key, KDFSaltConstVMessHeaderPayloadAEADKey, authId, nonce)
+			}
+		})
+		b.Run(implementation.name+"/auth_len", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				implementation.kdf(key, "auth_len")
+			}
+		})
+	}
+	b.Run("memoized/uncached salt", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			KDF(key, "uncached salt")
+		}
+	})
+	b.Run("deriver/header", func(b *testing.B) {
+		b.ReportAllocs()
+		deriver := NewKDFDeriver(KDFSaltConstVMessHeaderPayloadAEADKey)
+		dst := make([]byte, 0, sha256.Size)
+		for i := 0; i < b.N; i++ {
+			deriver.Derive(dst, key, authId, nonce)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+package vmess
+
+import (
+	"context"
+
+	"github.com/sagernet/sing/common/logger"
+)
+
+// Logger receives trace messages about handshakes and chunk framing, never keys or nonces.
+type Logger = logger.ContextLogger
+
+func (s *connStats) trace(args ...any) {
+	if s == nil || s.logger == nil {
+		return
+	}
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.logger.TraceContext(ctx, args...)
+}
@@ -0,0 +1,142 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+)
+
+// memoryAccountant makes chunk readers wait while the plaintext buffered across the service is over the limit.
+type memoryAccountant struct {
+	limit  int64
+	access sync.Mutex
+	total  int64
+	notify chan struct{}
+}
+
+func newMemoryAccountant(limit int64) *memoryAccountant {
+	return &memoryAccountant{limit: limit}
+}
+
+func (a *memoryAccountant) add(n int64) {
+	a.access.Lock()
+	defer a.access.Unlock()
+	a.total += n
+	if a.notify != nil && a.total <= a.limit {
+		close(a.notify)
+		a.notify = nil
+	}
+}
+
+func (a *memoryAccountant) overLimit() <-chan struct{} {
+	a.access.Lock()
+	defer a.access.Unlock()
+	if a.total <= a.limit {
+		return nil
+	}
+	if a.notify == nil {
+		a.notify = make(chan struct{})
+	}
+	return a.notify
+}
+
+func (a *memoryAccountant) buffered() int64 {
+	if a == nil {
+		return 0
+	}
+	a.access.Lock()
+	defer a.access.Unlock()
+	return a.total
+}
+
+func (s *Service[U]) BufferedBytes() int64 {
+	return s.memory.buffered()
+}
+
+func (a *memoryAccountant) open() *memoryAccount {
+	if a == nil {
+		return nil
+	}
+	return &memoryAccount{accountant: a, done: make(chan struct{})}
+}
+
+type memoryAccount struct {
+	accountant *memoryAccountant
+	access     sync.Mutex
+	held       int64
+	closed     bool
+	done       chan struct{}
+}
+
+func (m *memoryAccount) hold(n int) {
+	m.update(int64(n))
+}
+
+func (m *memoryAccount) release(n int) {
+	m.update(-int64(n))
+}
+
+func (m *memoryAccount) update(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.closed {
+		return
+	}
+	m.held += n
+	m.accountant.add(n)
+}
+
+func (m *memoryAccount) wait() error {
+	if m == nil {
+		return nil
+	}
+	for {
+		notify := m.accountant.overLimit()
+		if notify == nil {
+			return nil
+		}
+		select {
+		case <-notify:
+		case <-m.done:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+func (m *memoryAccount) buffered() int64 {
+	if m == nil {
+		return 0
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.held
+}
+
+func (m *memoryAccount) close() {
+	if m == nil {
+		return
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.done)
+	m.accountant.add(-m.held)
+	m.held = 0
+}
+
+func setMemoryAccount(reader any, account *memoryAccount) {
+	if account == nil {
+		return
+	}
+	switch reader := reader.(type) {
+	case *ChunkReader:
+		reader.memory = account
+	case *PipelinedReader:
+		reader.memory = account
+	}
+}
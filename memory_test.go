@@ -0,0 +1,80 @@
+package vmess
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type stallHandler struct {
+	release  chan struct{}
+	received chan int64
+}
+
+func (h *stallHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	defer conn.Close()
+	_, err := io.ReadFull(conn, make([]byte, 1))
+	if err != nil {
+		return err
+	}
+	<-h.release
+	n, err := io.Copy(io.Discard, conn)
+	h.received <- n + 1
+	return err
+}
+
+func (h *stallHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return conn.Close()
+}
+
+func (h *stallHandler) NewError(ctx context.Context, err error) {
+}
+
+func TestMemoryLimit(t *testing.T) {
+	const (
+		conns = 8
+		size  = 1 << 20
+		limit = 64 * 1024
+	)
+	for _, depth := range []int{0, 8} {
+		handler := &stallHandler{make(chan struct{}), make(chan int64, conns)}
+		options := []ServiceOption{ServiceWithMemoryLimit(limit)}
+		if depth > 0 {
+			options = append(options, ServiceWithPipelinedRead(depth))
+		}
+		service := newTestService(t, handler, options...)
+		client := newTestClient(t, testUserID)
+		for i := 0; i < conns; i++ {
+			upstream, _ := serveTestConn(service)
+			conn := client.DialEarlyConn(upstream, M.ParseSocksaddr("example.com:80"))
+			go func() {
+				conn.Write(make([]byte, size))
+				conn.Close()
+			}()
+		}
+		time.Sleep(300 * time.Millisecond)
+		buffered := service.BufferedBytes()
+		if buffered == 0 || buffered > limit+conns*maxChunkReadSize {
+			t.Fatal("depth ", depth, ": ", buffered, " bytes buffered with stalled handlers")
+		}
+		close(handler.release)
+		for i := 0; i < conns; i++ {
+			received := <-handler.received
+			if received != size {
+				t.Fatal("depth ", depth, ": handler received ", received, " bytes")
+			}
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for service.BufferedBytes() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("depth ", depth, ": ", service.BufferedBytes(), " bytes still accounted after close")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package vmess
+
+import "errors"
+
+const (
+	HandshakeFailureAuth    = "auth"
+	HandshakeFailureReplay  = "replay"
+	HandshakeFailureHeader  = "header"
+	HandshakeFailureLimit   = "limit"
+	HandshakeFailureClosed  = "closed"
+	HandshakeFailureUnknown = "unknown"
+)
+
+var HandshakeFailureReasons = []string{
+	HandshakeFailureAuth,
+	HandshakeFailureReplay,
+	HandshakeFailureHeader,
+	HandshakeFailureLimit,
+	HandshakeFailureClosed,
+	HandshakeFailureUnknown,
+}
+
+// Metrics receives protocol level events of a service and must be safe for concurrent use.
+type Metrics interface {
+	HandshakeSucceeded()
+	HandshakeFailed(reason string)
+	ConnectionOpened()
+	ConnectionClosed()
+	BytesRead(n uint64)
+	BytesWritten(n uint64)
+	ChunkDecryptFailed()
+	ReplayRejected()
+}
+
+type NopMetrics struct{}
+
+func (NopMetrics) HandshakeSucceeded()    {}
+func (NopMetrics) HandshakeFailed(string) {}
+func (NopMetrics) ConnectionOpened()      {}
+func (NopMetrics) ConnectionClosed()      {}
+func (NopMetrics) BytesRead(uint64)       {}
+func (NopMetrics) BytesWritten(uint64)    {}
+func (NopMetrics) ChunkDecryptFailed()    {}
+func (NopMetrics) ReplayRejected()        {}
+
+func handshakeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrReplay):
+		return HandshakeFailureReplay
+	case errors.Is(err, ErrAuthFailed):
+		return HandshakeFailureAuth
+	case errors.Is(err, ErrHeaderDecode):
+		return HandshakeFailureHeader
+	case errors.Is(err, ErrTooManyHandshakes):
+		return HandshakeFailureLimit
+	case errors.Is(err, ErrServiceClosed):
+		return HandshakeFailureClosed
+	default:
+		return HandshakeFailureUnknown
+	}
+}
@@ -0,0 +1,104 @@
+package vmess
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	F "github.com/sagernet/sing/common/format"
+)
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// PrometheusMetrics serves the Metrics counters in the Prometheus text exposition format.
+type PrometheusMetrics struct {
+	handshakes         uint64
+	activeConns        int64
+	bytesRead          uint64
+	bytesWritten       uint64
+	chunkDecryptErrors uint64
+	replays            uint64
+	handshakeFailures  []uint64
+	namespace          string
+}
+
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "vmess"
+	}
+	return &PrometheusMetrics{
+		namespace:         namespace,
+		handshakeFailures: make([]uint64, len(HandshakeFailureReasons)),
+	}
+}
+
+func (m *PrometheusMetrics) HandshakeSucceeded() {
+	atomic.AddUint64(&m.handshakes, 1)
+}
+
+func (m *PrometheusMetrics) HandshakeFailed(reason string) {
+	for i, knownReason := range HandshakeFailureReasons {
+		if reason == knownReason {
+			atomic.AddUint64(&m.handshakeFailures[i], 1)
+			return
+		}
+	}
+	atomic.AddUint64(&m.handshakeFailures[len(m.handshakeFailures)-1], 1)
+}
+
+func (m *PrometheusMetrics) ConnectionOpened() {
+	atomic.AddInt64(&m.activeConns, 1)
+}
+
+func (m *PrometheusMetrics) ConnectionClosed() {
+	atomic.AddInt64(&m.activeConns, -1)
+}
+
+func (m *PrometheusMetrics) BytesRead(n uint64) {
+	atomic.AddUint64(&m.bytesRead, n)
+}
+
+func (m *PrometheusMetrics) BytesWritten(n uint64) {
+	atomic.AddUint64(&m.bytesWritten, n)
+}
+
+func (m *PrometheusMetrics) ChunkDecryptFailed() {
+	atomic.AddUint64(&m.chunkDecryptErrors, 1)
+}
+
+func (m *PrometheusMetrics) ReplayRejected() {
+	atomic.AddUint64(&m.replays, 1)
+}
+
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var output []byte
+	metric := func(name string, metricType string, help string) {
+		output = append(output, F.ToString("# HELP ", m.namespace, "_", name, " ", help, "\n# TYPE ", m.namespace, "_", name, " ", metricType, "\n")...)
+	}
+	sample := func(name string, labels string, value any) {
+		output = append(output, F.ToString(m.namespace, "_", name, labels, " ", value, "\n")...)
+	}
+	metric("handshakes_total", "counter", "Completed handshakes.")
+	sample("handshakes_total", "", atomic.LoadUint64(&m.handshakes))
+	metric("handshake_failures_total", "counter", "Failed handshakes by reason.")
+	for i, reason := range HandshakeFailureReasons {
+		sample("handshake_failures_total", "{reason=\""+reason+"\"}", atomic.LoadUint64(&m.handshakeFailures[i]))
+	}
+	metric("active_connections", "gauge", "Connections accepted and not yet closed.")
+	sample("active_connections", "", atomic.LoadInt64(&m.activeConns))
+	metric("bytes_read_total", "counter", "Bytes read from clients.")
+	sample("bytes_read_total", "", atomic.LoadUint64(&m.bytesRead))
+	metric("bytes_written_total", "counter", "Bytes written to clients.")
+	sample("bytes_written_total", "", atomic.LoadUint64(&m.bytesWritten))
+	metric("chunk_decrypt_failures_total", "counter", "Payload chunks failing authentication.")
+	sample("chunk_decrypt_failures_total", "", atomic.LoadUint64(&m.chunkDecryptErrors))
+	metric("replays_total", "counter", "Requests rejected by the replay filter.")
+	sample("replays_total", "", atomic.LoadUint64(&m.replays))
+	n, err := w.Write(output)
+	return int64(n), err
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
@@ -0,0 +1,62 @@
+package vmess
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics("")
+	service := newTestService(t, &echoHandler{}, ServiceWithMetrics(metrics))
+
+	upstream, done := serveTestConn(service)
+	recorder := &recordConn{Conn: upstream}
+	conn, err := newTestClient(t, testUserID).DialConn(recorder, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-done
+
+	garbage, done := serveTestConn(service)
+	go garbage.Write(bytes.Repeat([]byte{1}, 128))
+	waitHandshake(t, "garbage", done)
+	garbage.Close()
+
+	replayed, done := serveTestConn(service)
+	go replayed.Write(recorder.bytes())
+	waitHandshake(t, "replayed", done)
+	replayed.Close()
+
+	var output strings.Builder
+	_, err = metrics.WriteTo(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range []string{
+		"vmess_handshakes_total 1\n",
+		"vmess_handshake_failures_total{reason=\"auth\"} 1\n",
+		"vmess_handshake_failures_total{reason=\"replay\"} 1\n",
+		"vmess_active_connections 0\n",
+		"vmess_replays_total 1\n",
+	} {
+		if !strings.Contains(output.String(), sample) {
+			t.Fatal("missing sample ", strings.TrimSpace(sample), " in:\n", output.String())
+		}
+	}
+	if metrics.bytesRead == 0 || metrics.bytesWritten == 0 {
+		t.Fatal("bytes not counted: read ", metrics.bytesRead, ", written ", metrics.bytesWritten)
+	}
+}
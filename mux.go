@@ -19,6 +19,20 @@ import (
 	N "github.com/sagernet/sing/common/network"
 )
 
+var SingMuxDestination = M.Socksaddr{
+	Fqdn: "sp.mux.sing-box.arpa",
+	Port: 444,
+}
+
+func IsSingMuxDestination(destination M.Socksaddr) bool {
+	return destination.Fqdn == SingMuxDestination.Fqdn
+}
+
+// MuxHandler serves a mux stream and passes each inner stream to handler.
+type MuxHandler interface {
+	NewMuxConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error
+}
+
 func HandleMuxConnection(ctx context.Context, conn net.Conn, handler Handler) error {
 	session := &serverSession{
 		ctx:          ctx,
@@ -100,6 +114,7 @@ func (c *serverSession) recv() error {
 
 	var network byte
 	var destination M.Socksaddr
+	var globalID *[XUDPGlobalIDLength]byte
 	if length > 4 {
 		limitReader := io.LimitReader(c.conn, int64(length-4))
 		err = binary.Read(limitReader, binary.BigEndian, &network)
@@ -110,6 +125,13 @@ func (c *serverSession) recv() error {
 		if err != nil {
 			return err
 		}
+		if status == StatusNew && network == NetworkUDP && limitReader.(*io.LimitedReader).N >= XUDPGlobalIDLength {
+			globalID = new([XUDPGlobalIDLength]byte)
+			_, err = io.ReadFull(limitReader, globalID[:])
+			if err != nil {
+				return err
+			}
+		}
 		if limitReader.(*io.LimitedReader).N > 0 {
 			_, err = io.Copy(io.Discard, limitReader)
 			if err != nil {
@@ -135,10 +157,14 @@ func (c *serverSession) recv() error {
 		default:
 			return E.New("bad network: ", network)
 		}
+		ctx := c.ctx
+		if globalID != nil {
+			ctx = ContextWithXUDPGlobalID(ctx, *globalID)
+		}
 		go func() {
 			var hErr error
 			if network == NetworkTCP {
-				hErr = c.handler.NewConnection(c.ctx, &serverMuxConn{
+				hErr = c.handler.NewConnection(ctx, &serverMuxConn{
 					sessionID,
 					pipeIn,
 					c,
@@ -146,7 +172,7 @@ func (c *serverSession) recv() error {
 					Destination: destination,
 				})
 			} else {
-				hErr = c.handler.NewPacketConnection(c.ctx, &serverMuxPacketConn{
+				hErr = c.handler.NewPacketConnection(ctx, &serverMuxPacketConn{
 					sessionID,
 					pipeIn,
 					c,
@@ -156,7 +182,7 @@ func (c *serverSession) recv() error {
 				})
 			}
 			if hErr != nil {
-				c.handler.NewError(c.ctx, hErr)
+				c.handler.NewError(ctx, hErr)
 			}
 		}()
 	case StatusKeep:
@@ -0,0 +1,60 @@
+package vmess
+
+import (
+	"strconv"
+	"strings"
+
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	MuxCoolVersion = 1
+	muxCoolSuffix  = "mux.cool"
+	muxCoolPort    = 9527
+)
+
+// ErrBadMuxRequest rejects a TCP request to a mux.cool name that is not a version and port the service speaks.
+type ErrBadMuxRequest struct {
+	Destination M.Socksaddr
+	Reason      string
+}
+
+func (e *ErrBadMuxRequest) Error() string {
+	return F.ToString("vmess: bad mux request to ", e.Destination, ": ", e.Reason)
+}
+
+func (e *ErrBadMuxRequest) Unwrap() error {
+	return ErrBadHeader
+}
+
+func IsMuxCoolDestination(destination M.Socksaddr) bool {
+	if !destination.IsFqdn() {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+	return name == muxCoolSuffix || strings.HasSuffix(name, "."+muxCoolSuffix)
+}
+
+func parseMuxCoolDestination(destination M.Socksaddr) (int, error) {
+	name := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+	label := strings.TrimSuffix(name, "."+muxCoolSuffix)
+	if len(label) < 2 || label[0] != 'v' || label[1] == '0' || strings.Contains(label, ".") {
+		return 0, &ErrBadMuxRequest{destination, "bad mux domain"}
+	}
+	version, err := strconv.ParseUint(label[1:], 10, 8)
+	if err != nil {
+		return 0, &ErrBadMuxRequest{destination, "bad mux domain"}
+	}
+	if version != MuxCoolVersion {
+		return 0, &ErrBadMuxRequest{destination, "unsupported mux version " + label[1:]}
+	}
+	if destination.Port != muxCoolPort && destination.Port != MuxDestination.Port {
+		return 0, &ErrBadMuxRequest{destination, "bad mux port " + strconv.Itoa(int(destination.Port))}
+	}
+	return int(version), nil
+}
+
+func (c *rawServerConn) MuxVersion() int {
+	return c.muxVersion
+}
@@ -0,0 +1,194 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	mux "github.com/sagernet/sing-mux"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type singMuxHandler struct {
+	destinations chan M.Socksaddr
+}
+
+func (h *singMuxHandler) NewMuxConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, handler Handler) error {
+	h.destinations <- metadata.Destination
+	return mux.HandleConnection(ctx, handler, logger.NOP(), conn, metadata)
+}
+
+type muxTestDialer struct {
+	service    *Service[int]
+	client     *Client
+	commandMux bool
+}
+
+func (d *muxTestDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	upstream, _ := serveTestConn(d.service)
+	if d.commandMux {
+		return d.client.DialEarlyMuxConnContext(ctx, upstream), nil
+	}
+	return d.client.DialEarlyConnContext(ctx, upstream, destination), nil
+}
+
+func (d *muxTestDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, os.ErrInvalid
+}
+
+var _ N.Dialer = (*muxTestDialer)(nil)
+
+func TestSingMux(t *testing.T) {
+	handler := &singMuxHandler{destinations: make(chan M.Socksaddr, 1)}
+	service := newTestService(t, &echoHandler{}, ServiceWithMuxHandler(handler))
+	for _, commandMux := range []bool{false, true} {
+		for _, protocol := range []string{"smux", "yamux", "h2mux"} {
+			if protocol == "h2mux" && raceEnabled {
+				// sing-mux v0.1.2 h2mux races on its own conn state.
+				continue
+			}
+			name := protocol
+			if commandMux {
+				name += " over CommandMux"
+			}
+			client, err := mux.NewClient(mux.Options{
+				Dialer:     &muxTestDialer{service, newTestClient(t, testUserID), commandMux},
+				Protocol:   protocol,
+				MaxStreams: 4,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 4; i++ {
+				conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("example.com:80"))
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				payload := []byte{byte(i), 1, 2, 3}
+				_, err = conn.Write(payload)
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				echoed := make([]byte, len(payload))
+				_, err = io.ReadFull(conn, echoed)
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				if string(echoed) != string(payload) {
+					t.Fatal(name, ": stream ", i, " echoed ", echoed)
+				}
+				conn.Close()
+			}
+			destination := <-handler.destinations
+			if commandMux && destination != MuxDestination || !commandMux && !IsSingMuxDestination(destination) {
+				t.Fatal(name, ": mux handler got destination ", destination)
+			}
+			client.Close()
+		}
+	}
+}
+
+func TestSingMuxRewrite(t *testing.T) {
+	rewritten := M.ParseSocksaddr("127.0.0.1:8080")
+	handler := &destinationHandler{destinations: make(chan M.Socksaddr, 1)}
+	service := newTestService(t, handler, ServiceWithMuxHandler(&singMuxHandler{destinations: make(chan M.Socksaddr, 2)}))
+	service.SetRewriteHandler(func(session SessionInfo[int]) (M.Socksaddr, error) {
+		if session.Destination.Fqdn != "example.com" {
+			t.Error("rewrite got destination ", session.Destination)
+		}
+		return rewritten, nil
+	})
+	for _, commandMux := range []bool{false, true} {
+		client, err := mux.NewClient(mux.Options{
+			Dialer:     &muxTestDialer{service, newTestClient(t, testUserID), commandMux},
+			Protocol:   "smux",
+			MaxStreams: 4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("rewrite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		destination := <-handler.destinations
+		if destination != rewritten {
+			t.Fatal("commandMux=", commandMux, ": inner stream dialed ", destination)
+		}
+		_, err = io.ReadFull(conn, make([]byte, 7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+type globalIDHandler struct {
+	globalIDs chan *[XUDPGlobalIDLength]byte
+}
+
+func (h *globalIDHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return os.ErrInvalid
+}
+
+func (h *globalIDHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer conn.Close()
+	globalID, loaded := XUDPGlobalIDFromContext(ctx)
+	if loaded {
+		h.globalIDs <- &globalID
+	} else {
+		h.globalIDs <- nil
+	}
+	return nil
+}
+
+func (h *globalIDHandler) NewError(ctx context.Context, err error) {
+}
+
+func TestMuxXUDPGlobalID(t *testing.T) {
+	globalID := [XUDPGlobalIDLength]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, test := range []struct {
+		name   string
+		extra  []byte
+		parsed bool
+	}{
+		{"exact", globalID[:], true},
+		{"trailing", append(globalID[:], 9, 10, 11), true},
+		{"short", globalID[:4], false},
+		{"none", nil, false},
+	} {
+		handler := &globalIDHandler{globalIDs: make(chan *[XUDPGlobalIDLength]byte, 1)}
+		clientConn, serverConn := net.Pipe()
+		go HandleMuxConnection(context.Background(), serverConn, handler)
+		var frame bytes.Buffer
+		frame.Write([]byte{0, 0, 0, 1, StatusNew, 0, NetworkUDP})
+		err := AddressSerializer.WriteAddrPort(&frame, M.ParseSocksaddr("1.1.1.1:53"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame.Write(test.extra)
+		binary.BigEndian.PutUint16(frame.Bytes(), uint16(frame.Len()-2))
+		_, err = clientConn.Write(frame.Bytes())
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		received := <-handler.globalIDs
+		if !test.parsed && received != nil {
+			t.Fatal(test.name, ": unexpected global id ", *received)
+		} else if test.parsed && (received == nil || *received != globalID) {
+			t.Fatal(test.name, ": global id not parsed")
+		}
+		clientConn.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	PacketEncodingNone       = ""
+	PacketEncodingPacketAddr = "packetaddr"
+	PacketEncodingXUDP       = "xudp"
+)
+
+var _ N.Dialer = (*Outbound)(nil)
+
+type Outbound struct {
+	client         *Client
+	dialer         N.Dialer
+	servers        []M.Socksaddr
+	packetEncoding string
+	endpointDelay  time.Duration
+}
+
+func NewOutbound(dialer N.Dialer, server M.Socksaddr, userId string, security string, alterId int, packetEncoding string, options ...ClientOption) (*Outbound, error) {
+	return NewOutboundWithEndpoints(dialer, []M.Socksaddr{server}, userId, security, alterId, packetEncoding, options...)
+}
+
+// NewOutboundWithEndpoints races each dial across several endpoints of the same server.
+func NewOutboundWithEndpoints(dialer N.Dialer, servers []M.Socksaddr, userId string, security string, alterId int, packetEncoding string, options ...ClientOption) (*Outbound, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	switch packetEncoding {
+	case PacketEncodingNone, PacketEncodingPacketAddr, PacketEncodingXUDP:
+	default:
+		return nil, E.New("unknown packet encoding: ", packetEncoding)
+	}
+	client, err := NewClient(userId, security, alterId, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbound{
+		client:         client,
+		dialer:         dialer,
+		servers:        servers,
+		packetEncoding: packetEncoding,
+	}, nil
+}
+
+func (o *Outbound) SetEndpointDelay(delay time.Duration) {
+	o.endpointDelay = delay
+}
+
+func (o *Outbound) Client() *Client {
+	return o.client
+}
+
+func (o *Outbound) Server() M.Socksaddr {
+	return o.servers[0]
+}
+
+func (o *Outbound) Servers() []M.Socksaddr {
+	return o.servers
+}
+
+func (o *Outbound) raceEndpoints(ctx context.Context, handshake endpointHandshake) (net.Conn, error) {
+	return raceEndpoints(ctx, o.dialer, o.servers, o.endpointDelay, handshake)
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	network = N.NetworkName(network)
+	switch network {
+	case N.NetworkTCP, N.NetworkUDP:
+	default:
+		return nil, E.Extend(N.ErrUnknownNetwork, network)
+	}
+	if len(o.servers) > 1 {
+		return o.raceDialContext(ctx, network, destination)
+	}
+	// a rejected session ticket is retried with a full handshake
+	if network == N.NetworkTCP && o.client.sessionTickets != nil {
+		return NewFallbackDialer(o.dialer, o.servers[0], o.client, o.client).DialConn(ctx, destination)
+	}
+	conn, err := o.dialer.DialContext(ctx, N.NetworkTCP, o.servers[0])
+	if err != nil {
+		return nil, err
+	}
+	// a connected UDP conn has a single destination, the plain UDP command
+	// carries it without the packet encoding overhead
+	if network == N.NetworkUDP {
+		return o.client.DialEarlyPacketConnContext(ctx, conn, destination), nil
+	}
+	return o.client.DialEarlyConnContext(ctx, conn, destination), nil
+}
+
+func (o *Outbound) raceDialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if network == N.NetworkUDP {
+		return o.raceEndpoints(ctx, func(ctx context.Context, upstream net.Conn) (net.Conn, error) {
+			return o.client.DialPacketConnContext(ctx, upstream, destination)
+		})
+	}
+	conn, err := o.raceEndpoints(ctx, func(ctx context.Context, upstream net.Conn) (net.Conn, error) {
+		return o.client.DialConnContext(ctx, upstream, destination)
+	})
+	if err != nil || o.client.sessionTickets == nil {
+		return conn, err
+	}
+	// a rejected session ticket is retried with a full handshake to the
+	// endpoint that won
+	endpoint := conn.(*clientConn).Endpoint()
+	return &fallbackConn{
+		ctx:         ctx,
+		dialer:      NewFallbackDialer(o.dialer, endpoint, o.client, o.client),
+		destination: destination,
+		conn:        conn,
+	}, nil
+}
+
+func (o *Outbound) DialMux(ctx context.Context) (net.Conn, error) {
+	if len(o.servers) > 1 {
+		return o.raceEndpoints(ctx, func(ctx context.Context, upstream net.Conn) (net.Conn, error) {
+			return o.client.DialMuxConnContext(ctx, upstream)
+		})
+	}
+	conn, err := o.dialer.DialContext(ctx, N.NetworkTCP, o.servers[0])
+	if err != nil {
+		return nil, err
+	}
+	return o.client.DialEarlyMuxConnContext(ctx, conn), nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	if len(o.servers) > 1 {
+		conn, err := o.raceEndpoints(ctx, func(ctx context.Context, upstream net.Conn) (net.Conn, error) {
+			switch o.packetEncoding {
+			case PacketEncodingPacketAddr:
+				return o.client.DialPacketAddrConnContext(ctx, upstream, destination)
+			case PacketEncodingXUDP:
+				return o.client.DialXUDPPacketConnContext(ctx, upstream, destination)
+			default:
+				return o.client.DialPacketConnContext(ctx, upstream, destination)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return conn.(net.PacketConn), nil
+	}
+	conn, err := o.dialer.DialContext(ctx, N.NetworkTCP, o.servers[0])
+	if err != nil {
+		return nil, err
+	}
+	switch o.packetEncoding {
+	case PacketEncodingPacketAddr:
+		return o.client.DialEarlyPacketAddrConnContext(ctx, conn, destination), nil
+	case PacketEncodingXUDP:
+		return o.client.DialEarlyXUDPPacketConnContext(ctx, conn, destination), nil
+	default:
+		return o.client.DialEarlyPacketConnContext(ctx, conn, destination), nil
+	}
+}
@@ -0,0 +1,29 @@
+package vmess
+
+// Pacer is called with the wire size of each length chunk before it is written and may block to delay it.
+type Pacer interface {
+	Pace(length int) error
+}
+
+type PacerFunc func(length int) error
+
+func (f PacerFunc) Pace(length int) error {
+	return f(length)
+}
+
+func setPacer(chain any, pacer Pacer) {
+	if pacer == nil {
+		return
+	}
+	walkUpstream(chain, func(layer any) bool {
+		switch layer := layer.(type) {
+		case *StreamChunkWriter:
+			layer.pacer = pacer
+		case *AEADChunkWriter:
+			layer.pacer = pacer
+		case *statsWriter:
+			return false
+		}
+		return true
+	})
+}
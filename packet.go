@@ -0,0 +1,115 @@
+package vmess
+
+import (
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	MaxPacketChunkSize            = 65535 - CipherOverhead - MaxPaddingSize
+	requestReservedPacketFragment = 1
+	packetFragmentHeaderLen       = 1
+	packetFragmentDataLen         = MaxPacketChunkSize - packetFragmentHeaderLen
+)
+
+const (
+	packetFragmentNone byte = iota
+	packetFragmentMore
+	packetFragmentLast
+)
+
+var (
+	ErrBadPacketFragment = E.New("vmess: bad packet fragment")
+	ErrPacketTooLarge    = E.New("vmess: packet too large")
+	ErrPacketDestination = E.New("vmess: packet destination differs from the connection")
+)
+
+func writePacket(writer N.ExtendedWriter, buffer *buf.Buffer, fragment bool) error {
+	if chunkWriter, isChunkWriter := writer.(*chunkSplitWriter); isChunkWriter {
+		writer = chunkWriter.Upstream().(N.ExtendedWriter)
+	}
+	if !fragment {
+		if buffer.Len() > MaxPacketChunkSize {
+			buffer.Release()
+			return E.Extend(ErrPacketTooLarge, buffer.Len())
+		}
+		return writer.WriteBuffer(buffer)
+	}
+	if buffer.Len() > packetFragmentDataLen {
+		defer buffer.Release()
+		return writePacketFragments(writer, buffer.Bytes())
+	}
+	fragmentHeadroom := headroomOf(writer)
+	fragmentHeadroom.front += packetFragmentHeaderLen
+	buffer = fragmentHeadroom.ensure(buffer)
+	buffer.ExtendHeader(packetFragmentHeaderLen)[0] = packetFragmentNone
+	return writer.WriteBuffer(buffer)
+}
+
+func writePacketFragments(writer N.ExtendedWriter, data []byte) error {
+	fragmentHeadroom := headroomOf(writer)
+	for len(data) > 0 {
+		dataLen := len(data)
+		flag := packetFragmentLast
+		if dataLen > packetFragmentDataLen {
+			dataLen = packetFragmentDataLen
+			flag = packetFragmentMore
+		}
+		fragment := fragmentHeadroom.newBuffer(packetFragmentHeaderLen + dataLen)
+		common.Must(fragment.WriteByte(flag))
+		common.Must1(fragment.Write(data[:dataLen]))
+		err := writer.WriteBuffer(fragment)
+		if err != nil {
+			return err
+		}
+		data = data[dataLen:]
+	}
+	return nil
+}
+
+func readPacket(reader N.ExtendedReader, buffer *buf.Buffer, fragment bool) error {
+	err := reader.ReadBuffer(buffer)
+	if err != nil || !fragment {
+		return err
+	}
+	flag, err := parsePacketFragment(buffer)
+	if err != nil {
+		return err
+	}
+	switch flag {
+	case packetFragmentNone:
+		return nil
+	case packetFragmentLast:
+		return E.Extend(ErrBadPacketFragment, "last fragment without first")
+	}
+	for flag == packetFragmentMore {
+		next := buf.With(buffer.FreeBytes())
+		err = reader.ReadBuffer(next)
+		if err != nil {
+			return E.Cause(err, "reassemble packet")
+		}
+		flag, err = parsePacketFragment(next)
+		if err != nil {
+			return err
+		}
+		if flag == packetFragmentNone {
+			return E.Extend(ErrBadPacketFragment, "unfragmented packet inside fragments")
+		}
+		copy(buffer.Extend(next.Len()), next.Bytes())
+	}
+	return nil
+}
+
+func parsePacketFragment(fragment *buf.Buffer) (flag byte, err error) {
+	if fragment.IsEmpty() {
+		return 0, E.Extend(ErrBadPacketFragment, "empty chunk")
+	}
+	flag = fragment.Byte(0)
+	if flag > packetFragmentLast {
+		return 0, E.Extend(ErrBadPacketFragment, "unknown flag ", flag)
+	}
+	fragment.Advance(packetFragmentHeaderLen)
+	return
+}
@@ -0,0 +1,58 @@
+package vmess
+
+import (
+	"net"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ net.PacketConn = (*NetPacketConn)(nil)
+
+// NetPacketConn follows net.UDPConn semantics on top of any tunneled packet conn.
+type NetPacketConn struct {
+	N.PacketConn
+	frontHeadroom int
+	rearHeadroom  int
+}
+
+func NewNetPacketConn(conn N.PacketConn) *NetPacketConn {
+	return &NetPacketConn{
+		PacketConn:    conn,
+		frontHeadroom: N.CalculateFrontHeadroom(conn),
+		rearHeadroom:  N.CalculateRearHeadroom(conn),
+	}
+}
+
+func (c *NetPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	destination, err := c.ReadPacket(buffer)
+	if err != nil {
+		return
+	}
+	n = copy(p, buffer.Bytes())
+	if destination.IsFqdn() {
+		addr = destination
+	} else {
+		addr = destination.UDPAddr()
+	}
+	return
+}
+
+func (c *NetPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buffer := buf.NewSize(c.frontHeadroom + len(p) + c.rearHeadroom)
+	buffer.Resize(c.frontHeadroom, 0)
+	common.Must1(buffer.Write(p))
+	err = c.WritePacket(buffer, M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *NetPacketConn) Upstream() any {
+	return c.PacketConn
+}
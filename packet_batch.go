@@ -0,0 +1,120 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	_ MultiPacketWriter = (*clientPacketConn)(nil)
+	_ MultiPacketWriter = (*serverPacketConn)(nil)
+)
+
+type MultiPacketWriter interface {
+	WriteMultiPacket(buffers []*buf.Buffer, destination M.Socksaddr) error
+}
+
+type packetBatchWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	batchLock  sync.Mutex
+	access     sync.Mutex
+	batching   bool
+	pending    []*buf.Buffer
+}
+
+func newPacketBatchWriter(upstream io.Writer) *packetBatchWriter {
+	return &packetBatchWriter{
+		upstream:   bufio.NewExtendedWriter(upstream),
+		vectorised: bufio.NewVectorisedWriter(upstream),
+	}
+}
+
+func (w *packetBatchWriter) begin() {
+	w.batchLock.Lock()
+	w.access.Lock()
+	w.batching = true
+	w.access.Unlock()
+}
+
+func (w *packetBatchWriter) flush() error {
+	w.access.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.batching = false
+	w.access.Unlock()
+	defer w.batchLock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return w.vectorised.WriteVectorised(pending)
+}
+
+func (w *packetBatchWriter) discard() {
+	w.access.Lock()
+	buf.ReleaseMulti(w.pending)
+	w.pending = nil
+	w.batching = false
+	w.access.Unlock()
+	w.batchLock.Unlock()
+}
+
+func (w *packetBatchWriter) collect(buffers ...*buf.Buffer) bool {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if !w.batching {
+		return false
+	}
+	w.pending = append(w.pending, buffers...)
+	return true
+}
+
+func (w *packetBatchWriter) Write(p []byte) (n int, err error) {
+	w.access.Lock()
+	if w.batching {
+		buffer := buf.NewSize(len(p))
+		common.Must1(buffer.Write(p))
+		w.pending = append(w.pending, buffer)
+		w.access.Unlock()
+		return len(p), nil
+	}
+	w.access.Unlock()
+	return w.upstream.Write(p)
+}
+
+func (w *packetBatchWriter) WriteBuffer(buffer *buf.Buffer) error {
+	if w.collect(buffer) {
+		return nil
+	}
+	return w.upstream.WriteBuffer(buffer)
+}
+
+func (w *packetBatchWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	if w.collect(buffers...) {
+		return nil
+	}
+	return w.vectorised.WriteVectorised(buffers)
+}
+
+func (w *packetBatchWriter) Upstream() any {
+	return w.upstream
+}
+
+func writeMultiPacket(writer N.ExtendedWriter, batch *packetBatchWriter, buffers []*buf.Buffer, fragment bool) error {
+	batch.begin()
+	for i, buffer := range buffers {
+		err := writePacket(writer, buffer, fragment)
+		if err != nil {
+			buf.ReleaseMulti(buffers[i+1:])
+			batch.discard()
+			return err
+		}
+	}
+	return batch.flush()
+}
@@ -0,0 +1,88 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestPacketFragment(t *testing.T) {
+	service := newTestService(t, &packetEchoHandler{})
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	for _, fragment := range []bool{true, false} {
+		var options []ClientOption
+		if fragment {
+			options = append(options, ClientWithPacketFragmentation())
+		}
+		client := newTestClient(t, testUserID, options...)
+		for _, size := range []int{1, packetFragmentDataLen, MaxPacketChunkSize, 70000} {
+			upstream, _ := serveTestConn(service)
+			recorder := &recordConn{Conn: upstream}
+			conn, err := client.DialPacketConn(recorder, destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := bytes.Repeat([]byte{byte(size)}, size)
+			err = conn.WritePacket(buf.As(payload), destination)
+			if !fragment && size > MaxPacketChunkSize {
+				if !errors.Is(err, ErrPacketTooLarge) {
+					t.Fatal("size ", size, ": unexpected error ", err)
+				}
+				conn.Close()
+				continue
+			}
+			if err != nil {
+				t.Fatal("fragment=", fragment, " size ", size, ": ", err)
+			}
+			buffer := buf.NewSize(size + MaxPacketChunkSize)
+			_, err = conn.ReadPacket(buffer)
+			if err != nil {
+				t.Fatal("fragment=", fragment, " size ", size, ": ", err)
+			}
+			if !bytes.Equal(buffer.Bytes(), payload) {
+				t.Fatal("fragment=", fragment, " size ", size, ": echoed ", buffer.Len(), " bytes")
+			}
+			buffer.Release()
+			if written := len(recorder.bytes()); written > size+2048 {
+				t.Fatal("fragment=", fragment, " size ", size, ": wrote ", written, " bytes")
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestPacketDestinationMismatch(t *testing.T) {
+	service := newTestService(t, &packetEchoHandler{})
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	other := M.ParseSocksaddr("8.8.8.8:53")
+	upstream, _ := serveTestConn(service)
+	conn, err := newTestClient(t, testUserID).DialPacketConn(upstream, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.WritePacket(buf.As([]byte("vmess")), other)
+	if !errors.Is(err, ErrPacketDestination) {
+		t.Fatal("WritePacket: unexpected error ", err)
+	}
+	_, err = conn.WriteTo([]byte("vmess"), other.UDPAddr())
+	if !errors.Is(err, ErrPacketDestination) {
+		t.Fatal("WriteTo: unexpected error ", err)
+	}
+	_, err = conn.WriteTo([]byte("vmess"), M.ParseSocksaddr("[::ffff:1.1.1.1]:53").UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := buf.New()
+	defer buffer.Release()
+	_, err = conn.ReadPacket(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer.Bytes()) != "vmess" {
+		t.Fatal("unexpected echo ", string(buffer.Bytes()))
+	}
+}
@@ -0,0 +1,41 @@
+package vmess
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing-vmess/packetaddr"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var PacketAddrDestination = M.Socksaddr{
+	Fqdn: packetaddr.SeqPacketMagicAddress,
+}
+
+func IsPacketAddrDestination(destination M.Socksaddr) bool {
+	return destination.Fqdn == packetaddr.SeqPacketMagicAddress
+}
+
+func NewPacketAddrConn(conn net.PacketConn, destination M.Socksaddr) *packetaddr.PacketConn {
+	return packetaddr.NewConn(conn, destination)
+}
+
+func (c *Client) DialPacketAddrConn(upstream net.Conn, destination M.Socksaddr) (*packetaddr.PacketConn, error) {
+	return c.DialPacketAddrConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialPacketAddrConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) (*packetaddr.PacketConn, error) {
+	conn, err := c.DialPacketConnContext(ctx, upstream, PacketAddrDestination)
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketAddrConn(conn, destination), nil
+}
+
+func (c *Client) DialEarlyPacketAddrConn(upstream net.Conn, destination M.Socksaddr) *packetaddr.PacketConn {
+	return c.DialEarlyPacketAddrConnContext(context.Background(), upstream, destination)
+}
+
+func (c *Client) DialEarlyPacketAddrConnContext(ctx context.Context, upstream net.Conn, destination M.Socksaddr) *packetaddr.PacketConn {
+	return NewPacketAddrConn(c.DialEarlyPacketConnContext(ctx, upstream, PacketAddrDestination), destination)
+}
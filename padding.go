@@ -0,0 +1,55 @@
+package vmess
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const (
+	// paddingHeaderLen is the masked padding length byte a padding policy sends before each chunk.
+	paddingHeaderLen = 1
+	// requestReservedPaddingPolicy asks the service to frame both directions with paddingHeaderLen.
+	requestReservedPaddingPolicy = 2
+)
+
+var ErrInvalidPaddingLength = newCategoryError(ErrBadLengthChunk, "invalid padding length")
+
+// PaddingPolicy must be set on both sides, and must return less than MaxPaddingSize.
+// Clients announce it in the request header, so a service with a policy still serves stock clients.
+type PaddingPolicy interface {
+	PaddingLength(hashCode uint16, chunkLength int) uint16
+}
+
+type PaddingPolicyFunc func(hashCode uint16, chunkLength int) uint16
+
+func (f PaddingPolicyFunc) PaddingLength(hashCode uint16, chunkLength int) uint16 {
+	return f(hashCode, chunkLength)
+}
+
+func policyPaddingLength(policy PaddingPolicy, hashCode uint16, chunkLength int) (uint16, error) {
+	paddingLen := policy.PaddingLength(hashCode, chunkLength)
+	if paddingLen >= MaxPaddingSize {
+		return 0, E.Extend(ErrInvalidPaddingLength, "padding=", paddingLen, ", max=", MaxPaddingSize-1)
+	}
+	return paddingLen, nil
+}
+
+func setPaddingPolicy(chain any, policy PaddingPolicy) {
+	if policy == nil {
+		return
+	}
+	walkUpstream(chain, func(layer any) bool {
+		switch layer := layer.(type) {
+		case *StreamChunkReader:
+			layer.paddingPolicy = policy
+		case *StreamChunkWriter:
+			layer.paddingPolicy = policy
+		case *AEADChunkReader:
+			layer.paddingPolicy = policy
+		case *AEADChunkWriter:
+			layer.paddingPolicy = policy
+		case *statsReader, *statsWriter:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,98 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const testPaddingAlign = 16
+
+func alignedPadding(hashCode uint16, chunkLength int) uint16 {
+	return uint16((testPaddingAlign - (2+paddingHeaderLen+chunkLength)%testPaddingAlign) % testPaddingAlign)
+}
+
+func newTestPaddingCodec(policy PaddingPolicy) *ChunkCodec {
+	shake := sha3.NewShake128()
+	common.Must1(shake.Write([]byte("padding")))
+	codec := NewChunkCodec(nil, shake)
+	codec.SetPaddingPolicy(policy)
+	return codec
+}
+
+func TestPaddingPolicy(t *testing.T) {
+	encoder := newTestPaddingCodec(PaddingPolicyFunc(alignedPadding))
+	decoder := newTestPaddingCodec(PaddingPolicyFunc(alignedPadding))
+	for dataLen := 1; dataLen < 100; dataLen++ {
+		payload := bytes.Repeat([]byte{byte(dataLen)}, dataLen)
+		buffer := buf.NewSize(encoder.FrontHeadroom() + dataLen + encoder.RearHeadroom())
+		buffer.Resize(encoder.FrontHeadroom(), 0)
+		common.Must1(buffer.Write(payload))
+		err := encoder.Frame(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffer.Len()%testPaddingAlign != 0 {
+			t.Fatal("chunk of ", dataLen, " bytes framed to ", buffer.Len(), " bytes")
+		}
+		err = decoder.Unframe(buffer)
+		if err != nil {
+			t.Fatal(dataLen, ": ", err)
+		}
+		if !bytes.Equal(buffer.Bytes(), payload) {
+			t.Fatal(dataLen, ": payload mismatch")
+		}
+		buffer.Release()
+	}
+
+	invalid := newTestPaddingCodec(PaddingPolicyFunc(func(hashCode uint16, chunkLength int) uint16 {
+		return MaxPaddingSize
+	}))
+	buffer := buf.NewSize(invalid.FrontHeadroom() + 1 + invalid.RearHeadroom())
+	defer buffer.Release()
+	buffer.Resize(invalid.FrontHeadroom(), 0)
+	common.Must(buffer.WriteByte(0))
+	err := invalid.Frame(buffer)
+	if !errors.Is(err, ErrInvalidPaddingLength) {
+		t.Fatal("padding of MaxPaddingSize accepted: ", err)
+	}
+}
+
+func TestPaddingPolicyConn(t *testing.T) {
+	policy := PaddingPolicyFunc(alignedPadding)
+	service := newTestService(t, &echoHandler{}, ServiceWithPaddingPolicy(policy))
+	payload := bytes.Repeat([]byte("vmess"), 8192)
+	for _, test := range []struct {
+		name    string
+		options []ClientOption
+	}{
+		{"masked length", []ClientOption{ClientWithPaddingPolicy(policy)}},
+		{"authenticated length", []ClientOption{ClientWithAuthenticatedLength(), ClientWithPaddingPolicy(policy)}},
+		{"stock masked length", nil},
+		{"stock authenticated length", []ClientOption{ClientWithAuthenticatedLength()}},
+	} {
+		client := newTestClient(t, testUserID, append(test.options, ClientWithGlobalPadding())...)
+		upstream, _ := serveTestConn(service)
+		conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		go conn.Write(payload)
+		received := make([]byte, len(payload))
+		_, err = io.ReadFull(conn, received)
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal(test.name, ": payload mismatch")
+		}
+		conn.Close()
+	}
+}
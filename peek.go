@@ -0,0 +1,37 @@
+package vmess
+
+import "github.com/sagernet/sing/common/buf"
+
+// PeekPayload returns the early data sent with the request header, valid until the next read.
+func (c *serverConn) PeekPayload() ([]byte, error) {
+	if c.payload != nil {
+		return c.payload.Bytes(), nil
+	}
+	if !c.earlyData || c.command != CommandTCP {
+		return nil, nil
+	}
+	c.earlyData = false
+	payload := buf.New()
+	err := c.reader.ReadBuffer(payload)
+	if err != nil {
+		payload.Release()
+		return nil, err
+	}
+	if payload.IsEmpty() {
+		payload.Release()
+		return nil, nil
+	}
+	c.payload = payload
+	return payload.Bytes(), nil
+}
+
+func (c *serverConn) releasePayload() {
+	if c.payload.IsEmpty() {
+		c.payload.Release()
+		c.payload = nil
+	}
+}
+
+func (c *serverConn) ReaderReplaceable() bool {
+	return c.payload == nil && c.rawServerConn.ReaderReplaceable()
+}
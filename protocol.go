@@ -4,6 +4,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"hash/crc32"
 	"io"
@@ -15,10 +17,13 @@ import (
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
 
 	"github.com/gofrs/uuid/v5"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/sys/cpu"
 )
 
 const (
@@ -27,6 +32,7 @@ const (
 	WriteChunkSize       = 15000
 	CacheDurationSeconds = 120
 	MaxPaddingSize       = 64
+	MaxChunkSize         = 65535 - MaxPaddingSize
 	MaxFrontHeadroom     = 2 + CipherOverhead
 	MaxRearHeadroom      = CipherOverhead*2 + MaxPaddingSize
 )
@@ -52,6 +58,8 @@ const (
 	RequestOptionChunkMasking        = 4
 	RequestOptionGlobalPadding       = 8
 	RequestOptionAuthenticatedLength = 16
+	RequestOptionRekey               = 32
+	RequestOptionCompression         = 64
 )
 
 // nonce in java called iv
@@ -67,6 +75,7 @@ const (
 	KDFSaltConstVMessHeaderPayloadAEADIV        = "VMess Header AEAD Nonce"
 	KDFSaltConstVMessHeaderPayloadLengthAEADKey = "VMess Header AEAD Key_Length"
 	KDFSaltConstVMessHeaderPayloadLengthAEADIV  = "VMess Header AEAD Nonce_Length"
+	KDFSaltConstVMessPayloadRekey               = "VMess Payload Rekey"
 )
 
 const (
@@ -91,6 +100,8 @@ var MuxDestination = M.Socksaddr{
 
 type TimeFunc = func() time.Time
 
+type ReplayFilter = replay.Filter
+
 var (
 	ErrUnsupportedSecurityType = E.New("vmess: unsupported security type")
 	ErrInvalidChecksum         = E.New("vmess: invalid chunk checksum")
@@ -126,16 +137,40 @@ func AlterId(user uuid.UUID) uuid.UUID {
 }
 
 func AuthID(key [16]byte, time time.Time, buffer *buf.Buffer) {
-	common.Must(binary.Write(buffer, binary.BigEndian, time.Unix()))
-	buffer.WriteRandom(4)
-	common.Must(binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes())))
+	authID(newAuthIDCipher(key), time, rand.Reader, buffer)
+}
+
+func newAuthIDCipher(key [16]byte) cipher.Block {
 	aesBlock, err := aes.NewCipher(KDF(key[:], KDFSaltConstAuthIDEncryptionKey)[:16])
 	common.Must(err)
+	return aesBlock
+}
+
+func authID(aesBlock cipher.Block, time time.Time, random io.Reader, buffer *buf.Buffer) {
+	common.Must(binary.Write(buffer, binary.BigEndian, time.Unix()))
+	common.Must1(buffer.ReadFullFrom(random, 4))
+	common.Must(binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes())))
 	aesBlock.Encrypt(buffer.Bytes(), buffer.Bytes())
 }
 
+func checkAuthID(decodedId *[16]byte) int {
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(decodedId[:12]))
+	return subtle.ConstantTimeCompare(checksum[:], decodedId[12:])
+}
+
+var (
+	hasGCMAsmAMD64 = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	hasGCMAsmARM64 = cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	hasGCMAsmS390X = cpu.S390X.HasAES && cpu.S390X.HasAESCBC && cpu.S390X.HasAESCTR && (cpu.S390X.HasGHASH || cpu.S390X.HasAESGCM)
+
+	hasAESGCMHardwareSupport = runtime.GOARCH == "amd64" && hasGCMAsmAMD64 ||
+		runtime.GOARCH == "arm64" && hasGCMAsmARM64 ||
+		runtime.GOARCH == "s390x" && hasGCMAsmS390X
+)
+
 func AutoSecurityType() byte {
-	if runtime.GOARCH == "amd64" || runtime.GOARCH == "s390x" || runtime.GOARCH == "arm64" {
+	if hasAESGCMHardwareSupport {
 		return SecurityTypeAes128Gcm
 	}
 	return SecurityTypeChacha20Poly1305
@@ -150,8 +185,41 @@ func GenerateChacha20Poly1305Key(b []byte) []byte {
 	return key
 }
 
-func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte) io.Reader {
+func ZeroSecurityOption(option byte) byte {
+	return option &^ (RequestOptionChunkStream | RequestOptionChunkMasking)
+}
+
+func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte, options ...ReaderOption) io.Reader {
+	var readerOptions readerOptions
+	for _, readerOption := range options {
+		readerOption(&readerOptions)
+	}
+	var reader io.Reader
+	if security == SecurityTypeAes256Gcm {
+		reader = createAes256GcmReader(upstream, readerOptions.commandKey, requestKey, requestNonce, key, nonce, option)
+	} else {
+		reader = createReader(upstream, streamReader, requestKey, requestNonce, key, nonce, security, option)
+	}
+	setFaultInjector(reader, readerOptions.faultInjector)
+	if readerOptions.nonceLimit {
+		setNonceLimit(reader)
+	}
+	if readerOptions.rekeyShift > 0 {
+		setRekeyShift(reader, readerOptions.rekeyShift)
+	}
+	if readerOptions.uniformChunkSize > 0 && hasChunkStream(security, option) {
+		reader = newUniformChunkReader(reader, readerOptions.uniformChunkSize)
+	}
+	if option&RequestOptionCompression != 0 {
+		reader = newCompressReader(reader)
+	}
+	return reader
+}
+
+func createReader(upstream io.Reader, streamReader io.Reader, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte) io.Reader {
 	switch security {
+	case SecurityTypeZero:
+		return createReader(upstream, streamReader, requestKey, requestNonce, key, nonce, SecurityTypeNone, ZeroSecurityOption(option))
 	case SecurityTypeNone:
 		var reader io.Reader
 		if option&RequestOptionChunkStream != 0 {
@@ -161,7 +229,7 @@ func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte,
 				common.Must1(globalPadding.Write(nonce))
 			}
 			if option&RequestOptionAuthenticatedLength != 0 {
-				reader = NewAes128GcmChunkReader(upstream, requestKey, requestNonce, globalPadding)
+				reader = newAuthenticatedLengthReader(upstream, newAesGcm, newAes128GcmRekey, requestKey, requestNonce, globalPadding, option)
 			} else {
 				var chunkMasking sha3.ShakeHash
 				if option&RequestOptionChunkMasking != 0 {
@@ -210,7 +278,7 @@ func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte,
 			common.Must1(globalPadding.Write(nonce))
 		}
 		if option&RequestOptionAuthenticatedLength != 0 {
-			chunkReader = NewAes128GcmChunkReader(upstream, requestKey, requestNonce, globalPadding)
+			chunkReader = newAuthenticatedLengthReader(upstream, newAesGcm, newAes128GcmRekey, requestKey, requestNonce, globalPadding, option)
 		} else {
 			var chunkMasking sha3.ShakeHash
 			if option&RequestOptionChunkMasking != 0 {
@@ -223,7 +291,11 @@ func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte,
 			}
 			chunkReader = NewStreamChunkReader(upstream, chunkMasking, globalPadding)
 		}
-		return NewAes128GcmReader(chunkReader, key, nonce)
+		reader := NewAEADReader(chunkReader, newAesGcm(key), nonce)
+		if option&RequestOptionRekey != 0 {
+			reader.rekey = newAes128GcmRekey(key)
+		}
+		return reader
 	case SecurityTypeChacha20Poly1305:
 		var chunkReader io.Reader
 		var globalPadding sha3.ShakeHash
@@ -232,7 +304,7 @@ func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte,
 			common.Must1(globalPadding.Write(nonce))
 		}
 		if option&RequestOptionAuthenticatedLength != 0 {
-			chunkReader = NewChacha20Poly1305ChunkReader(upstream, requestKey, requestNonce, globalPadding)
+			chunkReader = newAuthenticatedLengthReader(upstream, newChacha20Poly1305FromKey, newChacha20Poly1305Rekey, requestKey, requestNonce, globalPadding, option)
 		} else {
 			var chunkMasking sha3.ShakeHash
 			if option&RequestOptionChunkMasking != 0 {
@@ -245,14 +317,49 @@ func CreateReader(upstream io.Reader, streamReader io.Reader, requestKey []byte,
 			}
 			chunkReader = NewStreamChunkReader(upstream, chunkMasking, globalPadding)
 		}
-		return NewChacha20Poly1305Reader(chunkReader, key, nonce)
+		reader := NewAEADReader(chunkReader, newChacha20Poly1305FromKey(key), nonce)
+		if option&RequestOptionRekey != 0 {
+			reader.rekey = newChacha20Poly1305Rekey(key)
+		}
+		return reader
 	default:
-		panic("unexpected security type")
+		factory := loadSecurity(security)
+		if factory == nil {
+			panic("unexpected security type")
+		}
+		return createRegisteredReader(upstream, factory, requestKey, requestNonce, key, nonce, option)
+	}
+}
+
+func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte, options ...WriterOption) io.Writer {
+	writerOptions := newWriterOptions(options)
+	var writer io.Writer
+	if security == SecurityTypeAes256Gcm {
+		writer = createAes256GcmWriter(upstream, writerOptions.commandKey, requestKey, requestNonce, key, nonce, option)
+	} else {
+		writer = createWriter(upstream, streamWriter, requestKey, requestNonce, key, nonce, security, option)
+	}
+	setFaultInjector(writer, writerOptions.faultInjector)
+	if writerOptions.nonceLimit {
+		setNonceLimit(writer)
+	}
+	if writerOptions.rekeyShift > 0 {
+		setRekeyShift(writer, writerOptions.rekeyShift)
+	}
+	setWriteChunkSize(writer, writerOptions.chunkSize)
+	if writerOptions.uniformChunkSize > 0 && hasChunkStream(security, option) {
+		writer = newUniformChunkWriter(writer, writerOptions.uniformChunkSize)
 	}
+	if option&RequestOptionCompression != 0 {
+		writer = newCompressWriter(writer)
+	}
+	return writerOptions.apply(writer)
 }
 
-func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte) io.Writer {
+func createWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, security byte, option byte) io.Writer {
 	switch security {
+	case SecurityTypeZero:
+		return createWriter(upstream, streamWriter, requestKey, requestNonce, key, nonce, SecurityTypeNone, ZeroSecurityOption(option))
 	case SecurityTypeNone:
 		var writer io.Writer
 		if option&RequestOptionChunkStream != 0 {
@@ -262,7 +369,7 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 				common.Must1(globalPadding.Write(nonce))
 			}
 			if option&RequestOptionAuthenticatedLength != 0 {
-				writer = NewAes128GcmChunkWriter(upstream, requestKey, requestNonce, globalPadding)
+				writer = newAuthenticatedLengthWriter(upstream, newAesGcm, newAes128GcmRekey, requestKey, requestNonce, globalPadding, option)
 			} else {
 				var chunkMasking sha3.ShakeHash
 				if option&RequestOptionChunkMasking != 0 {
@@ -277,7 +384,7 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 			}
 		}
 		if writer != nil {
-			return writer
+			return newChunkSplitWriter(writer, WriteChunkSize)
 		} else {
 			return upstream
 		}
@@ -300,7 +407,7 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 					common.Must1(chunkMasking.Write(nonce))
 				}
 			}
-			return bufio.NewChunkWriter(NewStreamChecksumWriter(NewStreamChunkWriter(streamWriter, chunkMasking, globalPadding)), WriteChunkSize)
+			return newChunkSplitWriter(NewStreamChecksumWriter(NewStreamChunkWriter(streamWriter, chunkMasking, globalPadding)), WriteChunkSize)
 		}
 		return NewStreamWriter(upstream, key, nonce)
 	case SecurityTypeAes128Gcm:
@@ -311,7 +418,7 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 			common.Must1(globalPadding.Write(nonce))
 		}
 		if option&RequestOptionAuthenticatedLength != 0 {
-			writer = NewAes128GcmChunkWriter(upstream, requestKey, requestNonce, globalPadding)
+			writer = newAuthenticatedLengthWriter(upstream, newAesGcm, newAes128GcmRekey, requestKey, requestNonce, globalPadding, option)
 		} else {
 			var chunkMasking sha3.ShakeHash
 			if option&RequestOptionChunkMasking != 0 {
@@ -324,7 +431,11 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 			}
 			writer = NewStreamChunkWriter(upstream, chunkMasking, globalPadding)
 		}
-		return bufio.NewChunkWriter(NewAes128GcmWriter(writer, key, nonce), WriteChunkSize)
+		aeadWriter := NewAEADWriter(writer, newAesGcm(key), nonce)
+		if option&RequestOptionRekey != 0 {
+			aeadWriter.rekey = newAes128GcmRekey(key)
+		}
+		return newChunkSplitWriter(aeadWriter, WriteChunkSize)
 	case SecurityTypeChacha20Poly1305:
 		var chunkWriter io.Writer
 		var globalPadding sha3.ShakeHash
@@ -333,7 +444,7 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 			common.Must1(globalPadding.Write(nonce))
 		}
 		if option&RequestOptionAuthenticatedLength != 0 {
-			chunkWriter = NewChacha20Poly1305ChunkWriter(upstream, requestKey, requestNonce, globalPadding)
+			chunkWriter = newAuthenticatedLengthWriter(upstream, newChacha20Poly1305FromKey, newChacha20Poly1305Rekey, requestKey, requestNonce, globalPadding, option)
 		} else {
 			var chunkMasking sha3.ShakeHash
 			if option&RequestOptionChunkMasking != 0 {
@@ -346,12 +457,34 @@ func CreateWriter(upstream io.Writer, streamWriter io.Writer, requestKey []byte,
 			}
 			chunkWriter = NewStreamChunkWriter(upstream, chunkMasking, globalPadding)
 		}
-		return bufio.NewChunkWriter(NewChacha20Poly1305Writer(chunkWriter, key, nonce), WriteChunkSize)
+		aeadWriter := NewAEADWriter(chunkWriter, newChacha20Poly1305FromKey(key), nonce)
+		if option&RequestOptionRekey != 0 {
+			aeadWriter.rekey = newChacha20Poly1305Rekey(key)
+		}
+		return newChunkSplitWriter(aeadWriter, WriteChunkSize)
 	default:
-		panic("unexpected security type")
+		factory := loadSecurity(security)
+		if factory == nil {
+			panic("unexpected security type")
+		}
+		return createRegisteredWriter(upstream, factory, requestKey, requestNonce, key, nonce, option)
 	}
 }
 
+func writeEndOfStream(writer N.ExtendedWriter, option byte) error {
+	err := flushCoalescingWriter(writer)
+	if err != nil {
+		return err
+	}
+	if option&RequestOptionChunkStream == 0 {
+		return nil
+	}
+	if coalescingWriter, isCoalescing := writer.(*CoalescingWriter); isCoalescing {
+		writer = bufio.NewExtendedWriter(coalescingWriter.upstream)
+	}
+	return writer.WriteBuffer(headroomOf(writer).newBuffer(0))
+}
+
 func newAesGcm(key []byte) cipher.AEAD {
 	block, err := aes.NewCipher(key)
 	common.Must(err)
@@ -371,3 +504,7 @@ func newChacha20Poly1305(key []byte) cipher.AEAD {
 	common.Must(err)
 	return outCipher
 }
+
+func newChacha20Poly1305FromKey(key []byte) cipher.AEAD {
+	return newChacha20Poly1305(GenerateChacha20Poly1305Key(key))
+}
@@ -0,0 +1,253 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/rw"
+)
+
+func TestHalfClose(t *testing.T) {
+	payload := bytes.Repeat([]byte("vmess"), 8192)
+	for _, depth := range []int{0, 8} {
+		var options []ServiceOption
+		if depth > 0 {
+			options = append(options, ServiceWithPipelinedRead(depth))
+		}
+		service := newTestService(t, &echoHandler{}, options...)
+		upstream, done := serveTestConn(service)
+		conn, err := newTestClient(t, testUserID).DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn.Write(payload)
+			rw.CloseWrite(conn)
+		}()
+		received, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal("depth ", depth, ": ", err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("depth ", depth, ": echoed ", len(received), " of ", len(payload), " bytes")
+		}
+		conn.Close()
+		err = <-done
+		if err != nil {
+			t.Fatal("depth ", depth, ": ", err)
+		}
+	}
+}
+
+func TestAes256GcmWithoutCommandKey(t *testing.T) {
+	key := make([]byte, 16)
+	option := byte(RequestOptionChunkStream | RequestOptionAuthenticatedLength)
+	reader := CreateReader(bytes.NewReader(make([]byte, 64)), nil, key, key, key, key, SecurityTypeAes256Gcm, option)
+	_, err := reader.Read(make([]byte, 64))
+	if !errors.Is(err, ErrMissingCommandKey) {
+		t.Fatal("read: ", err)
+	}
+	writer := CreateWriter(io.Discard, nil, key, key, key, key, SecurityTypeAes256Gcm, option)
+	_, err = writer.Write([]byte("vmess"))
+	if !errors.Is(err, ErrMissingCommandKey) {
+		t.Fatal("write: ", err)
+	}
+}
+
+func TestNonceWrap(t *testing.T) {
+	key := make([]byte, 16)
+	const chunks = 65536 + 16
+	for _, option := range []byte{
+		RequestOptionChunkStream,
+		RequestOptionChunkStream | RequestOptionAuthenticatedLength,
+	} {
+		var stream bytes.Buffer
+		writer := CreateWriter(&stream, nil, key, key, key, key, SecurityTypeAes128Gcm, option)
+		payload := make([]byte, chunks)
+		for i := range payload {
+			payload[i] = byte(i)
+			_, err := writer.Write(payload[i : i+1])
+			if err != nil {
+				t.Fatal("option ", option, ": chunk ", i, ": ", err)
+			}
+		}
+		reader := CreateReader(&stream, nil, key, key, key, key, SecurityTypeAes128Gcm, option)
+		var received []byte
+		chunk := make([]byte, 4096)
+		for {
+			n, err := reader.Read(chunk)
+			received = append(received, chunk[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal("option ", option, ": ", err)
+			}
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("option ", option, ": received ", len(received), " of ", len(payload), " bytes")
+		}
+
+		writer = CreateWriter(io.Discard, nil, key, key, key, key, SecurityTypeAes128Gcm, option, WriterWithNonceLimit())
+		var err error
+		for i := 0; i < 65536; i++ {
+			_, err = writer.Write(payload[:1])
+			if err != nil {
+				t.Fatal("option ", option, ": limited chunk ", i, ": ", err)
+			}
+		}
+		_, err = writer.Write(payload[:1])
+		if !errors.Is(err, ErrNonceExhausted) {
+			t.Fatal("option ", option, ": unexpected error ", err)
+		}
+	}
+}
+
+func TestSecurityRoundTrip(t *testing.T) {
+	service := newTestService(t, &echoHandler{})
+	payload := make([]byte, 1<<20+WriteChunkSize/2)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	for _, security := range []string{"none", "zero", "aes-128-cfb", "aes-128-gcm", "chacha20-poly1305", "aes-256-gcm"} {
+		for _, masking := range []bool{false, true} {
+			for _, padding := range []bool{false, true} {
+				name := fmt.Sprint(security, " masking=", masking, " padding=", padding)
+				client, err := NewClient(testUserID, security, 0, ClientWithChunkMasking(masking), ClientWithGlobalPaddingEnabled(padding))
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				upstream, _ := serveTestConn(service)
+				conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				written := make(chan error, 1)
+				go func() {
+					_, err := conn.Write(payload)
+					written <- err
+				}()
+				received := make([]byte, len(payload))
+				_, err = io.ReadFull(conn, received)
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				err = <-written
+				if err != nil {
+					t.Fatal(name, ": write: ", err)
+				}
+				if !bytes.Equal(received, payload) {
+					t.Fatal(name, ": payload mismatch")
+				}
+				conn.Close()
+			}
+		}
+	}
+}
+
+func TestRekeyInterval(t *testing.T) {
+	key := make([]byte, 16)
+	for _, option := range []byte{
+		RequestOptionChunkStream | RequestOptionRekey,
+		RequestOptionChunkStream | RequestOptionAuthenticatedLength | RequestOptionRekey,
+	} {
+		var stream bytes.Buffer
+		writer := CreateWriter(&stream, nil, key, key, key, key, SecurityTypeAes128Gcm, option, WriterWithRekeyInterval(4))
+		for i := 0; i < 10; i++ {
+			_, err := writer.Write([]byte{byte(i)})
+			if err != nil {
+				t.Fatal("option ", option, ": ", err)
+			}
+		}
+		encrypted := stream.Bytes()
+
+		reader := CreateReader(bytes.NewReader(encrypted), nil, key, key, key, key, SecurityTypeAes128Gcm, option, ReaderWithRekeyInterval(4))
+		chunk := make([]byte, 64)
+		for i := 0; i < 10; i++ {
+			n, err := reader.Read(chunk)
+			if err != nil {
+				t.Fatal("option ", option, ": chunk ", i, ": ", err)
+			}
+			if n != 1 || chunk[0] != byte(i) {
+				t.Fatal("option ", option, ": chunk ", i, ": unexpected ", chunk[:n])
+			}
+		}
+
+		reader = CreateReader(bytes.NewReader(encrypted), nil, key, key, key, key, SecurityTypeAes128Gcm, option)
+		var err error
+		for i := 0; i < 4; i++ {
+			_, err = reader.Read(chunk)
+			if err != nil {
+				t.Fatal("option ", option, ": chunk ", i, " before rekey: ", err)
+			}
+		}
+		_, err = reader.Read(chunk)
+		var decryptErr *ErrChunkDecrypt
+		if !errors.As(err, &decryptErr) || decryptErr.Index != 4 {
+			t.Fatal("option ", option, ": expected decrypt failure at chunk 4, got ", err)
+		}
+	}
+}
+
+func TestRekeyIntervalConn(t *testing.T) {
+	service := newTestService(t, &echoHandler{})
+	payload := bytes.Repeat([]byte("vmess"), 1<<16)
+	for _, test := range []struct {
+		name    string
+		options []ClientOption
+	}{
+		{"masked length", nil},
+		{"authenticated length", []ClientOption{ClientWithAuthenticatedLength()}},
+	} {
+		client := newTestClient(t, testUserID, append(test.options, ClientWithRekeyInterval(2), ClientWithChunkSize(1024))...)
+		upstream, _ := serveTestConn(service)
+		conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		go conn.Write(payload)
+		received := make([]byte, len(payload))
+		_, err = io.ReadFull(conn, received)
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal(test.name, ": payload mismatch")
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkCreateConn(b *testing.B) {
+	requestKey := bytes.Repeat([]byte{1}, 16)
+	requestNonce := bytes.Repeat([]byte{2}, 16)
+	responseKey := bytes.Repeat([]byte{3}, 16)
+	responseNonce := bytes.Repeat([]byte{4}, 16)
+	option := byte(RequestOptionChunkStream | RequestOptionChunkMasking | RequestOptionAuthenticatedLength)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CreateReader(bytes.NewReader(nil), nil, requestKey, requestNonce, requestKey, requestNonce, SecurityTypeAes128Gcm, option)
+		CreateWriter(io.Discard, nil, requestKey, requestNonce, responseKey, responseNonce, SecurityTypeAes128Gcm, option)
+	}
+}
+
+func BenchmarkChunkWrite(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 16)
+	option := byte(RequestOptionChunkStream | RequestOptionChunkMasking | RequestOptionAuthenticatedLength)
+	writer := CreateWriter(io.Discard, nil, key, key, key, key, SecurityTypeAes128Gcm, option)
+	payload := make([]byte, WriteChunkSize)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := writer.Write(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package vmess
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type RateLimitedUserStore[U comparable] interface {
+	UserStore[U]
+	RateLimit(user U) (uploadBytesPerSecond uint64, downloadBytesPerSecond uint64)
+}
+
+type RateLimiter struct {
+	access sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns nil, meaning unlimited, for a zero rate.
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.access.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.access.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type rateLimitedReader struct {
+	upstream N.ExtendedReader
+	limiter  *RateLimiter
+}
+
+func newRateLimitedReader(upstream io.Reader, limiter *RateLimiter) *rateLimitedReader {
+	return &rateLimitedReader{bufio.NewExtendedReader(upstream), limiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.upstream.Read(p)
+	r.limiter.Wait(n)
+	return
+}
+
+func (r *rateLimitedReader) ReadBuffer(buffer *buf.Buffer) error {
+	err := r.upstream.ReadBuffer(buffer)
+	r.limiter.Wait(buffer.Len())
+	return err
+}
+
+func (r *rateLimitedReader) Upstream() any {
+	return r.upstream
+}
+
+type rateLimitedWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	limiter    *RateLimiter
+}
+
+func newRateLimitedWriter(upstream io.Writer, limiter *RateLimiter) *rateLimitedWriter {
+	return &rateLimitedWriter{bufio.NewExtendedWriter(upstream), bufio.NewVectorisedWriter(upstream), limiter}
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (n int, err error) {
+	w.limiter.Wait(len(p))
+	return w.upstream.Write(p)
+}
+
+func (w *rateLimitedWriter) WriteBuffer(buffer *buf.Buffer) error {
+	w.limiter.Wait(buffer.Len())
+	return w.upstream.WriteBuffer(buffer)
+}
+
+func (w *rateLimitedWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	w.limiter.Wait(buf.LenMulti(buffers))
+	return w.vectorised.WriteVectorised(buffers)
+}
+
+func (w *rateLimitedWriter) Upstream() any {
+	return w.upstream
+}
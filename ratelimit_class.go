@@ -0,0 +1,8 @@
+package vmess
+
+// RateLimitClassifier returns shared limiters for a session, applied on top of the user limits.
+type RateLimitClassifier[U comparable] func(session SessionInfo[U]) (upload *RateLimiter, download *RateLimiter)
+
+func (s *Service[U]) SetRateLimitClassifier(classifier RateLimitClassifier[U]) {
+	s.rateLimitClass = classifier
+}
@@ -0,0 +1,25 @@
+package vmess
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterZero(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	if limiter != nil {
+		t.Fatal("zero rate returned a limiter")
+	}
+	start := time.Now()
+	limiter.Wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("unlimited wait took ", elapsed)
+	}
+	limiter = NewRateLimiter(1000)
+	limiter.Wait(1000)
+	start = time.Now()
+	limiter.Wait(100)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("limited wait took ", elapsed)
+	}
+}
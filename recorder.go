@@ -0,0 +1,129 @@
+package vmess
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	RecordRequest  = "request"
+	RecordResponse = "response"
+	RecordRead     = "read"
+	RecordWrite    = "write"
+)
+
+type RecordedEvent struct {
+	Conn          uint64
+	Side          string
+	Event         string
+	Command       byte
+	Security      byte
+	Option        byte
+	Destination   string
+	Padding       int
+	Legacy        bool
+	CommandLength int
+	Index         uint64
+	Length        int
+}
+
+// Recorder writes the headers and chunk boundaries its conns see as JSON lines, without keys or payload.
+type Recorder struct {
+	access  sync.Mutex
+	encoder *json.Encoder
+	conns   uint64
+	err     error
+}
+
+func NewRecorder(writer io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(writer)}
+}
+
+func (r *Recorder) Err() error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	return r.err
+}
+
+func (r *Recorder) open(side string) *connRecording {
+	if r == nil {
+		return nil
+	}
+	return &connRecording{recorder: r, conn: atomic.AddUint64(&r.conns, 1), side: side}
+}
+
+func (r *Recorder) record(event RecordedEvent) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.err == nil {
+		r.err = r.encoder.Encode(event)
+	}
+}
+
+func ReadRecording(reader io.Reader) ([]RecordedEvent, error) {
+	decoder := json.NewDecoder(reader)
+	var events []RecordedEvent
+	for {
+		var event RecordedEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+type connRecording struct {
+	recorder   *Recorder
+	conn       uint64
+	side       string
+	readIndex  uint64
+	writeIndex uint64
+}
+
+func (s *connStats) recordRequest(command byte, security byte, option byte, destination M.Socksaddr, padding int, legacy bool) {
+	if s == nil || s.recording == nil {
+		return
+	}
+	event := s.recording.event(RecordRequest)
+	event.Command = command
+	event.Security = security
+	event.Option = option
+	if destination.IsValid() {
+		event.Destination = destination.String()
+	}
+	event.Padding = padding
+	event.Legacy = legacy
+	s.recording.recorder.record(event)
+}
+
+func (s *connStats) recordResponse(option byte, command byte, commandLen int, padding int) {
+	if s == nil || s.recording == nil {
+		return
+	}
+	event := s.recording.event(RecordResponse)
+	event.Option = option
+	event.Command = command
+	event.CommandLength = commandLen
+	event.Padding = padding
+	s.recording.recorder.record(event)
+}
+
+func (s *connStats) recordChunk(name string, index *uint64, dataLen int, paddingLen int) {
+	event := s.recording.event(name)
+	event.Index = atomic.AddUint64(index, 1) - 1
+	event.Length = dataLen
+	event.Padding = paddingLen
+	s.recording.recorder.record(event)
+}
+
+func (r *connRecording) event(name string) RecordedEvent {
+	return RecordedEvent{Conn: r.conn, Side: r.side, Event: name}
+}
@@ -0,0 +1,107 @@
+package vmess
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var _ ReplayFilter = (*BloomReplayFilter)(nil)
+
+// BloomReplayFilter rejects an auth id for at least one and at most two windows after it was first seen.
+type BloomReplayFilter struct {
+	access   sync.Mutex
+	window   time.Duration
+	hashes   int
+	bits     uint64
+	seed     [2]maphash.Seed
+	current  []uint64
+	previous []uint64
+	rotated  time.Time
+}
+
+func NewBloomReplayFilter(window time.Duration, capacity int, falsePositiveRate float64) (*BloomReplayFilter, error) {
+	if window <= 0 {
+		return nil, E.New("invalid replay window: ", window)
+	}
+	if capacity <= 0 {
+		return nil, E.New("invalid replay filter capacity: ", capacity)
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, E.New("invalid false positive rate: ", falsePositiveRate)
+	}
+	bits := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	words := (uint64(bits) + 63) / 64
+	return &BloomReplayFilter{
+		window:   window,
+		hashes:   hashes,
+		bits:     words * 64,
+		seed:     [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+		rotated:  time.Now(),
+	}, nil
+}
+
+func (f *BloomReplayFilter) Check(sum []byte) bool {
+	h1, h2 := f.hash(sum)
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.rotate(time.Now())
+	if f.contains(f.current, h1, h2) || f.contains(f.previous, h1, h2) {
+		return false
+	}
+	for i := 0; i < f.hashes; i++ {
+		index := (h1 + uint64(i)*h2) % f.bits
+		f.current[index/64] |= 1 << (index % 64)
+	}
+	return true
+}
+
+func (f *BloomReplayFilter) hash(sum []byte) (h1 uint64, h2 uint64) {
+	var hash maphash.Hash
+	hash.SetSeed(f.seed[0])
+	hash.Write(sum)
+	h1 = hash.Sum64()
+	hash.SetSeed(f.seed[1])
+	hash.Write(sum)
+	h2 = hash.Sum64() | 1
+	return
+}
+
+func (f *BloomReplayFilter) contains(filter []uint64, h1 uint64, h2 uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		index := (h1 + uint64(i)*h2) % f.bits
+		if filter[index/64]&(1<<(index%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomReplayFilter) rotate(now time.Time) {
+	elapsed := now.Sub(f.rotated)
+	if elapsed < f.window {
+		return
+	}
+	if elapsed >= 2*f.window {
+		clearBloom(f.previous)
+	} else {
+		f.previous, f.current = f.current, f.previous
+	}
+	clearBloom(f.current)
+	f.rotated = now
+}
+
+func clearBloom(filter []uint64) {
+	for i := range filter {
+		filter[i] = 0
+	}
+}
@@ -0,0 +1,23 @@
+package vmess
+
+import (
+	F "github.com/sagernet/sing/common/format"
+)
+
+// ErrRequiredOptions rejects a request lacking any option given to ServiceWithRequiredOptions.
+type ErrRequiredOptions struct {
+	Required byte
+	Option   byte
+}
+
+func (e *ErrRequiredOptions) Missing() byte {
+	return e.Required &^ e.Option
+}
+
+func (e *ErrRequiredOptions) Error() string {
+	return F.ToString("vmess: request options ", e.Option, " lack required options ", e.Missing())
+}
+
+func (e *ErrRequiredOptions) Unwrap() error {
+	return ErrAuthFailed
+}
@@ -0,0 +1,90 @@
+package vmess
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const ResponseCommandSwitchAccount = 1
+
+var ErrResponseCommandTooLarge = E.New("response command too large")
+
+// ResponseCommand is at most 255 bytes on the wire, including the FNV-1a checksum of the payload.
+type ResponseCommand struct {
+	Command byte
+	Payload []byte
+}
+
+type ResponseCommandHandler[U comparable] func(session SessionInfo[U]) *ResponseCommand
+
+type ResponseCommandCallback func(command ResponseCommand)
+
+func (c *ResponseCommand) encodedLen() int {
+	if c == nil || c.Command == 0 {
+		return 0
+	}
+	return 4 + len(c.Payload)
+}
+
+func (c *ResponseCommand) encode(response []byte) {
+	checksum := fnv.New32a()
+	common.Must1(checksum.Write(c.Payload))
+	checksum.Sum(response[:0])
+	copy(response[4:], c.Payload)
+}
+
+func parseResponseCommand(command byte, content []byte) (ResponseCommand, bool) {
+	if len(content) < 4 {
+		return ResponseCommand{}, false
+	}
+	checksum := fnv.New32a()
+	common.Must1(checksum.Write(content[4:]))
+	if checksum.Sum32() != binary.BigEndian.Uint32(content) {
+		return ResponseCommand{}, false
+	}
+	return ResponseCommand{command, content[4:]}, true
+}
+
+type SwitchAccountCommand struct {
+	Host         string
+	Port         uint16
+	ID           uuid.UUID
+	AlterID      uint16
+	Level        byte
+	ValidMinutes byte
+}
+
+func (c SwitchAccountCommand) ResponseCommand() (*ResponseCommand, error) {
+	if len(c.Host) > 255 {
+		return nil, E.Extend(ErrResponseCommandTooLarge, "host ", c.Host)
+	}
+	payload := make([]byte, 0, 1+len(c.Host)+2+16+2+2)
+	payload = append(payload, byte(len(c.Host)))
+	payload = append(payload, c.Host...)
+	payload = append(payload, byte(c.Port>>8), byte(c.Port))
+	payload = append(payload, c.ID[:]...)
+	payload = append(payload, byte(c.AlterID>>8), byte(c.AlterID), c.Level, c.ValidMinutes)
+	return &ResponseCommand{ResponseCommandSwitchAccount, payload}, nil
+}
+
+func ParseSwitchAccountCommand(payload []byte) (*SwitchAccountCommand, error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0])+2+16+2+2 {
+		return nil, E.New("bad switch account command")
+	}
+	hostLen := int(payload[0])
+	command := &SwitchAccountCommand{
+		Host: string(payload[1 : 1+hostLen]),
+	}
+	payload = payload[1+hostLen:]
+	command.Port = binary.BigEndian.Uint16(payload)
+	copy(command.ID[:], payload[2:18])
+	command.AlterID = binary.BigEndian.Uint16(payload[18:])
+	command.Level = payload[20]
+	command.ValidMinutes = payload[21]
+	return command, nil
+}
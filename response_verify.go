@@ -0,0 +1,33 @@
+package vmess
+
+import (
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrResponseRejected = E.New("vmess: response rejected")
+
+type ResponseHeader struct {
+	ResponseHeader         byte
+	Option                 byte
+	Command                byte
+	CommandLength          byte
+	ExpectedResponseHeader byte
+	RequestOption          byte
+}
+
+// ResponseVerifier sees each decrypted response header first, an error aborts the connection.
+type ResponseVerifier func(header ResponseHeader) error
+
+func (c *rawClientConn) verifyResponse(response []byte) error {
+	if c.responseVerifier == nil {
+		return nil
+	}
+	return wrapCategoryError(ErrResponseRejected, c.responseVerifier(ResponseHeader{
+		ResponseHeader:         response[0],
+		Option:                 response[1],
+		Command:                response[2],
+		CommandLength:          response[3],
+		ExpectedResponseHeader: c.responseHeader,
+		RequestOption:          c.option,
+	}), "verify response")
+}
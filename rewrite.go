@@ -0,0 +1,60 @@
+package vmess
+
+import (
+	"context"
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// RewriteHandler returns the destination to dial for a decoded request, an error rejects the connection.
+type RewriteHandler[U comparable] func(session SessionInfo[U]) (M.Socksaddr, error)
+
+func (s *Service[U]) SetRewriteHandler(handler RewriteHandler[U]) {
+	s.rewrite = handler
+}
+
+func (s *Service[U]) rewriteDestination(session SessionInfo[U]) (M.Socksaddr, error) {
+	destination, err := s.rewrite(session)
+	if err != nil {
+		return M.Socksaddr{}, E.Cause(err, "rewrite destination ", session.Destination)
+	}
+	if !destination.IsValid() {
+		return M.Socksaddr{}, E.New("rewrite destination ", session.Destination, ": invalid destination")
+	}
+	return destination, nil
+}
+
+type rewriteMuxHandler[U comparable] struct {
+	Handler
+	service *Service[U]
+	session SessionInfo[U]
+}
+
+func (h *rewriteMuxHandler[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	session := h.session
+	session.Command = CommandTCP
+	session.Destination = metadata.Destination
+	destination, err := h.service.rewriteDestination(session)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	metadata.Destination = destination
+	return h.Handler.NewConnection(ctx, conn, metadata)
+}
+
+func (h *rewriteMuxHandler[U]) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	session := h.session
+	session.Command = CommandUDP
+	session.Destination = metadata.Destination
+	destination, err := h.service.rewriteDestination(session)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	metadata.Destination = destination
+	return h.Handler.NewPacketConnection(ctx, conn, metadata)
+}
@@ -0,0 +1,60 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"io"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const (
+	SecurityTypeAes256Gcm = 15
+
+	KDFSaltConstVMessAes256GcmKey = "VMess AES-256-GCM Key"
+)
+
+var ErrMissingCommandKey = E.New("vmess: aes-256-gcm without command key")
+
+func ReaderWithCommandKey(commandKey []byte) ReaderOption {
+	return func(options *readerOptions) {
+		options.commandKey = commandKey
+	}
+}
+
+func WriterWithCommandKey(commandKey []byte) WriterOption {
+	return func(options *writerOptions) {
+		options.commandKey = commandKey
+	}
+}
+
+func newAes256GcmFactory(commandKey []byte) SecurityFactory {
+	return func(key []byte) cipher.AEAD {
+		return newAesGcm(KDF(commandKey, KDFSaltConstVMessAes256GcmKey, key))
+	}
+}
+
+func createAes256GcmReader(upstream io.Reader, commandKey []byte, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, option byte) io.Reader {
+	if len(commandKey) == 0 {
+		return failedReadWriter{ErrMissingCommandKey}
+	}
+	return createRegisteredReader(upstream, newAes256GcmFactory(commandKey), requestKey, requestNonce, key, nonce, option)
+}
+
+func createAes256GcmWriter(upstream io.Writer, commandKey []byte, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, option byte) io.Writer {
+	if len(commandKey) == 0 {
+		return failedReadWriter{ErrMissingCommandKey}
+	}
+	return createRegisteredWriter(upstream, newAes256GcmFactory(commandKey), requestKey, requestNonce, key, nonce, option)
+}
+
+type failedReadWriter struct {
+	err error
+}
+
+func (c failedReadWriter) Read(p []byte) (n int, err error) {
+	return 0, c.err
+}
+
+func (c failedReadWriter) Write(p []byte) (n int, err error) {
+	return 0, c.err
+}
@@ -0,0 +1,10 @@
+package vmess
+
+var ErrSecurityRejected = newCategoryError(ErrAuthFailed, "security type rejected")
+
+// SecurityPolicy decides per user whether to accept the security and options of an authenticated request.
+type SecurityPolicy[U comparable] func(user U, security byte, option byte) bool
+
+func (s *Service[U]) SetSecurityPolicy(policy SecurityPolicy[U]) {
+	s.securityPolicy = policy
+}
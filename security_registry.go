@@ -0,0 +1,112 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// SecurityFactory creates the AEAD for a 16-byte body or length key.
+// It must use a nonce of 2 to 16 bytes and add exactly CipherOverhead bytes per chunk.
+type SecurityFactory func(key []byte) cipher.AEAD
+
+var (
+	securityAccess    sync.RWMutex
+	securityFactories [16]SecurityFactory
+)
+
+// RegisterSecurity adds an AEAD body cipher under a free security id, both ends have to register it in init.
+func RegisterSecurity(id byte, factory SecurityFactory) {
+	if id <= SecurityTypeZero || id == SecurityTypeAes256Gcm || id >= byte(len(securityFactories)) {
+		panic("vmess: invalid security id " + strconv.Itoa(int(id)))
+	}
+	if factory == nil {
+		panic("vmess: nil security factory")
+	}
+	aead := factory(make([]byte, 16))
+	if nonceSize := aead.NonceSize(); nonceSize < 2 || nonceSize > 16 {
+		panic("vmess: security id " + strconv.Itoa(int(id)) + " has unsupported nonce size " + strconv.Itoa(nonceSize))
+	}
+	if overhead := aead.Overhead(); overhead != CipherOverhead {
+		panic("vmess: security id " + strconv.Itoa(int(id)) + " has unsupported overhead " + strconv.Itoa(overhead))
+	}
+	securityAccess.Lock()
+	defer securityAccess.Unlock()
+	if securityFactories[id] != nil {
+		panic("vmess: security id " + strconv.Itoa(int(id)) + " registered twice")
+	}
+	securityFactories[id] = factory
+}
+
+func (f SecurityFactory) newRekey(key []byte) *aeadRekey {
+	return &aeadRekey{key: key, newCipher: f}
+}
+
+func loadSecurity(id byte) SecurityFactory {
+	if id >= byte(len(securityFactories)) {
+		return nil
+	}
+	securityAccess.RLock()
+	defer securityAccess.RUnlock()
+	return securityFactories[id]
+}
+
+func isSupportedSecurity(security byte) bool {
+	switch security {
+	case SecurityTypeLegacy, SecurityTypeAes128Gcm, SecurityTypeChacha20Poly1305, SecurityTypeNone, SecurityTypeZero, SecurityTypeAes256Gcm:
+		return true
+	default:
+		return loadSecurity(security) != nil
+	}
+}
+
+func newChunkShakes(nonce []byte, option byte) (chunkMasking sha3.ShakeHash, globalPadding sha3.ShakeHash) {
+	if option&RequestOptionGlobalPadding != 0 {
+		globalPadding = sha3.NewShake128()
+		common.Must1(globalPadding.Write(nonce))
+	}
+	if option&RequestOptionChunkMasking != 0 {
+		if globalPadding != nil {
+			chunkMasking = globalPadding
+		} else {
+			chunkMasking = sha3.NewShake128()
+			common.Must1(chunkMasking.Write(nonce))
+		}
+	}
+	return
+}
+
+func createRegisteredReader(upstream io.Reader, factory SecurityFactory, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, option byte) io.Reader {
+	var chunkReader io.Reader
+	chunkMasking, globalPadding := newChunkShakes(nonce, option)
+	if option&RequestOptionAuthenticatedLength != 0 {
+		chunkReader = newAuthenticatedLengthReader(upstream, factory, factory.newRekey, requestKey, requestNonce, globalPadding, option)
+	} else {
+		chunkReader = NewStreamChunkReader(upstream, chunkMasking, globalPadding)
+	}
+	reader := NewAEADReader(chunkReader, factory(key), nonce)
+	if option&RequestOptionRekey != 0 {
+		reader.rekey = factory.newRekey(key)
+	}
+	return reader
+}
+
+func createRegisteredWriter(upstream io.Writer, factory SecurityFactory, requestKey []byte, requestNonce []byte, key []byte, nonce []byte, option byte) io.Writer {
+	var chunkWriter io.Writer
+	chunkMasking, globalPadding := newChunkShakes(nonce, option)
+	if option&RequestOptionAuthenticatedLength != 0 {
+		chunkWriter = newAuthenticatedLengthWriter(upstream, factory, factory.newRekey, requestKey, requestNonce, globalPadding, option)
+	} else {
+		chunkWriter = NewStreamChunkWriter(upstream, chunkMasking, globalPadding)
+	}
+	aeadWriter := NewAEADWriter(chunkWriter, factory(key), nonce)
+	if option&RequestOptionRekey != 0 {
+		aeadWriter.rekey = factory.newRekey(key)
+	}
+	return newChunkSplitWriter(aeadWriter, WriteChunkSize)
+}
@@ -0,0 +1,105 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"sync"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const testSecurityID = 7
+
+var registerTestSecurity sync.Once
+
+func testSecurity() byte {
+	registerTestSecurity.Do(func() {
+		RegisterSecurity(testSecurityID, newAesGcm)
+	})
+	return testSecurityID
+}
+
+type resizedAEAD struct {
+	cipher.AEAD
+	nonceSize int
+	overhead  int
+}
+
+func (a resizedAEAD) NonceSize() int {
+	return a.nonceSize
+}
+
+func (a resizedAEAD) Overhead() int {
+	return a.overhead
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Error(name, ": accepted")
+		}
+	}()
+	f()
+}
+
+func TestRegisterSecurityRejects(t *testing.T) {
+	id := testSecurity()
+	for _, reserved := range []byte{0, SecurityTypeLegacy, SecurityTypeAuto, SecurityTypeAes128Gcm, SecurityTypeChacha20Poly1305, SecurityTypeNone, SecurityTypeZero, SecurityTypeAes256Gcm, 16} {
+		expectPanic(t, "reserved id", func() {
+			RegisterSecurity(reserved, newAesGcm)
+		})
+	}
+	expectPanic(t, "duplicate id", func() {
+		RegisterSecurity(id, newAesGcm)
+	})
+	expectPanic(t, "nil factory", func() {
+		RegisterSecurity(8, nil)
+	})
+	expectPanic(t, "nonce size", func() {
+		RegisterSecurity(8, func(key []byte) cipher.AEAD {
+			return resizedAEAD{newAesGcm(key), 24, CipherOverhead}
+		})
+	})
+	expectPanic(t, "overhead", func() {
+		RegisterSecurity(8, func(key []byte) cipher.AEAD {
+			return resizedAEAD{newAesGcm(key), 12, 8}
+		})
+	})
+	if loadSecurity(8) != nil {
+		t.Fatal("rejected factory registered")
+	}
+}
+
+func TestRegisteredSecurity(t *testing.T) {
+	id := testSecurity()
+	service := newTestService(t, &echoHandler{})
+	payload := bytes.Repeat([]byte("vmess"), 8192)
+	for _, test := range []struct {
+		name    string
+		options []ClientOption
+	}{
+		{"masked length", nil},
+		{"authenticated length", []ClientOption{ClientWithAuthenticatedLength()}},
+		{"rekey", []ClientOption{ClientWithRekey()}},
+	} {
+		client := newTestClient(t, testUserID, append(test.options, ClientWithSecurity(id))...)
+		upstream, _ := serveTestConn(service)
+		conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		go conn.Write(payload)
+		received := make([]byte, len(payload))
+		_, err = io.ReadFull(conn, received)
+		if err != nil {
+			t.Fatal(test.name, ": ", err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal(test.name, ": payload mismatch")
+		}
+		conn.Close()
+	}
+}
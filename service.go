@@ -6,13 +6,17 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
-	"hash/crc32"
+	"hash/fnv"
 	"io"
-	"math"
 	"net"
+	"net/netip"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -38,87 +42,396 @@ type Handler interface {
 }
 
 var (
-	ErrBadHeader    = E.New("bad header")
-	ErrBadTimestamp = E.New("bad timestamp")
-	ErrReplay       = E.New("replayed request")
-	ErrBadRequest   = E.New("bad request")
-	ErrBadVersion   = E.New("bad version")
+	ErrBadHeader     = newCategoryError(ErrHeaderDecode, "bad header")
+	ErrBadTimestamp  = newCategoryError(ErrAuthFailed, "bad timestamp")
+	ErrReplay        = E.New("replayed request")
+	ErrBadRequest    = newCategoryError(ErrAuthFailed, "bad request")
+	ErrBadVersion    = newCategoryError(ErrHeaderDecode, "bad version")
+	ErrServiceClosed = E.New("vmess: service closed")
+
+	ErrLegacyHeaderWithKeys = E.New("vmess: legacy headers need user ids, not command keys")
 )
 
+type BadTimestampHandler = func(source M.Socksaddr, timestamp time.Time, drift time.Duration)
+
+// SessionInfo Timestamp and Drift are zero for requests resumed with a session ticket.
+type SessionInfo[U comparable] struct {
+	User           U
+	UserKey        [16]byte
+	Source         M.Socksaddr
+	Destination    M.Socksaddr
+	Command        byte
+	Security       byte
+	Option         byte
+	LegacyProtocol bool
+	Timestamp      time.Time
+	Drift          time.Duration
+	MuxVersion     int
+}
+
+type SessionHandler[U comparable] func(session SessionInfo[U])
+
+type UserStore[U comparable] interface {
+	Lookup(cmdKey [16]byte) (user U, loaded bool)
+}
+
 type userIdCipher[U comparable] struct {
-	userId U
-	cipher cipher.Block
+	userId     U
+	key        [16]byte
+	cipher     cipher.Block
+	securities []byte
+}
+
+// User is an entry of UpdateUserList, Securities restricts the accepted security types when not empty.
+type User[U comparable] struct {
+	User       U
+	UUID       string
+	AlterID    int
+	Securities []byte
+}
+
+func allowsSecurity(securities []byte, security byte) bool {
+	if len(securities) == 0 {
+		return true
+	}
+	for _, allowed := range securities {
+		if allowed == security {
+			return true
+		}
+	}
+	return false
+}
+
+type serviceUsers[U comparable] struct {
+	userIdCipher   []userIdCipher[U]
+	userIndexCache map[int]int64
+	cacheLock      sync.RWMutex
+	legacyAuth     *legacyAuthTable
+}
+
+func (u *serviceUsers[U]) cachedUser(authId []byte, decodedId *[16]byte) (index int, found bool) {
+	u.cacheLock.RLock()
+	defer u.cacheLock.RUnlock()
+	// every cached user is tried, so the time taken does not tell which one
+	// matched
+	var candidate [16]byte
+	matched := 0
+	for i := range u.userIndexCache {
+		valid := u.userIdCipher[i].check(authId, &candidate)
+		take := valid &^ matched
+		subtle.ConstantTimeCopy(take, decodedId[:], candidate[:])
+		index = subtle.ConstantTimeSelect(take, i, index)
+		matched |= valid
+	}
+	return index, matched == 1
+}
+
+func (u *serviceUsers[U]) uncachedUser(authId []byte, decodedId *[16]byte) (index int, found bool) {
+	u.cacheLock.RLock()
+	defer u.cacheLock.RUnlock()
+	if len(u.userIdCipher) >= parallelAuthSearchThreshold {
+		if workers := runtime.GOMAXPROCS(0); workers > 1 {
+			return u.parallelSearch(authId, decodedId, workers)
+		}
+	}
+	return u.searchRange(authId, decodedId, 0, len(u.userIdCipher), nil)
+}
+
+func (u *serviceUsers[U]) searchRange(authId []byte, decodedId *[16]byte, start int, end int, stop *int64) (index int, found bool) {
+	for i := start; i < end; i++ {
+		if _, cached := u.userIndexCache[i]; cached {
+			continue
+		}
+		if u.userIdCipher[i].decode(authId, decodedId) {
+			return i, true
+		}
+		if stop != nil && i&63 == 63 && atomic.LoadInt64(stop) >= 0 {
+			return
+		}
+	}
+	return
+}
+
+const (
+	parallelAuthSearchThreshold = 4096
+	parallelAuthSearchBatch     = 1024
+)
+
+func (u *serviceUsers[U]) parallelSearch(authId []byte, decodedId *[16]byte, workers int) (index int, found bool) {
+	userCount := len(u.userIdCipher)
+	if maxWorkers := (userCount + parallelAuthSearchBatch - 1) / parallelAuthSearchBatch; workers > maxWorkers {
+		workers = maxWorkers
+	}
+	var (
+		next    int64
+		matched int64 = -1
+		wg      sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			var localId [16]byte
+			for atomic.LoadInt64(&matched) < 0 {
+				start := int(atomic.AddInt64(&next, parallelAuthSearchBatch)) - parallelAuthSearchBatch
+				if start >= userCount {
+					return
+				}
+				end := start + parallelAuthSearchBatch
+				if end > userCount {
+					end = userCount
+				}
+				i, ok := u.searchRange(authId, &localId, start, end, &matched)
+				if ok {
+					if atomic.CompareAndSwapInt64(&matched, -1, int64(i)) {
+						*decodedId = localId
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if matched < 0 {
+		return
+	}
+	return int(matched), true
+}
+
+func (u *serviceUsers[U]) touchCache(index int) {
+	now := time.Now()
+	u.cacheLock.Lock()
+	if expire, loaded := u.userIndexCache[index]; !loaded || now.Add(8*time.Minute).Unix() > expire {
+		u.userIndexCache[index] = now.Add(30 * time.Minute).Unix()
+	}
+	u.cacheLock.Unlock()
+}
+
+func (u *serviceUsers[U]) clearCache() {
+	now := time.Now().Unix()
+	u.cacheLock.Lock()
+	for i, t := range u.userIndexCache {
+		if now > t {
+			delete(u.userIndexCache, i)
+		}
+	}
+	u.cacheLock.Unlock()
+}
+
+func (c *userIdCipher[U]) decode(authId []byte, decodedId *[16]byte) bool {
+	return c.check(authId, decodedId) == 1
+}
+
+func (c *userIdCipher[U]) check(authId []byte, decodedId *[16]byte) int {
+	c.cipher.Decrypt(decodedId[:], authId)
+	return checkAuthID(decodedId)
 }
 
 type Service[U comparable] struct {
-	userIndexCache       map[int]int64
-	cacheLock            sync.Mutex
-	userKey              map[U][16]byte
-	userIdCipher         []userIdCipher[U]
+	usersAccess          sync.RWMutex
+	users                *serviceUsers[U]
+	userStore            UserStore[U]
 	replayFilter         replay.Filter
 	handler              Handler
 	time                 func() time.Time
+	timeTolerance        time.Duration
+	badTimestampHandler  BadTimestampHandler
 	ticker               *time.Ticker
 	done                 chan struct{}
 	disableHeaderProtect bool
+	legacyHeader         bool
+	writeCoalescing      time.Duration
+	pipelinedRead        int
+	muxHandler           MuxHandler
+	chachaHeader         bool
+	paddingPolicy        PaddingPolicy
+	pacer                Pacer
+	sessionHandler       SessionHandler[U]
+	responseCommand      ResponseCommandHandler[U]
+	rewrite              RewriteHandler[U]
+	udpResolver          UDPResolver[U]
+	rateLimitClass       RateLimitClassifier[U]
+	securityPolicy       SecurityPolicy[U]
+	connAccess           sync.Mutex
+	conns                map[net.Conn]struct{}
+	closing              bool
+	drained              chan struct{}
+	udpTimeout           time.Duration
+	udpMaxSessions       int
+	udpSessions          *udpSessionTable[U]
+	logger               Logger
+	ticketLifetime       time.Duration
+	sessionTickets       *sessionTicketStore[U]
+	errorJitter          time.Duration
+	handshakeLimiter     *handshakeLimiter
+	uot                  bool
+	strictMode           bool
+	handshakeWorkers     *handshakeWorkers
+	metrics              Metrics
+	uniformChunkSize     int
+	writeAggregation     int
+	udpMultiplex         bool
+	requiredOptions      byte
+	recorder             *Recorder
+	faultInjector        FaultInjector
+	accessLog            *accessLog
+	handshakeObserver    HandshakeObserver
+	memory               *memoryAccountant
+	legacySessions       *legacySessionHistory
 }
 
 func NewService[U comparable](handler Handler, options ...ServiceOption) *Service[U] {
 	service := &Service[U]{
-		userIndexCache: map[int]int64{},
-		replayFilter:   replay.NewSimple(time.Second * 120),
-		handler:        handler,
-		time:           time.Now,
-		done:           make(chan struct{}),
+		users: &serviceUsers[U]{
+			userIndexCache: map[int]int64{},
+		},
+		handler:       handler,
+		time:          time.Now,
+		timeTolerance: CacheDurationSeconds * time.Second,
+		done:          make(chan struct{}),
 	}
 	anyService := (*Service[string])(unsafe.Pointer(service))
 	for _, option := range options {
 		option(anyService)
 	}
+	if service.replayFilter == nil {
+		service.replayFilter = replay.NewSimple(service.timeTolerance)
+	}
+	if service.metrics == nil {
+		service.metrics = NopMetrics{}
+	}
+	if service.udpTimeout > 0 || service.udpMaxSessions > 0 {
+		service.udpSessions = newUDPSessionTable[U](service.udpTimeout, service.udpMaxSessions)
+	}
+	if service.ticketLifetime > 0 {
+		service.sessionTickets = newSessionTicketStore[U](service.ticketLifetime)
+	}
+	if service.legacyHeader {
+		service.legacySessions = newLegacySessionHistory()
+	}
 	return service
 }
 
 func (s *Service[U]) UpdateUsers(userList []U, userIdList []string, alterIdList []int) error {
-	userKeyMap := make(map[U][16]byte)
+	users := make([]User[U], len(userList))
+	for i, user := range userList {
+		users[i] = User[U]{User: user, UUID: userIdList[i]}
+		if alterIdList != nil {
+			users[i].AlterID = alterIdList[i]
+		}
+	}
+	return s.UpdateUserList(users)
+}
+
+func (s *Service[U]) UpdateUserList(userList []User[U]) error {
 	userIdCiphers := make([]userIdCipher[U], len(userList))
-	userAlterIds := make(map[U][][16]byte)
+	var legacyUserIds [][][16]byte
+	if s.legacyHeader {
+		legacyUserIds = make([][][16]byte, len(userList))
+	}
 	for i, user := range userList {
-		userId := userIdList[i]
-		userUUID := uuid.FromStringOrNil(userId)
+		userUUID := uuid.FromStringOrNil(user.UUID)
 		if userUUID == uuid.Nil {
-			userUUID = uuid.NewV5(userUUID, userId)
+			userUUID = uuid.NewV5(userUUID, user.UUID)
 		}
 		userCmdKey := Key(userUUID)
-		userKeyMap[user] = userCmdKey
 		cp, err := aes.NewCipher(KDF(userCmdKey[:], KDFSaltConstAuthIDEncryptionKey)[:16])
 		if err != nil {
 			return err
 		}
 		userIdCiphers[i] = userIdCipher[U]{
-			userId: user,
-			cipher: cp,
+			userId:     user.User,
+			key:        userCmdKey,
+			cipher:     cp,
+			securities: user.Securities,
 		}
-		alterId := alterIdList[i]
-		if alterId > 0 {
-			alterIds := make([][16]byte, 0, alterId)
+		if s.legacyHeader {
+			legacyIds := make([][16]byte, 0, 1+user.AlterID)
+			legacyIds = append(legacyIds, userUUID)
 			currentId := userUUID
-			for j := 0; j < alterId; j++ {
+			for j := 0; j < user.AlterID; j++ {
 				currentId = AlterId(currentId)
-				alterIds = append(alterIds, currentId)
+				legacyIds = append(legacyIds, currentId)
 			}
-			userAlterIds[user] = alterIds
+			legacyUserIds[i] = legacyIds
 		}
 	}
-	s.userKey = userKeyMap
-	s.userIdCipher = userIdCiphers
-	s.cacheLock.Lock()
-	s.userIndexCache = map[int]int64{}
-	s.cacheLock.Unlock()
+	users := &serviceUsers[U]{
+		userIdCipher:   userIdCiphers,
+		userIndexCache: map[int]int64{},
+	}
+	if s.legacyHeader {
+		users.legacyAuth = newLegacyAuthTable(legacyUserIds)
+		users.legacyAuth.update(s.time(), s.timeTolerance)
+	}
+	s.usersAccess.Lock()
+	s.users = users
+	s.usersAccess.Unlock()
+	s.sessionTickets.clear()
 	return nil
 }
 
+func (s *Service[U]) UpdateUserKeys(userKeys [][16]byte) error {
+	return s.UpdateUsersWithKeys(make([]U, len(userKeys)), userKeys)
+}
+
+// UpdateUsersWithKeys fails with ErrLegacyHeaderWithKeys under ServiceWithLegacyHeader,
+// legacy auth hashes the user id and alter ids, which can not be derived from a command key.
+func (s *Service[U]) UpdateUsersWithKeys(userList []U, userKeyList [][16]byte) error {
+	if s.legacyHeader {
+		return ErrLegacyHeaderWithKeys
+	}
+	userIdCiphers := make([]userIdCipher[U], len(userList))
+	for i, user := range userList {
+		userKey := userKeyList[i]
+		cp, err := aes.NewCipher(KDF(userKey[:], KDFSaltConstAuthIDEncryptionKey)[:16])
+		if err != nil {
+			return err
+		}
+		userIdCiphers[i] = userIdCipher[U]{
+			userId: user,
+			key:    userKey,
+			cipher: cp,
+		}
+	}
+	users := &serviceUsers[U]{
+		userIdCipher:   userIdCiphers,
+		userIndexCache: map[int]int64{},
+	}
+	s.usersAccess.Lock()
+	s.users = users
+	s.usersAccess.Unlock()
+	s.sessionTickets.clear()
+	return nil
+}
+
+func (s *Service[U]) SetUserStore(store UserStore[U]) {
+	s.usersAccess.Lock()
+	s.userStore = store
+	s.usersAccess.Unlock()
+}
+
+func (s *Service[U]) SetSessionHandler(handler SessionHandler[U]) {
+	s.sessionHandler = handler
+}
+
+func (s *Service[U]) SetResponseCommandHandler(handler ResponseCommandHandler[U]) {
+	s.responseCommand = handler
+}
+
+func (s *Service[U]) loadUsers() (*serviceUsers[U], UserStore[U]) {
+	s.usersAccess.RLock()
+	defer s.usersAccess.RUnlock()
+	return s.users, s.userStore
+}
+
 func (s *Service[U]) Start() error {
 	s.ticker = time.NewTicker(time.Minute * 20)
+	go s.loopClearCache()
+	if s.legacyHeader {
+		go s.loopLegacyAuth()
+	}
+	s.handshakeWorkers.start(s.done)
 	return nil
 }
 
@@ -128,6 +441,52 @@ func (s *Service[U]) Close() error {
 	return nil
 }
 
+func (s *Service[U]) CloseContext(ctx context.Context) (interrupted int, err error) {
+	drained := make(chan struct{})
+	s.connAccess.Lock()
+	s.closing = true
+	if len(s.conns) == 0 {
+		close(drained)
+	} else {
+		s.drained = drained
+	}
+	s.connAccess.Unlock()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.connAccess.Lock()
+		interrupted = len(s.conns)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connAccess.Unlock()
+	}
+	return interrupted, s.Close()
+}
+
+func (s *Service[U]) trackConn(conn net.Conn) bool {
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Service[U]) untrackConn(conn net.Conn) {
+	s.connAccess.Lock()
+	defer s.connAccess.Unlock()
+	delete(s.conns, conn)
+	if len(s.conns) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
 func (s *Service[U]) loopClearCache() {
 	for {
 		select {
@@ -135,23 +494,63 @@ func (s *Service[U]) loopClearCache() {
 		case <-s.done:
 			return
 		}
-		for i, t := range s.userIndexCache {
-			if time.Now().Unix() > t {
-				s.cacheLock.Lock()
-				delete(s.userIndexCache, i)
-				s.cacheLock.Unlock()
-			}
-		}
+		users, _ := s.loadUsers()
+		users.clearCache()
 	}
 }
 
 func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	var handshaken bool
+	err := s.newConnection(ctx, conn, metadata, &handshaken)
+	if err != nil && !handshaken {
+		s.metrics.HandshakeFailed(handshakeFailureReason(err))
+	}
+	if err != nil && s.errorJitter > 0 && isProbeError(err) {
+		s.delayError()
+	}
+	return err
+}
+
+func (s *Service[U]) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, handshaken *bool) (err error) {
 	const headerLenBufferLen = 2 + CipherOverhead
 	const aeadMinHeaderLen = 16 + headerLenBufferLen + 8 + CipherOverhead + 42
+	const legacyMinHeaderLen = 16 + 38 + 4
+	if !s.trackConn(conn) {
+		conn.Close()
+		return ErrServiceClosed
+	}
+	defer s.untrackConn(conn)
+	s.metrics.ConnectionOpened()
+	defer s.metrics.ConnectionClosed()
+	releaseHandshake, acquired := s.handshakeLimiter.acquire(conn, metadata.Source)
+	if !acquired {
+		return ErrTooManyHandshakes
+	}
+	defer releaseHandshake()
+	handshake := newHandshakeMachine(ctx, &serverHandshakeTransitions, s.handshakeObserver)
+	defer func() {
+		if err != nil && handshake.State() != HandshakeStateRequestAccepted {
+			handshake.fail(err)
+		}
+	}()
+	err = handshake.transition(HandshakeStateAuthenticating)
+	if err != nil {
+		return err
+	}
+	handshakeStart := time.Now()
 	minHeaderLen := aeadMinHeaderLen
+	if s.legacyHeader {
+		minHeaderLen = legacyMinHeaderLen
+	}
 
 	requestBuffer := buf.New()
 	defer requestBuffer.Release()
+	requestStart := requestBuffer.Start()
+	defer func() {
+		if err != nil && !*handshaken {
+			err = newHandshakeRejected(err, requestBuffer.Slice()[requestStart:requestBuffer.Start()+requestBuffer.Len()])
+		}
+	}()
 
 	if !s.disableHeaderProtect {
 		n, err := requestBuffer.ReadOnceFrom(conn)
@@ -168,88 +567,124 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 		}
 	}
 
+	users, userStore := s.loadUsers()
 	authId := requestBuffer.To(16)
 	var decodedId [16]byte
-	var user U
+	var userIndex int
+	var ticket *serverSessionTicket[U]
 	var found bool
-	for i, t := range s.userIndexCache {
-		s.userIdCipher[i].cipher.Decrypt(decodedId[:], authId)
-		timestamp := int64(binary.BigEndian.Uint64(decodedId[:]))
-		checksum := binary.BigEndian.Uint32(decodedId[12:])
-		if crc32.ChecksumIEEE(decodedId[:12]) != checksum {
-			continue
-		}
-		if math.Abs(math.Abs(float64(timestamp))-float64(time.Now().Unix())) > 120 {
-			return ErrBadTimestamp
+	var legacyProtocol bool
+	var legacyTimestamp uint64
+	err = s.handshakeWorkers.run(s.done, func() error {
+		ticket, found = s.sessionTickets.take(authId, s.time())
+		if !found {
+			userIndex, found = users.cachedUser(authId, &decodedId)
 		}
-		if !s.replayFilter.Check(decodedId[:]) {
-			return ErrReplay
+		if !found {
+			userIndex, found = users.uncachedUser(authId, &decodedId)
 		}
-		user = s.userIdCipher[i].userId
-		found = true
-		if time.Now().Add(8*time.Minute).Unix() > t {
-			s.cacheLock.Lock()
-			s.userIndexCache[i] = time.Now().Add(30 * time.Minute).Unix()
-			s.cacheLock.Unlock()
+		if !found && users.legacyAuth != nil {
+			var entry legacyAuthEntry
+			entry, found = users.legacyAuth.lookup(authId, s.time(), s.timeTolerance)
+			if found {
+				legacyProtocol = true
+				legacyTimestamp = uint64(entry.timestamp)
+				userIndex = entry.userIndex
+			}
 		}
-		break
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	if !found {
-		for i, u := range s.userIdCipher {
-			if _, e := s.userIndexCache[i]; e {
-				continue
-			}
-			u.cipher.Decrypt(decodedId[:], authId)
-			timestamp := int64(binary.BigEndian.Uint64(decodedId[:]))
-			checksum := binary.BigEndian.Uint32(decodedId[12:])
-			if crc32.ChecksumIEEE(decodedId[:12]) != checksum {
-				continue
-			}
-			if math.Abs(math.Abs(float64(timestamp))-float64(time.Now().Unix())) > 120 {
-				return ErrBadTimestamp
-			}
-			if !s.replayFilter.Check(decodedId[:]) {
-				return ErrReplay
+		return ErrBadRequest
+	}
+	var timestamp time.Time
+	var drift time.Duration
+	if legacyProtocol {
+		timestamp = time.Unix(int64(legacyTimestamp), 0)
+		drift = s.time().Sub(timestamp)
+	}
+	if !legacyProtocol && ticket == nil {
+		timestamp = time.Unix(int64(binary.BigEndian.Uint64(decodedId[:])), 0)
+		drift = s.time().Sub(timestamp)
+		if drift > s.timeTolerance || drift < -s.timeTolerance {
+			if s.badTimestampHandler != nil {
+				s.badTimestampHandler(metadata.Source, timestamp, drift)
 			}
-			user = u.userId
-			found = true
-			s.cacheLock.Lock()
-			s.userIndexCache[i] = time.Now().Add(30 * time.Minute).Unix()
-			s.cacheLock.Unlock()
-			break
+			return E.Extend(ErrBadTimestamp, "drift ", drift)
 		}
+		if !s.replayFilter.Check(decodedId[:]) {
+			s.metrics.ReplayRejected()
+			return ErrReplay
+		}
+		users.touchCache(userIndex)
 	}
-	var legacyProtocol bool
-	var legacyTimestamp uint64
-	if !found {
-		return ErrBadRequest
+	var user U
+	var cmdKey [16]byte
+	var securities []byte
+	if ticket != nil {
+		user, cmdKey, securities = ticket.user, ticket.key, ticket.securities
+	} else {
+		user = users.userIdCipher[userIndex].userId
+		cmdKey = users.userIdCipher[userIndex].key
+		securities = users.userIdCipher[userIndex].securities
+	}
+	var uploadLimiter, downloadLimiter *RateLimiter
+	var allowedCommands CommandMask
+	if userStore != nil {
+		var loaded bool
+		user, loaded = userStore.Lookup(cmdKey)
+		if !loaded {
+			return ErrBadRequest
+		}
+		if limitedStore, isLimited := userStore.(RateLimitedUserStore[U]); isLimited {
+			uploadRate, downloadRate := limitedStore.RateLimit(user)
+			uploadLimiter = NewRateLimiter(uploadRate)
+			downloadLimiter = NewRateLimiter(downloadRate)
+		}
+		if restrictedStore, isRestricted := userStore.(CommandRestrictedUserStore[U]); isRestricted {
+			allowedCommands = restrictedStore.AllowedCommands(user)
+		}
 	}
 
+	err = handshake.transition(HandshakeStateReadingRequest)
+	if err != nil {
+		return err
+	}
 	ctx = auth.ContextWithUser(ctx, user)
-	cmdKey := s.userKey[user]
 	var headerReader io.Reader
 	var headerBuffer []byte
 
 	var reader io.Reader
-	var err error
+	var legacyBuffered *bytes.Reader
+	var legacyRetain *retainReader
 	if legacyProtocol {
 		requestBuffer.Advance(16)
-		reader = io.MultiReader(bytes.NewReader(requestBuffer.Bytes()), conn)
+		legacyBuffered = bytes.NewReader(requestBuffer.Bytes())
+		legacyRetain = &retainReader{buffer: requestBuffer, upstream: conn, retain: true}
+		reader = io.MultiReader(legacyBuffered, legacyRetain)
 
 		timeHash := md5.New()
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
 		common.Must(binary.Write(timeHash, binary.BigEndian, legacyTimestamp))
-		userKey := s.userKey[user]
-		headerReader = NewStreamReader(reader, userKey[:], timeHash.Sum(nil))
+		headerReader = NewStreamReader(reader, cmdKey[:], timeHash.Sum(nil))
 		headerBuffer, err = rw.ReadBytes(headerReader, 38)
 		if err != nil {
 			return E.Extend(ErrBadHeader, io.ErrShortBuffer)
 		}
 	} else {
 		if requestBuffer.Len() < aeadMinHeaderLen {
-			return ErrBadHeader
+			if !s.disableHeaderProtect {
+				return ErrBadHeader
+			}
+			_, err = requestBuffer.ReadAtLeastFrom(conn, aeadMinHeaderLen-requestBuffer.Len())
+			if err != nil {
+				return err
+			}
 		}
 
 		reader = conn
@@ -257,9 +692,29 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 		const nonceIndex = 16 + headerLenBufferLen
 		connectionNonce := requestBuffer.Range(nonceIndex, nonceIndex+8)
 
-		lengthKey := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)[:16]
-		lengthNonce := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
-		lengthBuffer, err := newAesGcm(lengthKey).Open(requestBuffer.Index(16), lengthNonce, requestBuffer.Range(16, nonceIndex), authId)
+		var headerCipher cipher.AEAD
+		var lengthBuffer []byte
+		err = s.handshakeWorkers.run(s.done, func() error {
+			var err error
+			if ticket != nil {
+				headerCipher = newAesGcm(ticket.secret[:])
+				lengthBuffer, err = headerCipher.Open(nil, sessionTicketNonce(connectionNonce, 0), requestBuffer.Range(16, nonceIndex), authId)
+				if err != nil {
+					return wrapCategoryError(ErrHeaderDecode, err, "open ticket header length")
+				}
+				return nil
+			}
+			lengthKey := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadLengthAEADKey, authId, connectionNonce)
+			lengthNonce := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadLengthAEADIV, authId, connectionNonce)[:12]
+			var chachaHeader bool
+			lengthBuffer, chachaHeader, err = openHeaderLength(lengthKey, lengthNonce, requestBuffer.Range(16, nonceIndex), authId, s.chachaHeader)
+			if err != nil {
+				return err
+			}
+			headerKey := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)
+			headerCipher = newHeaderAEAD(headerKey, chachaHeader)
+			return nil
+		})
 		if err != nil {
 			return err
 		}
@@ -274,9 +729,18 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 			}
 		}
 
-		headerKey := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadAEADKey, authId, connectionNonce)[:16]
-		headerNonce := KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
-		headerBuffer, err = newAesGcm(headerKey).Open(requestBuffer.Index(headerIndex), headerNonce, requestBuffer.Range(headerIndex, headerIndex+headerLength+CipherOverhead), authId)
+		err = s.handshakeWorkers.run(s.done, func() error {
+			var err error
+			var headerNonce []byte
+			if ticket != nil {
+				headerNonce = sessionTicketNonce(connectionNonce, 1)
+			} else {
+				headerNonce = KDF(cmdKey[:], KDFSaltConstVMessHeaderPayloadAEADIV, authId, connectionNonce)[:12]
+			}
+			// opened outside the request range, which is kept for a rejection
+			headerBuffer, err = headerCipher.Open(requestBuffer.FreeBytes()[:0], headerNonce, requestBuffer.Range(headerIndex, headerIndex+headerLength+CipherOverhead), authId)
+			return wrapCategoryError(ErrHeaderDecode, err, "open header")
+		})
 		if err != nil {
 			return err
 		}
@@ -288,6 +752,11 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 		headerReader = bytes.NewReader(headerBuffer[38:])
 	}
 
+	headerSource := headerReader
+	headerHash := fnv.New32a()
+	common.Must1(headerHash.Write(headerBuffer[:38]))
+	headerReader = io.TeeReader(headerSource, headerHash)
+
 	version := headerBuffer[0]
 	if version != Version {
 		return E.Extend(ErrBadVersion, version)
@@ -303,19 +772,34 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 	option := headerBuffer[34]
 	paddingLen := int(headerBuffer[35] >> 4)
 	security := headerBuffer[35] & 0x0F
+	reserved := headerBuffer[36]
 	command := headerBuffer[37]
 	switch command {
 	case CommandTCP, CommandUDP, CommandMux:
 	default:
-		return E.New("unknown command: ", command)
+		return E.Extend(ErrBadHeader, "unknown command: ", command)
+	}
+	if !isSupportedSecurity(security) {
+		return E.Extend(ErrBadHeader, "unsupported security: ", security)
+	}
+	if security == SecurityTypeZero {
+		security = SecurityTypeNone
+		option = ZeroSecurityOption(option)
 	}
 	if command == CommandUDP && option == 0 {
-		return E.New("bad packet connection")
+		return E.Extend(ErrBadHeader, "bad packet connection")
+	}
+	var paddingPolicy PaddingPolicy
+	if reserved&requestReservedPaddingPolicy != 0 {
+		if s.paddingPolicy == nil {
+			return E.Extend(ErrBadHeader, "padding policy not configured")
+		}
+		paddingPolicy = s.paddingPolicy
 	}
 	if command != CommandMux {
 		metadata.Destination, err = AddressSerializer.ReadAddrPort(headerReader)
 		if err != nil {
-			return err
+			return wrapCategoryError(ErrHeaderDecode, err, "read destination")
 		}
 	}
 	if paddingLen > 0 {
@@ -324,64 +808,331 @@ func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata
 			return E.Extend(ErrBadHeader, "bad padding")
 		}
 	}
-	err = rw.SkipN(headerReader, 4)
+	var checksum [4]byte
+	_, err = io.ReadFull(headerSource, checksum[:])
 	if err != nil {
+		return E.Extend(ErrBadHeader, "bad checksum")
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != headerHash.Sum32() {
+		return ErrBadChecksum
+	}
+	if legacyProtocol {
+		sessionId := legacySessionID{user: cmdKey}
+		copy(sessionId.key[:], requestBodyKey)
+		copy(sessionId.nonce[:], requestBodyNonce)
+		if !s.legacySessions.add(sessionId, s.time(), timestamp.Add(s.timeTolerance)) {
+			s.metrics.ReplayRejected()
+			return ErrReplay
+		}
+	}
+	err = handshake.transition(HandshakeStateValidatingRequest)
+	if err != nil {
+		return err
+	}
+	var muxVersion int
+	if command == CommandMux {
+		muxVersion = MuxCoolVersion
+	} else if command == CommandTCP && IsMuxCoolDestination(metadata.Destination) {
+		muxVersion, err = parseMuxCoolDestination(metadata.Destination)
+		if err != nil {
+			return err
+		}
+		command = CommandMux
+		metadata.Destination = M.Socksaddr{}
+	}
+	if !allowsSecurity(securities, security) || s.securityPolicy != nil && !s.securityPolicy(user, security, option) {
+		return E.Extend(ErrSecurityRejected, "security=", security, " option=", option)
+	}
+	if !allowedCommands.Allows(command) {
+		if s.logger != nil {
+			s.logger.WarnContext(ctx, "vmess: rejected command ", command, " for user ", user)
+		}
+		return E.Extend(ErrCommandRejected, "command=", command)
+	}
+	if s.strictMode {
+		violation := strictModeViolation(security, option)
+		if violation != "" {
+			if s.logger != nil {
+				s.logger.WarnContext(ctx, "vmess: strict mode rejected user ", user, ": ", violation)
+			}
+			return E.Extend(ErrStrictMode, violation)
+		}
+	}
+	if option&s.requiredOptions != s.requiredOptions {
+		err = &ErrRequiredOptions{s.requiredOptions, option}
+		if s.logger != nil {
+			s.logger.WarnContext(ctx, "vmess: rejected user ", user, ": ", err)
+		}
 		return err
 	}
-	if !legacyProtocol && requestBuffer.Len() > 0 {
+	var earlyLen int
+	if legacyProtocol {
+		legacyRetain.retain = false
+		earlyLen = legacyBuffered.Len()
+	} else if requestBuffer.Len() > 0 {
+		earlyLen = requestBuffer.Len()
 		reader = bufio.NewCachedReader(reader, requestBuffer)
 	}
-	reader = CreateReader(reader, nil, requestBodyKey, requestBodyNonce, requestBodyKey, requestBodyNonce, security, option)
+	if uploadLimiter != nil {
+		reader = newRateLimitedReader(reader, uploadLimiter)
+	}
+	var session SessionInfo[U]
+	if s.sessionHandler != nil || s.responseCommand != nil || s.rewrite != nil || s.udpResolver != nil || s.rateLimitClass != nil {
+		session = SessionInfo[U]{
+			User:           user,
+			UserKey:        cmdKey,
+			Source:         metadata.Source,
+			Destination:    metadata.Destination,
+			Command:        command,
+			Security:       security,
+			Option:         option,
+			LegacyProtocol: legacyProtocol,
+			Timestamp:      timestamp,
+			Drift:          drift,
+			MuxVersion:     muxVersion,
+		}
+		if command == CommandMux {
+			session.Destination = MuxDestination
+		}
+	}
+	var classUpload, classDownload *RateLimiter
+	if s.rateLimitClass != nil {
+		classUpload, classDownload = s.rateLimitClass(session)
+		if classUpload != nil {
+			reader = newRateLimitedReader(reader, classUpload)
+		}
+	}
+	stats := &connStats{logger: s.logger, ctx: ctx, metrics: s.metrics, recording: s.recorder.open("server")}
+	stats.trace("vmess: read request command=", command, " security=", security, " option=", option, " destination=", metadata.Destination, " padding=", paddingLen, " legacy=", legacyProtocol, " ticket=", ticket != nil)
+	stats.recordRequest(command, security, option, metadata.Destination, paddingLen, legacyProtocol)
+	reader = newStatsReader(reader, stats)
+	var readerOptions []ReaderOption
+	if command != CommandUDP && s.uniformChunkSize > 0 {
+		readerOptions = append(readerOptions, ReaderWithUniformChunks(s.uniformChunkSize))
+	}
+	if security == SecurityTypeAes256Gcm {
+		readerOptions = append(readerOptions, ReaderWithCommandKey(cmdKey[:]))
+	}
+	if s.faultInjector != nil {
+		readerOptions = append(readerOptions, ReaderWithFaultInjector(s.faultInjector))
+	}
+	rekeyShift := reserved >> requestReservedRekeyShift
+	if rekeyShift > 0 {
+		readerOptions = append(readerOptions, ReaderWithRekeyInterval(1<<rekeyShift))
+	}
+	reader = CreateReader(reader, nil, requestBodyKey, requestBodyNonce, requestBodyKey, requestBodyNonce, security, option, readerOptions...)
 	if option&RequestOptionChunkStream != 0 && command == CommandTCP || command == CommandMux {
-		reader = bufio.NewChunkReader(reader, ReadChunkSize)
+		reader = newChunkReader(reader, s.pipelinedRead)
 	}
+	memory := s.memory.open()
+	setMemoryAccount(reader, memory)
+	stats.attach(reader)
+	setPaddingPolicy(reader, paddingPolicy)
+	stats.handshakeDone(handshakeStart)
+	releaseHandshake()
+	*handshaken = true
+	s.metrics.HandshakeSucceeded()
 	rawConn := rawServerConn{
-		Conn:           conn,
-		legacyProtocol: legacyProtocol,
-		requestKey:     requestBodyKey,
-		requestNonce:   requestBodyNonce,
-		responseHeader: responseHeader,
-		security:       security,
-		option:         option,
-		reader:         bufio.NewExtendedReader(reader),
+		Conn:            conn,
+		legacyProtocol:  legacyProtocol,
+		command:         command,
+		muxVersion:      muxVersion,
+		handshake:       handshake,
+		memory:          memory,
+		writeCoalescing: s.writeCoalescing,
+		requestKey:      requestBodyKey,
+		requestNonce:    requestBodyNonce,
+		commandKey:      cmdKey[:],
+		responseHeader:  responseHeader,
+		security:        security,
+		option:          option,
+		packetFragment:  command == CommandUDP && reserved&requestReservedPacketFragment != 0,
+		rekeyShift:      rekeyShift,
+		uploadLimiter:   uploadLimiter,
+		downloadLimiter: downloadLimiter,
+		classUpload:     classUpload,
+		classDownload:   classDownload,
+		user:            user,
+		stats:           stats,
+		deadline:        &writeDeadline{},
+		paddingPolicy:   paddingPolicy,
+		pacer:           s.pacer,
+		faultInjector:   s.faultInjector,
+		rawDestination:  metadata.Destination,
+		earlyData:       earlyLen > 0,
+		earlyLen:        earlyLen,
+		uniformChunks:   s.uniformChunkSize,
+		aggregateSize:   s.writeAggregation,
+		reader:          bufio.NewExtendedReader(reader),
+	}
+	handler := s.handler
+	if s.sessionHandler != nil || s.responseCommand != nil || s.rewrite != nil || s.udpResolver != nil {
+		if s.rewrite != nil {
+			if command == CommandMux || s.muxHandler != nil && IsSingMuxDestination(metadata.Destination) {
+				handler = &rewriteMuxHandler[U]{handler, s, session}
+			} else if !(s.uot && isUoTDestination(metadata.Destination)) && !s.isUDPMultiplex(command, metadata.Destination) {
+				metadata.Destination, err = s.rewriteDestination(session)
+				if err != nil {
+					return err
+				}
+				session.Destination = metadata.Destination
+			}
+		}
+		if s.sessionHandler != nil {
+			s.sessionHandler(session)
+		}
+		if s.responseCommand != nil {
+			rawConn.responseCommand = s.responseCommand(session)
+			if rawConn.responseCommand.encodedLen() > 255 {
+				return E.Extend(ErrResponseCommandTooLarge, rawConn.responseCommand.encodedLen())
+			}
+		}
 	}
 
+	if s.sessionTickets != nil && !legacyProtocol && option&requestOptionSessionTicket != 0 && rawConn.responseCommand == nil {
+		rawConn.responseCommand = s.sessionTickets.issue(user, cmdKey, securities, rand.Reader, s.time())
+	}
+
+	var resolvedAddresses []netip.Addr
+	if command == CommandUDP && s.udpResolver != nil && metadata.Destination.IsFqdn() && !s.isUDPMultiplex(command, metadata.Destination) {
+		metadata.Destination, resolvedAddresses, err = s.resolveUDPDestination(ctx, session, metadata.Destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	rawConn.destination = metadata.Destination
+	if command == CommandMux {
+		rawConn.destination = MuxDestination
+		rawConn.rawDestination = MuxDestination
+	}
+	if s.accessLog != nil {
+		defer func() {
+			s.accessLog.log(handshakeStart, user, metadata.Source, rawConn.destination, command, security, stats, err)
+		}()
+	}
+
+	err = handshake.transition(HandshakeStateRequestAccepted)
+	if err != nil {
+		return err
+	}
 	switch command {
 	case CommandTCP:
-		return s.handler.NewConnection(ctx, &serverConn{rawConn}, metadata)
+		if s.muxHandler != nil && IsSingMuxDestination(metadata.Destination) {
+			return s.muxHandler.NewMuxConnection(ctx, &serverConn{rawServerConn: rawConn}, metadata, handler)
+		}
+		if s.uot && isUoTDestination(metadata.Destination) {
+			return s.newUoTConnection(ctx, &serverConn{rawServerConn: rawConn}, metadata, session)
+		}
+		return handler.NewConnection(ctx, &serverConn{rawServerConn: rawConn}, metadata)
 	case CommandUDP:
-		return s.handler.NewPacketConnection(ctx, &serverPacketConn{rawConn, metadata.Destination}, metadata)
+		packetConn := &serverPacketConn{rawServerConn: rawConn, addresses: resolvedAddresses}
+		if s.udpSessions != nil {
+			session := s.udpSessions.open(udpSessionKey[U]{user, metadata.Source, metadata.Destination}, conn)
+			defer s.udpSessions.release(session)
+			packetConn.activity = &session.udpActivity
+		}
+		if s.isUDPMultiplex(command, metadata.Destination) {
+			return s.newUDPMultiplexConnection(ctx, packetConn, metadata, session)
+		}
+		return handler.NewPacketConnection(ctx, packetConn, metadata)
 	case CommandMux:
-		return HandleMuxConnection(ctx, &serverConn{rawConn}, s.handler)
+		if s.muxHandler != nil {
+			metadata.Destination = MuxDestination
+			return s.muxHandler.NewMuxConnection(ctx, &serverConn{rawServerConn: rawConn}, metadata, handler)
+		}
+		return HandleMuxConnection(ctx, &serverConn{rawServerConn: rawConn}, handler)
 	default:
 		return E.New("unknown command: ", command)
 	}
 }
 
+var (
+	_ ServerConn = (*serverConn)(nil)
+	_ ServerConn = (*serverPacketConn)(nil)
+)
+
+// ServerConn reports what the client negotiated, on the conns passed to the handler and the mux handler.
+type ServerConn interface {
+	Security() byte
+	Options() byte
+	Command() byte
+	User() any
+	Destination() M.Socksaddr
+	RequestDestination() M.Socksaddr
+	MuxVersion() int
+	HandshakeState() HandshakeState
+}
+
 type rawServerConn struct {
 	net.Conn
-	legacyProtocol bool
-	requestKey     []byte
-	requestNonce   []byte
-	responseHeader byte
-	security       byte
-	option         byte
-	reader         N.ExtendedReader
-	writer         N.ExtendedWriter
+	legacyProtocol  bool
+	command         byte
+	muxVersion      int
+	handshake       *handshakeMachine
+	memory          *memoryAccount
+	writeCoalescing time.Duration
+	requestKey      []byte
+	requestNonce    []byte
+	commandKey      []byte
+	faultInjector   FaultInjector
+	responseHeader  byte
+	responseCommand *ResponseCommand
+	security        byte
+	option          byte
+	uploadLimiter   *RateLimiter
+	downloadLimiter *RateLimiter
+	classUpload     *RateLimiter
+	classDownload   *RateLimiter
+	stats           *connStats
+	paddingPolicy   PaddingPolicy
+	pacer           Pacer
+	deadline        *writeDeadline
+	batch           *packetBatchWriter
+	user            any
+	destination     M.Socksaddr
+	rawDestination  M.Socksaddr
+	earlyData       bool
+	earlyLen        int
+	uniformChunks   int
+	packetFragment  bool
+	rekeyShift      byte
+	aggregateSize   int
+	aggregate       *aggregateWriter
+	reader          N.ExtendedReader
+	writer          N.ExtendedWriter
 }
 
 func (c *rawServerConn) writeResponse() error {
+	err := c.handshake.failure()
+	if err != nil {
+		return err
+	}
+	err = c.writeResponseHeader()
+	if err != nil {
+		c.handshake.fail(err)
+		return err
+	}
+	return c.handshake.transition(HandshakeStateEstablished)
+}
+
+func (c *rawServerConn) writeResponseHeader() error {
 	if c.legacyProtocol {
 		responseKey := md5.Sum(c.requestKey)
 		responseNonce := md5.Sum(c.requestNonce)
-		headerWriter := NewStreamWriter(c.Conn, responseKey[:], responseNonce[:])
-		_, err := headerWriter.Write([]byte{c.responseHeader, c.option, 0, 0})
+		headerWriter := NewStreamWriter(c.connWriter(), responseKey[:], responseNonce[:])
+		response := c.encodeResponseHeader()
+		_, err := headerWriter.Write(response)
 		if err != nil {
 			return E.Cause(err, "write response")
 		}
-		c.writer = bufio.NewExtendedWriter(CreateWriter(c.Conn, headerWriter, c.requestKey, c.requestNonce, responseKey[:], responseNonce[:], c.security, c.option))
+		c.writer = bufio.NewExtendedWriter(CreateWriter(c.connWriter(), headerWriter, c.requestKey, c.requestNonce, responseKey[:], responseNonce[:], c.security, c.option, c.writerOptions()...))
+		c.stats.attach(c.writer)
+		setPaddingPolicy(c.writer, c.paddingPolicy)
+		setPacer(c.writer, c.pacer)
 	} else {
-		responseBuffer := buf.NewSize(2 + CipherOverhead + 4 + CipherOverhead)
+		response := c.encodeResponseHeader()
+		responseBuffer := buf.NewSize(2 + CipherOverhead + len(response) + CipherOverhead)
 		defer responseBuffer.Release()
 
 		_responseKey := sha256.Sum256(c.requestKey[:])
@@ -392,45 +1143,173 @@ func (c *rawServerConn) writeResponse() error {
 		headerLenKey := KDF(responseKey, KDFSaltConstAEADRespHeaderLenKey)[:16]
 		headerLenNonce := KDF(responseNonce, KDFSaltConstAEADRespHeaderLenIV)[:12]
 		headerLenCipher := newAesGcm(headerLenKey)
-		binary.BigEndian.PutUint16(responseBuffer.Extend(2), 4)
+		binary.BigEndian.PutUint16(responseBuffer.Extend(2), uint16(len(response)))
 		headerLenCipher.Seal(responseBuffer.Index(0), headerLenNonce, responseBuffer.Bytes(), nil)
 		responseBuffer.Extend(CipherOverhead)
 
 		headerKey := KDF(responseKey, KDFSaltConstAEADRespHeaderPayloadKey)[:16]
 		headerNonce := KDF(responseNonce, KDFSaltConstAEADRespHeaderPayloadIV)[:12]
 		headerCipher := newAesGcm(headerKey)
-		common.Must(
-			responseBuffer.WriteByte(c.responseHeader),
-			responseBuffer.WriteByte(c.option),
-			responseBuffer.WriteZeroN(2),
-		)
+		common.Must1(responseBuffer.Write(response))
 		const headerIndex = 2 + CipherOverhead
 		headerCipher.Seal(responseBuffer.Index(headerIndex), headerNonce, responseBuffer.From(headerIndex), nil)
 		responseBuffer.Extend(CipherOverhead)
 
-		_, err := c.Conn.Write(responseBuffer.Bytes())
+		upstream := c.connWriter()
+		_, err := upstream.Write(responseBuffer.Bytes())
 		if err != nil {
 			return err
 		}
 
-		c.writer = bufio.NewExtendedWriter(CreateWriter(c.Conn, nil, c.requestKey, c.requestNonce, responseKey, responseNonce, c.security, c.option))
+		c.writer = bufio.NewExtendedWriter(CreateWriter(upstream, nil, c.requestKey, c.requestNonce, responseKey, responseNonce, c.security, c.option, c.writerOptions()...))
+		c.stats.attach(c.writer)
+		setPaddingPolicy(c.writer, c.paddingPolicy)
+		setPacer(c.writer, c.pacer)
 	}
 	return nil
 }
 
+func (c *rawServerConn) encodeResponseHeader() []byte {
+	commandLen := c.responseCommand.encodedLen()
+	response := make([]byte, 4+commandLen)
+	response[0] = c.responseHeader
+	response[1] = c.option
+	c.stats.trace("vmess: write response option=", c.option, " command length=", commandLen)
+	if commandLen > 0 {
+		response[2] = c.responseCommand.Command
+		response[3] = byte(commandLen)
+		c.responseCommand.encode(response[4:])
+	}
+	c.stats.recordResponse(c.option, response[2], commandLen, 0)
+	return response
+}
+
+func (c *rawServerConn) connWriter() io.Writer {
+	if c.batch != nil {
+		return newStatsWriter(c.batch, c.stats)
+	}
+	var writer io.Writer = c.Conn
+	if c.command != CommandUDP && c.aggregateSize > 0 {
+		if c.aggregate == nil {
+			c.aggregate = newAggregateWriter(c.Conn, c.aggregateSize)
+		}
+		writer = c.aggregate
+	}
+	if c.downloadLimiter != nil {
+		writer = newRateLimitedWriter(writer, c.downloadLimiter)
+	}
+	if c.classDownload != nil {
+		writer = newRateLimitedWriter(writer, c.classDownload)
+	}
+	writer = newDeadlineWriter(writer, c.deadline)
+	if c.command == CommandUDP {
+		c.batch = newPacketBatchWriter(writer)
+		writer = c.batch
+	}
+	return newStatsWriter(writer, c.stats)
+}
+
+func (c *rawServerConn) Stats() ConnStats {
+	stats := c.stats.snapshot(c.command, c.security, c.option)
+	stats.BytesBuffered = uint64(c.memory.buffered())
+	return stats
+}
+
+func (c *rawServerConn) HandshakeState() HandshakeState {
+	return c.handshake.State()
+}
+
+func (c *rawServerConn) Security() byte {
+	return c.security
+}
+
+func (c *rawServerConn) Options() byte {
+	return c.option
+}
+
+func (c *rawServerConn) Command() byte {
+	return c.command
+}
+
+func (c *rawServerConn) User() any {
+	return c.user
+}
+
+func (c *rawServerConn) Destination() M.Socksaddr {
+	return c.destination
+}
+
+func (c *rawServerConn) HandshakeSuccess() error {
+	if c.writer == nil {
+		return c.writeResponse()
+	}
+	return nil
+}
+
+func (c *rawServerConn) writerOptions() []WriterOption {
+	var options []WriterOption
+	if c.command == CommandTCP && c.writeCoalescing > 0 {
+		options = append(options, WriterWithCoalescing(c.writeCoalescing))
+	}
+	if c.command != CommandUDP && c.uniformChunks > 0 {
+		options = append(options, WriterWithUniformChunks(c.uniformChunks))
+	}
+	if c.security == SecurityTypeAes256Gcm {
+		options = append(options, WriterWithCommandKey(c.commandKey))
+	}
+	if c.faultInjector != nil {
+		options = append(options, WriterWithFaultInjector(c.faultInjector))
+	}
+	if c.rekeyShift > 0 {
+		options = append(options, WriterWithRekeyInterval(1<<c.rekeyShift))
+	}
+	return options
+}
+
 func (c *rawServerConn) Close() error {
 	return common.Close(
+		common.Closer(func() error {
+			return closeCoalescingWriter(c.writer)
+		}),
 		c.Conn,
 		c.reader,
 	)
 }
 
+func (c *rawServerConn) CloseWrite() error {
+	if c.writer == nil {
+		err := c.writeResponse()
+		if err != nil {
+			return err
+		}
+	}
+	err := writeEndOfStream(c.writer, c.option)
+	if err != nil {
+		return err
+	}
+	return rw.CloseWrite(c.Conn)
+}
+
+func (c *rawServerConn) CloseRead() error {
+	switch reader := c.reader.(type) {
+	case *ChunkReader, *PipelinedReader:
+		common.Close(reader)
+	}
+	return rw.CloseRead(c.Conn)
+}
+
 func (c *rawServerConn) FrontHeadroom() int {
-	return MaxFrontHeadroom
+	if c.writer != nil {
+		return 0
+	}
+	return MaxFrontHeadroom + N.CalculateFrontHeadroom(c.Conn)
 }
 
 func (c *rawServerConn) RearHeadroom() int {
-	return MaxRearHeadroom
+	if c.writer != nil {
+		return 0
+	}
+	return MaxRearHeadroom + N.CalculateRearHeadroom(c.Conn)
 }
 
 func (c *rawServerConn) NeedHandshake() bool {
@@ -441,15 +1320,52 @@ func (c *rawServerConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
 
+func (c *rawServerConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *rawServerConn) SetWriteDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
 func (c *rawServerConn) Upstream() any {
 	return c.Conn
 }
 
+func (c *rawServerConn) transparent() bool {
+	return c.uploadLimiter == nil && c.downloadLimiter == nil && c.classUpload == nil && c.classDownload == nil && c.command == CommandTCP && c.security == SecurityTypeNone && c.option&RequestOptionChunkStream == 0 && c.option&RequestOptionCompression == 0
+}
+
+func (c *rawServerConn) ReaderReplaceable() bool {
+	return c.transparent()
+}
+
+func (c *rawServerConn) WriterReplaceable() bool {
+	return c.writer != nil && c.transparent()
+}
+
+func (c *rawServerConn) UpstreamReader() any {
+	return c.reader
+}
+
+func (c *rawServerConn) UpstreamWriter() any {
+	return c.writer
+}
+
 type serverConn struct {
 	rawServerConn
+	payload *buf.Buffer
 }
 
 func (c *serverConn) Read(b []byte) (n int, err error) {
+	if c.payload != nil {
+		n = copy(b, c.payload.Bytes())
+		c.payload.Advance(n)
+		c.releasePayload()
+		return
+	}
 	return c.reader.Read(b)
 }
 
@@ -460,10 +1376,19 @@ func (c *serverConn) Write(b []byte) (n int, err error) {
 			return
 		}
 	}
-	return c.writer.Write(b)
+	return c.aggregate.write(c.writer, b)
 }
 
 func (c *serverConn) ReadBuffer(buffer *buf.Buffer) error {
+	if c.payload != nil {
+		n, err := buffer.Write(c.payload.Bytes())
+		if err != nil {
+			return err
+		}
+		c.payload.Advance(n)
+		c.releasePayload()
+		return nil
+	}
 	return c.reader.ReadBuffer(buffer)
 }
 
@@ -475,11 +1400,24 @@ func (c *serverConn) WriteBuffer(buffer *buf.Buffer) error {
 			return err
 		}
 	}
-	return c.writer.WriteBuffer(buffer)
+	return c.aggregate.writeBuffer(c.writer, buffer)
 }
 
 func (c *serverConn) WriteTo(w io.Writer) (n int64, err error) {
-	return bufio.Copy(w, c.reader)
+	if c.payload != nil {
+		var payloadLen int
+		payloadLen, err = w.Write(c.payload.Bytes())
+		n = int64(payloadLen)
+		c.payload.Advance(payloadLen)
+		c.releasePayload()
+		if err != nil {
+			return
+		}
+	}
+	var copyN int64
+	copyN, err = bufio.Copy(w, c.reader)
+	n += copyN
+	return
 }
 
 func (c *serverConn) ReadFrom(r io.Reader) (n int64, err error) {
@@ -496,14 +1434,18 @@ var _ PacketConn = (*serverPacketConn)(nil)
 
 type serverPacketConn struct {
 	rawServerConn
-	destination M.Socksaddr
+	activity  *udpActivity
+	addresses []netip.Addr
 }
 
 func (c *serverPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, err = c.reader.Read(p)
+	buffer := buf.With(p)
+	err = readPacket(c.reader, buffer, c.packetFragment)
 	if err != nil {
 		return
 	}
+	c.activity.touch()
+	n = copy(p, buffer.Bytes())
 	addr = c.destination.UDPAddr()
 	return
 }
@@ -515,14 +1457,21 @@ func (c *serverPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			return
 		}
 	}
-	return c.writer.Write(p)
+	err = writePacket(c.writer, buf.As(p), c.packetFragment)
+	if err != nil {
+		return
+	}
+	c.activity.touch()
+	n = len(p)
+	return
 }
 
 func (c *serverPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
-	err = c.reader.ReadBuffer(buffer)
+	err = readPacket(c.reader, buffer, c.packetFragment)
 	if err != nil {
 		return
 	}
+	c.activity.touch()
 	destination = c.destination
 	return
 }
@@ -531,8 +1480,22 @@ func (c *serverPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	if c.writer == nil {
 		err := c.writeResponse()
 		if err != nil {
+			buffer.Release()
+			return err
+		}
+	}
+	c.activity.touch()
+	return writePacket(c.writer, buffer, c.packetFragment)
+}
+
+func (c *serverPacketConn) WriteMultiPacket(buffers []*buf.Buffer, destination M.Socksaddr) error {
+	if c.writer == nil {
+		err := c.writeResponse()
+		if err != nil {
+			buf.ReleaseMulti(buffers)
 			return err
 		}
 	}
-	return c.writer.WriteBuffer(buffer)
+	c.activity.touch()
+	return writeMultiPacket(c.writer, c.batch, buffers, c.packetFragment)
 }
@@ -0,0 +1,156 @@
+package vmess
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+)
+
+const legacyAuthUpdateInterval = 10 * time.Second
+
+type legacyAuthEntry struct {
+	userIndex int
+	timestamp int64
+}
+
+type legacyAuthTable struct {
+	access     sync.RWMutex
+	userIds    [][][16]byte
+	hashes     map[[16]byte]legacyAuthEntry
+	stamps     map[int64][][16]byte
+	firstStamp int64
+	lastStamp  int64
+}
+
+func newLegacyAuthTable(userIds [][][16]byte) *legacyAuthTable {
+	return &legacyAuthTable{
+		userIds: userIds,
+		hashes:  make(map[[16]byte]legacyAuthEntry),
+		stamps:  make(map[int64][][16]byte),
+	}
+}
+
+func (t *legacyAuthTable) update(now time.Time, tolerance time.Duration) {
+	nowStamp := now.Unix()
+	toleranceSeconds := int64(tolerance / time.Second)
+	expireStamp := nowStamp - toleranceSeconds
+	endStamp := nowStamp + toleranceSeconds + int64(legacyAuthUpdateInterval/time.Second)
+	t.access.RLock()
+	beginStamp := t.lastStamp + 1
+	t.access.RUnlock()
+	if beginStamp < expireStamp {
+		beginStamp = expireStamp
+	}
+	stamps := make(map[int64][][16]byte)
+	for timestamp := beginStamp; timestamp <= endStamp; timestamp++ {
+		var authInfos [][16]byte
+		for _, ids := range t.userIds {
+			for _, id := range ids {
+				var authInfo [16]byte
+				idHash := hmac.New(md5.New, id[:])
+				common.Must(binary.Write(idHash, binary.BigEndian, uint64(timestamp)))
+				idHash.Sum(authInfo[:0])
+				authInfos = append(authInfos, authInfo)
+			}
+		}
+		stamps[timestamp] = authInfos
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	for timestamp, authInfos := range stamps {
+		var index int
+		for userIndex, ids := range t.userIds {
+			for range ids {
+				t.hashes[authInfos[index]] = legacyAuthEntry{userIndex, timestamp}
+				index++
+			}
+		}
+		t.stamps[timestamp] = authInfos
+	}
+	if t.firstStamp == 0 {
+		t.firstStamp = beginStamp
+	}
+	if endStamp > t.lastStamp {
+		t.lastStamp = endStamp
+	}
+	for ; t.firstStamp < expireStamp; t.firstStamp++ {
+		for _, authInfo := range t.stamps[t.firstStamp] {
+			if t.hashes[authInfo].timestamp == t.firstStamp {
+				delete(t.hashes, authInfo)
+			}
+		}
+		delete(t.stamps, t.firstStamp)
+	}
+}
+
+func (t *legacyAuthTable) lookup(authInfo []byte, now time.Time, tolerance time.Duration) (entry legacyAuthEntry, found bool) {
+	var key [16]byte
+	copy(key[:], authInfo)
+	t.access.RLock()
+	entry, found = t.hashes[key]
+	t.access.RUnlock()
+	if !found {
+		return
+	}
+	drift := now.Sub(time.Unix(entry.timestamp, 0))
+	if drift > tolerance || drift < -tolerance {
+		return legacyAuthEntry{}, false
+	}
+	return
+}
+
+type legacySessionID struct {
+	user  [16]byte
+	key   [16]byte
+	nonce [16]byte
+}
+
+type legacySessionHistory struct {
+	access   sync.Mutex
+	sessions map[legacySessionID]time.Time
+}
+
+func newLegacySessionHistory() *legacySessionHistory {
+	return &legacySessionHistory{sessions: make(map[legacySessionID]time.Time)}
+}
+
+func (h *legacySessionHistory) add(id legacySessionID, now time.Time, expire time.Time) bool {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if previous, loaded := h.sessions[id]; loaded && now.Before(previous) {
+		return false
+	}
+	h.sessions[id] = expire
+	return true
+}
+
+func (h *legacySessionHistory) expire(now time.Time) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	for id, expire := range h.sessions {
+		if !now.Before(expire) {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+func (s *Service[U]) loopLegacyAuth() {
+	ticker := time.NewTicker(legacyAuthUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		users, _ := s.loadUsers()
+		if users.legacyAuth != nil {
+			users.legacyAuth.update(s.time(), s.timeTolerance)
+		}
+		s.legacySessions.expire(s.time())
+	}
+}
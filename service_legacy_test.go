@@ -0,0 +1,112 @@
+package vmess
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type recordConn struct {
+	net.Conn
+	access  sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.access.Lock()
+	c.written.Write(p)
+	c.access.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordConn) bytes() []byte {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+func TestLegacyReplay(t *testing.T) {
+	service := NewService[int](&echoHandler{}, ServiceWithLegacyHeader())
+	err := service.UpdateUsers([]int{1}, []string{testUserID}, []int{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	client, err := NewClient(testUserID, "aes-128-gcm", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, _ := serveTestConn(service)
+	recorder := &recordConn{Conn: upstream}
+	conn, err := client.DialConn(recorder, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	replayed, done := serveTestConn(service)
+	go replayed.Write(recorder.bytes())
+	defer replayed.Close()
+	select {
+	case err = <-done:
+		if !errors.Is(err, ErrReplay) {
+			t.Fatal("replayed legacy request not rejected: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed legacy request accepted")
+	}
+}
+
+func TestLegacyHeaderWithKeys(t *testing.T) {
+	service := NewService[int](&echoHandler{}, ServiceWithLegacyHeader())
+	err := service.UpdateUsers([]int{1}, []string{testUserID}, []int{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	err = service.UpdateUserKeys([][16]byte{Key(uuid.FromStringOrNil(testUserID))})
+	if !errors.Is(err, ErrLegacyHeaderWithKeys) {
+		t.Fatal("UpdateUserKeys: unexpected error ", err)
+	}
+	client, err := NewClient(testUserID, "aes-128-gcm", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, _ := serveTestConn(service)
+	conn, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal("legacy auth lost after rejected key update: ", err)
+	}
+}
@@ -1,5 +1,7 @@
 package vmess
 
+import "time"
+
 type ServiceOption func(service *Service[string])
 
 func ServiceWithTimeFunc(timeFunc TimeFunc) ServiceOption {
@@ -13,3 +15,189 @@ func ServiceWithDisableHeaderProtection() ServiceOption {
 		service.disableHeaderProtect = true
 	}
 }
+
+func ServiceWithReplayFilter(filter ReplayFilter) ServiceOption {
+	return func(service *Service[string]) {
+		service.replayFilter = filter
+	}
+}
+
+func ServiceWithTimeTolerance(tolerance time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.timeTolerance = tolerance
+	}
+}
+
+func ServiceWithBadTimestampHandler(handler BadTimestampHandler) ServiceOption {
+	return func(service *Service[string]) {
+		service.badTimestampHandler = handler
+	}
+}
+
+func ServiceWithLegacyHeader() ServiceOption {
+	return func(service *Service[string]) {
+		service.legacyHeader = true
+	}
+}
+
+func ServiceWithWriteCoalescing(delay time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.writeCoalescing = delay
+	}
+}
+
+func ServiceWithPipelinedRead(depth int) ServiceOption {
+	return func(service *Service[string]) {
+		service.pipelinedRead = depth
+	}
+}
+
+func ServiceWithMuxHandler(handler MuxHandler) ServiceOption {
+	return func(service *Service[string]) {
+		service.muxHandler = handler
+	}
+}
+
+func ServiceWithChacha20Poly1305Header() ServiceOption {
+	return func(service *Service[string]) {
+		service.chachaHeader = true
+	}
+}
+
+func ServiceWithPaddingPolicy(policy PaddingPolicy) ServiceOption {
+	return func(service *Service[string]) {
+		service.paddingPolicy = policy
+	}
+}
+
+func ServiceWithUDPTimeout(timeout time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.udpTimeout = timeout
+	}
+}
+
+func ServiceWithSessionTickets(lifetime time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.ticketLifetime = lifetime
+	}
+}
+
+func ServiceWithUDPMaxSessions(maxSessions int) ServiceOption {
+	return func(service *Service[string]) {
+		service.udpMaxSessions = maxSessions
+	}
+}
+
+func ServiceWithPacer(pacer Pacer) ServiceOption {
+	return func(service *Service[string]) {
+		service.pacer = pacer
+	}
+}
+
+func ServiceWithLogger(logger Logger) ServiceOption {
+	return func(service *Service[string]) {
+		service.logger = logger
+	}
+}
+
+func ServiceWithErrorJitter(maxDelay time.Duration) ServiceOption {
+	return func(service *Service[string]) {
+		service.errorJitter = maxDelay
+	}
+}
+
+func ServiceWithHandshakeLimit(maxPerSource int, evictHandler HandshakeEvictHandler) ServiceOption {
+	return func(service *Service[string]) {
+		if maxPerSource > 0 {
+			service.handshakeLimiter = newHandshakeLimiter(maxPerSource, evictHandler)
+		}
+	}
+}
+
+func ServiceWithMetrics(metrics Metrics) ServiceOption {
+	return func(service *Service[string]) {
+		service.metrics = metrics
+	}
+}
+
+func ServiceWithUniformChunks(size int) ServiceOption {
+	return func(service *Service[string]) {
+		service.uniformChunkSize = uniformChunkSize(size)
+	}
+}
+
+func ServiceWithWriteAggregation(size int) ServiceOption {
+	return func(service *Service[string]) {
+		service.writeAggregation = writeAggregationSize(size)
+	}
+}
+
+func ServiceWithUoT() ServiceOption {
+	return func(service *Service[string]) {
+		service.uot = true
+	}
+}
+
+func ServiceWithStrictMode() ServiceOption {
+	return func(service *Service[string]) {
+		service.strictMode = true
+	}
+}
+
+func ServiceWithHandshakeWorkers(workers int, queueLength int) ServiceOption {
+	return func(service *Service[string]) {
+		if workers > 0 {
+			service.handshakeWorkers = newHandshakeWorkers(workers, queueLength)
+		}
+	}
+}
+
+func ServiceWithUDPMultiplex() ServiceOption {
+	return func(service *Service[string]) {
+		service.udpMultiplex = true
+	}
+}
+
+func ServiceWithRequiredOptions(options byte) ServiceOption {
+	return func(service *Service[string]) {
+		service.requiredOptions = options
+	}
+}
+
+func ServiceWithRecorder(recorder *Recorder) ServiceOption {
+	return func(service *Service[string]) {
+		service.recorder = recorder
+	}
+}
+
+func ServiceWithFaultInjector(injector FaultInjector) ServiceOption {
+	return func(service *Service[string]) {
+		service.faultInjector = injector
+	}
+}
+
+func ServiceWithAccessLog(logger AccessLogger, privacy AccessLogPrivacy) ServiceOption {
+	return func(service *Service[string]) {
+		if logger == nil {
+			service.accessLog = nil
+			return
+		}
+		service.accessLog = newAccessLog(logger, privacy)
+	}
+}
+
+func ServiceWithHandshakeObserver(observer HandshakeObserver) ServiceOption {
+	return func(service *Service[string]) {
+		service.handshakeObserver = observer
+	}
+}
+
+func ServiceWithMemoryLimit(limit int64) ServiceOption {
+	return func(service *Service[string]) {
+		if limit <= 0 {
+			service.memory = nil
+			return
+		}
+		service.memory = newMemoryAccountant(limit)
+	}
+}
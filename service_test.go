@@ -0,0 +1,72 @@
+package vmess
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestUpdateUserList(t *testing.T) {
+	const restrictedUserID = "6f9c1b9e-0e6a-4d8c-9f3c-7a1d2b4e5f60"
+	service := newTestService(t, &echoHandler{})
+	err := service.UpdateUserList([]User[int]{
+		{User: 1, UUID: testUserID},
+		{User: 2, UUID: restrictedUserID, Securities: []byte{SecurityTypeChacha20Poly1305}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, done := serveTestConn(service)
+	go newTestClient(t, restrictedUserID).DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	err = waitHandshake(t, "restricted", done)
+	upstream.Close()
+	if !errors.Is(err, ErrSecurityRejected) {
+		t.Fatal("restricted: ", err)
+	}
+
+	echo := func(name string, conn io.ReadWriter) {
+		_, err := conn.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+	}
+	client, err := NewClient(restrictedUserID, "chacha20-poly1305", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, _ = serveTestConn(service)
+	allowed, err := client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	echo("allowed", allowed)
+
+	upstream, _ = serveTestConn(service)
+	unrestricted, err := newTestClient(t, testUserID).DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unrestricted.Close()
+	echo("unrestricted", unrestricted)
+
+	err = service.UpdateUserList([]User[int]{{User: 1, UUID: testUserID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo("after reload", allowed)
+	upstream, done = serveTestConn(service)
+	go client.DialConn(upstream, M.ParseSocksaddr("example.com:80"))
+	err = waitHandshake(t, "removed", done)
+	upstream.Close()
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatal("removed: ", err)
+	}
+}
@@ -0,0 +1,200 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const (
+	requestOptionSessionTicket   = 128
+	responseCommandSessionTicket = 0xF1
+	sessionTicketPayloadLen      = 16 + 16 + 4
+	sessionTicketLimit           = 65536
+)
+
+var ErrSessionTicketRejected = E.New("vmess: session ticket rejected")
+
+// sessionTicket is a single use id and secret that lets the next request skip the user search.
+type sessionTicket struct {
+	id      [16]byte
+	secret  [16]byte
+	expires time.Time
+}
+
+func parseSessionTicket(payload []byte, now time.Time) (*sessionTicket, bool) {
+	if len(payload) != sessionTicketPayloadLen {
+		return nil, false
+	}
+	var ticket sessionTicket
+	copy(ticket.id[:], payload[:16])
+	copy(ticket.secret[:], payload[16:32])
+	lifetime := time.Duration(binary.BigEndian.Uint32(payload[32:])) * time.Second
+	// leave a margin for the lifetime spent in flight and clock skew
+	ticket.expires = now.Add(lifetime * 3 / 4)
+	return &ticket, true
+}
+
+func (t *sessionTicket) headerCipher() cipher.AEAD {
+	return newAesGcm(t.secret[:])
+}
+
+func sessionTicketNonce(connectionNonce []byte, index byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, connectionNonce)
+	nonce[11] = index
+	return nonce
+}
+
+func (h *RequestHeader) sealTicket(ticket *sessionTicket, random io.Reader, requestBuffer *buf.Buffer) {
+	const headerLenBufferLen = 2 + CipherOverhead
+
+	headerLen := h.Len()
+	common.Must1(requestBuffer.Write(ticket.id[:]))
+	authId := requestBuffer.To(16)
+
+	headerLenBuffer := buf.With(requestBuffer.Extend(headerLenBufferLen))
+	connectionNonce := requestBuffer.Extend(8)
+	common.Must1(io.ReadFull(random, connectionNonce))
+
+	headerCipher := ticket.headerCipher()
+	common.Must(binary.Write(headerLenBuffer, binary.BigEndian, uint16(headerLen)))
+	headerCipher.Seal(headerLenBuffer.Index(0), sessionTicketNonce(connectionNonce, 0), headerLenBuffer.Bytes(), authId)
+
+	headerBuffer := buf.With(requestBuffer.Extend(headerLen + CipherOverhead))
+	h.encode(headerBuffer, random)
+	headerCipher.Seal(headerBuffer.Index(0), sessionTicketNonce(connectionNonce, 1), headerBuffer.Bytes(), authId)
+}
+
+type sessionTicketCache struct {
+	access sync.Mutex
+	ticket *sessionTicket
+}
+
+func (c *sessionTicketCache) take(now time.Time) *sessionTicket {
+	if c == nil {
+		return nil
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	ticket := c.ticket
+	c.ticket = nil
+	if ticket == nil || now.After(ticket.expires) {
+		return nil
+	}
+	return ticket
+}
+
+func (c *sessionTicketCache) store(ticket *sessionTicket) {
+	c.access.Lock()
+	c.ticket = ticket
+	c.access.Unlock()
+}
+
+type serverSessionTicket[U comparable] struct {
+	user       U
+	key        [16]byte
+	securities []byte
+	secret     [16]byte
+	expires    time.Time
+}
+
+type sessionTicketStore[U comparable] struct {
+	access   sync.Mutex
+	lifetime time.Duration
+	tickets  map[[16]byte]*serverSessionTicket[U]
+	order    [][16]byte
+}
+
+func newSessionTicketStore[U comparable](lifetime time.Duration) *sessionTicketStore[U] {
+	return &sessionTicketStore[U]{
+		lifetime: lifetime,
+		tickets:  make(map[[16]byte]*serverSessionTicket[U]),
+	}
+}
+
+func (s *sessionTicketStore[U]) issue(user U, key [16]byte, securities []byte, random io.Reader, now time.Time) *ResponseCommand {
+	payload := make([]byte, sessionTicketPayloadLen)
+	common.Must1(io.ReadFull(random, payload[:32]))
+	binary.BigEndian.PutUint32(payload[32:], uint32(s.lifetime/time.Second))
+	ticket := &serverSessionTicket[U]{
+		user:       user,
+		key:        key,
+		securities: securities,
+		expires:    now.Add(s.lifetime),
+	}
+	var id [16]byte
+	copy(id[:], payload[:16])
+	copy(ticket.secret[:], payload[16:32])
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.expire(now)
+	if len(s.tickets) >= sessionTicketLimit {
+		return nil
+	}
+	s.tickets[id] = ticket
+	s.order = append(s.order, id)
+	if len(s.order) > 2*len(s.tickets) {
+		s.compact()
+	}
+	return &ResponseCommand{responseCommandSessionTicket, payload}
+}
+
+func (s *sessionTicketStore[U]) take(authId []byte, now time.Time) (*serverSessionTicket[U], bool) {
+	if s == nil {
+		return nil, false
+	}
+	var id [16]byte
+	copy(id[:], authId)
+	s.access.Lock()
+	defer s.access.Unlock()
+	ticket, loaded := s.tickets[id]
+	if !loaded {
+		return nil, false
+	}
+	delete(s.tickets, id)
+	if now.After(ticket.expires) {
+		return nil, false
+	}
+	return ticket, true
+}
+
+func (s *sessionTicketStore[U]) expire(now time.Time) {
+	// tickets share one lifetime, so issue order is expiry order
+	for len(s.order) > 0 {
+		ticket, loaded := s.tickets[s.order[0]]
+		if loaded {
+			if !now.After(ticket.expires) {
+				break
+			}
+			delete(s.tickets, s.order[0])
+		}
+		s.order = s.order[1:]
+	}
+}
+
+func (s *sessionTicketStore[U]) compact() {
+	order := make([][16]byte, 0, len(s.tickets))
+	for _, id := range s.order {
+		if _, loaded := s.tickets[id]; loaded {
+			order = append(order, id)
+		}
+	}
+	s.order = order
+}
+
+func (s *sessionTicketStore[U]) clear() {
+	if s == nil {
+		return
+	}
+	s.access.Lock()
+	s.tickets = make(map[[16]byte]*serverSessionTicket[U])
+	s.order = nil
+	s.access.Unlock()
+}
@@ -0,0 +1,25 @@
+package vmess
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketOrderBounded(t *testing.T) {
+	store := newSessionTicketStore[int](time.Hour)
+	now := time.Now()
+	for i := 0; i < 10000; i++ {
+		command := store.issue(1, [16]byte{}, nil, rand.Reader, now)
+		if command == nil {
+			t.Fatal("ticket not issued")
+		}
+		_, loaded := store.take(command.Payload[:16], now)
+		if !loaded {
+			t.Fatal("ticket not found")
+		}
+	}
+	if len(store.order) > 2*len(store.tickets)+1 {
+		t.Fatal("order not compacted: ", len(store.order), " ids for ", len(store.tickets), " tickets")
+	}
+}
@@ -0,0 +1,209 @@
+package vmess
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type ConnStats struct {
+	BytesRead         uint64
+	BytesWritten      uint64
+	ChunksRead        uint64
+	ChunksWritten     uint64
+	PaddingRead       uint64
+	PaddingWritten    uint64
+	HandshakeDuration time.Duration
+	BytesBuffered     uint64
+	Command           byte
+	Security          byte
+	Option            byte
+}
+
+type connStats struct {
+	bytesRead         uint64
+	bytesWritten      uint64
+	chunksRead        uint64
+	chunksWritten     uint64
+	paddingRead       uint64
+	paddingWritten    uint64
+	handshakeDuration int64
+	logger            Logger
+	ctx               context.Context
+	metrics           Metrics
+	recording         *connRecording
+}
+
+func (s *connStats) snapshot(command byte, security byte, option byte) ConnStats {
+	return ConnStats{
+		BytesRead:         atomic.LoadUint64(&s.bytesRead),
+		BytesWritten:      atomic.LoadUint64(&s.bytesWritten),
+		ChunksRead:        atomic.LoadUint64(&s.chunksRead),
+		ChunksWritten:     atomic.LoadUint64(&s.chunksWritten),
+		PaddingRead:       atomic.LoadUint64(&s.paddingRead),
+		PaddingWritten:    atomic.LoadUint64(&s.paddingWritten),
+		HandshakeDuration: time.Duration(atomic.LoadInt64(&s.handshakeDuration)),
+		Command:           command,
+		Security:          security,
+		Option:            option,
+	}
+}
+
+func (s *connStats) handshakeDone(start time.Time) {
+	atomic.StoreInt64(&s.handshakeDuration, int64(time.Since(start)))
+}
+
+func (s *connStats) countRead(n int64) {
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+	if s.metrics != nil {
+		s.metrics.BytesRead(uint64(n))
+	}
+}
+
+func (s *connStats) countWritten(n int64) {
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+	if s.metrics != nil {
+		s.metrics.BytesWritten(uint64(n))
+	}
+}
+
+func (s *connStats) chunkDecryptFailed() {
+	if s != nil && s.metrics != nil {
+		s.metrics.ChunkDecryptFailed()
+	}
+}
+
+func (s *connStats) chunkRead(dataLen int, paddingLen int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.chunksRead, 1)
+	atomic.AddUint64(&s.paddingRead, uint64(paddingLen))
+	if s.logger != nil {
+		s.trace("vmess: read chunk data=", dataLen, " padding=", paddingLen)
+	}
+	if s.recording != nil {
+		s.recordChunk(RecordRead, &s.recording.readIndex, dataLen, paddingLen)
+	}
+}
+
+func (s *connStats) chunkWritten(dataLen int, paddingLen int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.chunksWritten, 1)
+	atomic.AddUint64(&s.paddingWritten, uint64(paddingLen))
+	if s.logger != nil {
+		s.trace("vmess: write chunk data=", dataLen, " padding=", paddingLen)
+	}
+	if s.recording != nil {
+		s.recordChunk(RecordWrite, &s.recording.writeIndex, dataLen, paddingLen)
+	}
+}
+
+func (s *connStats) attach(chain any) {
+	walkUpstream(chain, func(layer any) bool {
+		switch layer := layer.(type) {
+		case *StreamChunkReader:
+			layer.stats = s
+		case *StreamChunkWriter:
+			layer.stats = s
+		case *AEADChunkReader:
+			layer.stats = s
+		case *AEADChunkWriter:
+			layer.stats = s
+		case *AEADReader:
+			layer.stats = s
+		case *statsReader, *statsWriter:
+			return false
+		}
+		return true
+	})
+}
+
+func walkUpstream(chain any, visit func(layer any) bool) {
+	for chain != nil && visit(chain) {
+		upstream, hasUpstream := chain.(common.WithUpstream)
+		if !hasUpstream {
+			return
+		}
+		chain = upstream.Upstream()
+	}
+}
+
+type statsReader struct {
+	upstream N.ExtendedReader
+	stats    *connStats
+}
+
+func newStatsReader(upstream io.Reader, stats *connStats) *statsReader {
+	return &statsReader{bufio.NewExtendedReader(upstream), stats}
+}
+
+func (r *statsReader) Read(p []byte) (n int, err error) {
+	n, err = r.upstream.Read(p)
+	r.stats.countRead(int64(n))
+	return
+}
+
+func (r *statsReader) ReadBuffer(buffer *buf.Buffer) error {
+	err := r.upstream.ReadBuffer(buffer)
+	r.stats.countRead(int64(buffer.Len()))
+	return err
+}
+
+func (r *statsReader) UnwrapReader() (io.Reader, []N.CountFunc) {
+	return r.upstream, []N.CountFunc{r.stats.countRead}
+}
+
+func (r *statsReader) Upstream() any {
+	return r.upstream
+}
+
+type statsWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	stats      *connStats
+}
+
+func newStatsWriter(upstream io.Writer, stats *connStats) *statsWriter {
+	return &statsWriter{bufio.NewExtendedWriter(upstream), bufio.NewVectorisedWriter(upstream), stats}
+}
+
+func (w *statsWriter) Write(p []byte) (n int, err error) {
+	n, err = w.upstream.Write(p)
+	w.stats.countWritten(int64(n))
+	return
+}
+
+func (w *statsWriter) WriteBuffer(buffer *buf.Buffer) error {
+	dataLen := buffer.Len()
+	err := w.upstream.WriteBuffer(buffer)
+	if err == nil {
+		w.stats.countWritten(int64(dataLen))
+	}
+	return err
+}
+
+func (w *statsWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	dataLen := buf.LenMulti(buffers)
+	err := w.vectorised.WriteVectorised(buffers)
+	if err == nil {
+		w.stats.countWritten(int64(dataLen))
+	}
+	return err
+}
+
+func (w *statsWriter) UnwrapWriter() (io.Writer, []N.CountFunc) {
+	return w.upstream, []N.CountFunc{w.stats.countWritten}
+}
+
+func (w *statsWriter) Upstream() any {
+	return w.upstream
+}
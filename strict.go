@@ -0,0 +1,16 @@
+package vmess
+
+var ErrStrictMode = newCategoryError(ErrAuthFailed, "rejected by strict mode")
+
+func strictModeViolation(security byte, option byte) string {
+	switch {
+	case security == SecurityTypeLegacy:
+		return "legacy security"
+	case option&RequestOptionChunkStream == 0:
+		return "missing chunk stream"
+	case option&RequestOptionChunkMasking == 0:
+		return "missing chunk masking"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,34 @@
+package vmess
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrNotTransparent = E.New("vmess: conn is not transparent")
+
+func upstreamSyscallConn(upstream net.Conn) (syscall.RawConn, error) {
+	conn, loaded := common.Cast[syscall.Conn](upstream)
+	if !loaded {
+		return nil, E.Cause(ErrNotTransparent, "upstream is not a syscall conn")
+	}
+	return conn.SyscallConn()
+}
+
+func (c *clientConn) SyscallConn() (syscall.RawConn, error) {
+	if c.reader == nil || c.writer == nil || c.writeCoalescing > 0 || c.writeAggregation > 0 || !c.transparent() {
+		return nil, ErrNotTransparent
+	}
+	return upstreamSyscallConn(c.Conn)
+}
+
+func (c *serverConn) SyscallConn() (syscall.RawConn, error) {
+	if c.writer == nil || uint64(c.earlyLen) > atomic.LoadUint64(&c.stats.bytesRead) || c.payload != nil || c.writeCoalescing > 0 || c.aggregateSize > 0 || !c.transparent() {
+		return nil, ErrNotTransparent
+	}
+	return upstreamSyscallConn(c.Conn)
+}
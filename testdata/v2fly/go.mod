@@ -0,0 +1,19 @@
+module github.com/sagernet/sing-vmess/testdata/v2fly
+
+go 1.21
+
+require (
+	github.com/v2fly/v2ray-core/v5 v5.8.0
+	golang.org/x/crypto v0.12.0
+)
+
+require (
+	github.com/adrg/xdg v0.4.0 // indirect
+	github.com/dgryski/go-metro v0.0.0-20211217172704-adc40b04c140 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3 // indirect
+	github.com/seiflotfy/cuckoofilter v0.0.0-20220411075957-e3b120b3f5fb // indirect
+	github.com/v2fly/ss-bloomring v0.0.0-20210312155135-28617310f63e // indirect
+	golang.org/x/sys v0.11.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
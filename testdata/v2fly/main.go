@@ -0,0 +1,162 @@
+//go:debug randseednop=0
+
+// Command v2fly records VMess requests sent by v2ray-core, run it with go run -tags faketime . from this directory.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/protocol"
+	"github.com/v2fly/v2ray-core/v5/proxy/vmess"
+	"github.com/v2fly/v2ray-core/v5/proxy/vmess/encoding"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// fakeTime is the clock of the faketime runtime, which never moves unless goroutines sleep.
+	fakeTime    = 1257894000
+	userID      = "b831381d-6324-4d53-ad4f-8cda48b30811"
+	destination = "example.com"
+	port        = 443
+)
+
+var requestPayload = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+type Capture struct {
+	Name        string
+	AlterID     int
+	Security    byte
+	Option      byte
+	Padding     int
+	Timestamp   int64
+	Random      string
+	Destination string
+	Payload     []byte
+	Request     []byte
+}
+
+func main() {
+	capturesPath := flag.String("captures", "../v2fly_requests.json", "write request captures to this file")
+	flag.Parse()
+	if time.Now().Unix() != fakeTime {
+		log.Fatal("clock is not fixed, build with -tags faketime")
+	}
+	var captures []Capture
+	for _, alterID := range []int{0, 4} {
+		found := make(map[int]bool)
+		for seed := 0; len(found) < 16; seed++ {
+			capture, err := captureRequest(alterID, seed)
+			common.Must(err)
+			if !found[capture.Padding] {
+				found[capture.Padding] = true
+				captures = append(captures, capture)
+			}
+		}
+	}
+	sort.SliceStable(captures, func(i, j int) bool {
+		return captures[i].AlterID < captures[j].AlterID || captures[i].AlterID == captures[j].AlterID && captures[i].Padding < captures[j].Padding
+	})
+	common.Must(writeJSON(*capturesPath, captures))
+}
+
+func writeJSON(path string, value any) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0o644)
+}
+
+type countReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.n += n
+	return
+}
+
+// seedRandom replaces crypto/rand and math/rand, which v2ray-core reads for keys, nonces, padding and timestamps.
+func seedRandom(name string, seed int64) *countReader {
+	shake := sha3.NewShake128()
+	common.Must2(shake.Write([]byte(name)))
+	random := &countReader{reader: shake}
+	rand.Reader = random
+	mrand.Seed(seed)
+	return random
+}
+
+func newUser(alterID int) *protocol.MemoryUser {
+	account, err := (&vmess.Account{Id: userID, AlterId: uint32(alterID)}).AsAccount()
+	common.Must(err)
+	return &protocol.MemoryUser{Account: account}
+}
+
+func captureRequest(alterID int, seed int) (Capture, error) {
+	mode := "aead"
+	if alterID > 0 {
+		mode = "legacy"
+	}
+	request := &protocol.RequestHeader{
+		Version:  encoding.Version,
+		User:     newUser(alterID),
+		Command:  protocol.RequestCommandTCP,
+		Option:   protocol.RequestOptionChunkStream | protocol.RequestOptionChunkMasking | protocol.RequestOptionGlobalPadding,
+		Security: protocol.SecurityType_AES128_GCM,
+		Address:  net.DomainAddress(destination),
+		Port:     port,
+	}
+	capture := Capture{
+		AlterID:     alterID,
+		Security:    byte(request.Security),
+		Option:      byte(request.Option),
+		Timestamp:   fakeTime,
+		Random:      fmt.Sprint("shake128:", mode, "-", seed),
+		Destination: fmt.Sprint(destination, ":", port),
+		Payload:     requestPayload,
+	}
+	random := seedRandom(capture.Random, int64(seed))
+	session := encoding.NewClientSession(context.Background(), alterID == 0, protocol.DefaultIDHash, 0)
+	var output bytes.Buffer
+	headerRandom := random.n
+	err := session.EncodeRequestHeader(request, &output)
+	if err != nil {
+		return Capture{}, err
+	}
+	// the padding is the only random input of a legacy header, an AEAD header adds 4 auth id and 8 nonce bytes
+	capture.Padding = random.n - headerRandom
+	if alterID == 0 {
+		capture.Padding -= 4 + 8
+	}
+	capture.Name = fmt.Sprint(mode, "-p", capture.Padding)
+	bodyWriter, err := session.EncodeRequestBody(request, &output)
+	if err != nil {
+		return Capture{}, err
+	}
+	err = bodyWriter.WriteMultiBuffer(buf.MergeBytes(nil, requestPayload))
+	if err != nil {
+		return Capture{}, err
+	}
+	err = bodyWriter.WriteMultiBuffer(buf.MultiBuffer{})
+	if err != nil {
+		return Capture{}, err
+	}
+	capture.Request = output.Bytes()
+	return capture, nil
+}
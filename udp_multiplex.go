@@ -0,0 +1,497 @@
+package vmess
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var UDPMultiplexDestination = M.Socksaddr{
+	Fqdn: "sp.udp-multiplex.sing-vmess.arpa",
+}
+
+func IsUDPMultiplexDestination(destination M.Socksaddr) bool {
+	return destination.Fqdn == UDPMultiplexDestination.Fqdn
+}
+
+var (
+	ErrUDPMultiplexUnsupported = E.New("vmess: server does not support UDP multiplexing")
+	ErrUDPMultiplexClosed      = E.New("vmess: UDP multiplex flow closed")
+)
+
+const (
+	udpMultiplexVersion     = 1
+	udpMultiplexHeaderLen   = 4 + 1
+	udpMultiplexFrameData   = 0
+	udpMultiplexFrameClose  = 1
+	udpMultiplexQueueLen    = 64
+	udpMultiplexMaxSessions = 1024
+	udpMultiplexMaxRewrites = 256
+)
+
+type udpMultiplexer struct {
+	conn        PacketConn
+	writeAccess sync.Mutex
+	access      sync.Mutex
+	flows       map[uint32]*udpMultiplexFlow
+	accept      func(flow *udpMultiplexFlow)
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+}
+
+func newUDPMultiplexer(conn PacketConn, accept func(flow *udpMultiplexFlow)) *udpMultiplexer {
+	return &udpMultiplexer{
+		conn:   conn,
+		flows:  make(map[uint32]*udpMultiplexFlow),
+		accept: accept,
+		done:   make(chan struct{}),
+	}
+}
+
+func (m *udpMultiplexer) loop() error {
+	for {
+		buffer := buf.NewPacket()
+		_, err := m.conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			m.close(err)
+			return err
+		}
+		err = m.dispatch(buffer)
+		if err != nil {
+			m.close(err)
+			return err
+		}
+	}
+}
+
+func (m *udpMultiplexer) dispatch(buffer *buf.Buffer) error {
+	if buffer.Len() < udpMultiplexHeaderLen {
+		buffer.Release()
+		return E.New("vmess: short UDP multiplex frame")
+	}
+	header := buffer.To(udpMultiplexHeaderLen)
+	sessionID := binary.BigEndian.Uint32(header)
+	frameType := header[4]
+	buffer.Advance(udpMultiplexHeaderLen)
+	switch frameType {
+	case udpMultiplexFrameClose:
+		buffer.Release()
+		m.access.Lock()
+		flow := m.flows[sessionID]
+		delete(m.flows, sessionID)
+		m.access.Unlock()
+		if flow != nil {
+			flow.closeLocal()
+		}
+		return nil
+	case udpMultiplexFrameData:
+	default:
+		buffer.Release()
+		return E.New("vmess: bad UDP multiplex frame type ", frameType)
+	}
+	addr, err := AddressSerializer.ReadAddrPort(buffer)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	addr = addr.Unwrap()
+	m.access.Lock()
+	flow, loaded := m.flows[sessionID]
+	if !loaded && m.accept != nil && len(m.flows) < udpMultiplexMaxSessions {
+		flow = newUDPMultiplexFlow(m, sessionID, addr)
+		m.flows[sessionID] = flow
+		m.access.Unlock()
+		m.accept(flow)
+	} else {
+		m.access.Unlock()
+	}
+	if flow == nil {
+		buffer.Release()
+		if m.accept != nil {
+			go m.writeClose(sessionID)
+		}
+		return nil
+	}
+	select {
+	case flow.queue <- udpMultiplexPacket{buffer, addr}:
+	default:
+		buffer.Release()
+	}
+	return nil
+}
+
+func (m *udpMultiplexer) writeFrame(sessionID uint32, buffer *buf.Buffer, destination M.Socksaddr) error {
+	headerLen := udpMultiplexHeaderLen + AddressSerializer.AddrPortLen(destination)
+	if buffer.Start() < headerLen {
+		newBuffer := buf.NewSize(headerLen + buffer.Len())
+		newBuffer.Resize(headerLen, 0)
+		common.Must1(newBuffer.Write(buffer.Bytes()))
+		buffer.Release()
+		buffer = newBuffer
+	}
+	header := buf.With(buffer.ExtendHeader(headerLen))
+	common.Must(
+		binary.Write(header, binary.BigEndian, sessionID),
+		header.WriteByte(udpMultiplexFrameData),
+		AddressSerializer.WriteAddrPort(header, destination),
+	)
+	m.writeAccess.Lock()
+	defer m.writeAccess.Unlock()
+	return m.conn.WritePacket(buffer, UDPMultiplexDestination)
+}
+
+func (m *udpMultiplexer) writeClose(sessionID uint32) error {
+	buffer := buf.NewSize(udpMultiplexHeaderLen)
+	common.Must(
+		binary.Write(buffer, binary.BigEndian, sessionID),
+		buffer.WriteByte(udpMultiplexFrameClose),
+	)
+	m.writeAccess.Lock()
+	defer m.writeAccess.Unlock()
+	return m.conn.WritePacket(buffer, UDPMultiplexDestination)
+}
+
+func (m *udpMultiplexer) open(sessionID uint32, destination M.Socksaddr) (*udpMultiplexFlow, error) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	select {
+	case <-m.done:
+		return nil, m.err
+	default:
+	}
+	flow := newUDPMultiplexFlow(m, sessionID, destination)
+	m.flows[sessionID] = flow
+	return flow, nil
+}
+
+func (m *udpMultiplexer) release(flow *udpMultiplexFlow) {
+	m.access.Lock()
+	current := m.flows[flow.sessionID]
+	if current == flow {
+		delete(m.flows, flow.sessionID)
+	}
+	m.access.Unlock()
+	if current == flow {
+		_ = m.writeClose(flow.sessionID)
+	}
+}
+
+func (m *udpMultiplexer) close(err error) {
+	m.closeOnce.Do(func() {
+		m.access.Lock()
+		m.err = E.Cause(err, "UDP multiplex closed")
+		close(m.done)
+		m.flows = make(map[uint32]*udpMultiplexFlow)
+		m.access.Unlock()
+		m.conn.Close()
+	})
+}
+
+type udpMultiplexPacket struct {
+	buffer *buf.Buffer
+	addr   M.Socksaddr
+}
+
+var _ PacketConn = (*udpMultiplexFlow)(nil)
+
+type udpMultiplexFlow struct {
+	mux         *udpMultiplexer
+	sessionID   uint32
+	destination M.Socksaddr
+	queue       chan udpMultiplexPacket
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	rewriteAccess sync.Mutex
+	rewrite       func(destination M.Socksaddr) (M.Socksaddr, error)
+	rewritten     map[M.Socksaddr]M.Socksaddr
+}
+
+func newUDPMultiplexFlow(mux *udpMultiplexer, sessionID uint32, destination M.Socksaddr) *udpMultiplexFlow {
+	return &udpMultiplexFlow{
+		mux:         mux,
+		sessionID:   sessionID,
+		destination: destination,
+		queue:       make(chan udpMultiplexPacket, udpMultiplexQueueLen),
+		done:        make(chan struct{}),
+	}
+}
+
+func (c *udpMultiplexFlow) receive() (udpMultiplexPacket, error) {
+	for {
+		select {
+		case packet := <-c.queue:
+			if c.rewrite == nil {
+				return packet, nil
+			}
+			addr, err := c.rewriteDestination(packet.addr)
+			if err != nil {
+				packet.buffer.Release()
+				continue
+			}
+			packet.addr = addr
+			return packet, nil
+		case <-c.done:
+			return udpMultiplexPacket{}, io.EOF
+		case <-c.mux.done:
+			return udpMultiplexPacket{}, c.mux.err
+		}
+	}
+}
+
+func (c *udpMultiplexFlow) rewriteDestination(destination M.Socksaddr) (M.Socksaddr, error) {
+	c.rewriteAccess.Lock()
+	defer c.rewriteAccess.Unlock()
+	if rewritten, loaded := c.rewritten[destination]; loaded {
+		return rewritten, nil
+	}
+	rewritten, err := c.rewrite(destination)
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	if c.rewritten == nil || len(c.rewritten) >= udpMultiplexMaxRewrites {
+		c.rewritten = make(map[M.Socksaddr]M.Socksaddr)
+	}
+	c.rewritten[destination] = rewritten
+	return rewritten, nil
+}
+
+func (c *udpMultiplexFlow) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	packet, err := c.receive()
+	if err != nil {
+		return
+	}
+	defer packet.buffer.Release()
+	if packet.buffer.Len() > buffer.FreeLen() {
+		return M.Socksaddr{}, io.ErrShortBuffer
+	}
+	common.Must1(buffer.Write(packet.buffer.Bytes()))
+	return packet.addr, nil
+}
+
+func (c *udpMultiplexFlow) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	packet, err := c.receive()
+	if err != nil {
+		return
+	}
+	defer packet.buffer.Release()
+	if packet.buffer.Len() > len(p) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	n = copy(p, packet.buffer.Bytes())
+	if packet.addr.IsFqdn() {
+		addr = packet.addr
+	} else {
+		addr = packet.addr.UDPAddr()
+	}
+	return
+}
+
+func (c *udpMultiplexFlow) Read(p []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(p)
+	return
+}
+
+func (c *udpMultiplexFlow) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	select {
+	case <-c.done:
+		buffer.Release()
+		return ErrUDPMultiplexClosed
+	default:
+	}
+	if !destination.IsValid() {
+		destination = c.destination
+	}
+	return c.mux.writeFrame(c.sessionID, buffer, destination)
+}
+
+func (c *udpMultiplexFlow) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buffer := buf.NewSize(udpMultiplexHeaderLen + M.MaxSocksaddrLength + len(p))
+	buffer.Resize(udpMultiplexHeaderLen+M.MaxSocksaddrLength, 0)
+	common.Must1(buffer.Write(p))
+	err = c.WritePacket(buffer, M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *udpMultiplexFlow) Write(p []byte) (n int, err error) {
+	return c.WriteTo(p, c.destination)
+}
+
+func (c *udpMultiplexFlow) closeLocal() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *udpMultiplexFlow) Close() error {
+	c.closeLocal()
+	c.mux.release(c)
+	return nil
+}
+
+func (c *udpMultiplexFlow) FrontHeadroom() int {
+	return udpMultiplexHeaderLen + M.MaxSocksaddrLength
+}
+
+func (c *udpMultiplexFlow) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+func (c *udpMultiplexFlow) RemoteAddr() net.Addr {
+	return c.destination.UDPAddr()
+}
+
+func (c *udpMultiplexFlow) SetDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *udpMultiplexFlow) SetReadDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *udpMultiplexFlow) SetWriteDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *udpMultiplexFlow) NeedAdditionalReadDeadline() bool {
+	return true
+}
+
+func (c *udpMultiplexFlow) Upstream() any {
+	return c.mux.conn
+}
+
+type UDPMultiplexConn struct {
+	mux           *udpMultiplexer
+	access        sync.Mutex
+	nextSessionID uint32
+}
+
+func (c *Client) DialUDPMultiplexConn(upstream net.Conn) (*UDPMultiplexConn, error) {
+	return c.DialUDPMultiplexConnContext(context.Background(), upstream)
+}
+
+func (c *Client) DialUDPMultiplexConnContext(ctx context.Context, upstream net.Conn) (*UDPMultiplexConn, error) {
+	conn, err := c.DialPacketConnContext(ctx, upstream, UDPMultiplexDestination)
+	if err != nil {
+		return nil, err
+	}
+	err = handshakeContext(ctx, upstream, nil, func() error {
+		buffer := buf.NewPacket()
+		defer buffer.Release()
+		_, err := conn.ReadPacket(buffer)
+		if err != nil {
+			return E.Cause(ErrUDPMultiplexUnsupported, err)
+		}
+		if buffer.Len() != 1 || buffer.Byte(0) != udpMultiplexVersion {
+			return ErrUDPMultiplexUnsupported
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	multiplexConn := &UDPMultiplexConn{mux: newUDPMultiplexer(conn, nil)}
+	go multiplexConn.mux.loop()
+	return multiplexConn, nil
+}
+
+// ListenPacket opens a new flow whose packets go to destination unless WritePacket is given another one.
+func (c *UDPMultiplexConn) ListenPacket(destination M.Socksaddr) (PacketConn, error) {
+	c.access.Lock()
+	c.nextSessionID++
+	sessionID := c.nextSessionID
+	c.access.Unlock()
+	return c.mux.open(sessionID, destination)
+}
+
+func (c *UDPMultiplexConn) Close() error {
+	c.mux.close(net.ErrClosed)
+	return nil
+}
+
+func (c *UDPMultiplexConn) Upstream() any {
+	return c.mux.conn
+}
+
+func (s *Service[U]) isUDPMultiplex(command byte, destination M.Socksaddr) bool {
+	return s.udpMultiplex && command == CommandUDP && IsUDPMultiplexDestination(destination)
+}
+
+func (s *Service[U]) newUDPMultiplexConnection(ctx context.Context, conn PacketConn, metadata M.Metadata, session SessionInfo[U]) error {
+	hello := buf.NewSize(1)
+	common.Must(hello.WriteByte(udpMultiplexVersion))
+	err := conn.WritePacket(hello, UDPMultiplexDestination)
+	if err != nil {
+		return E.Cause(err, "write UDP multiplex version")
+	}
+	mux := newUDPMultiplexer(conn, func(flow *udpMultiplexFlow) {
+		flow.rewrite = s.udpMultiplexRewrite(ctx, session)
+		go func() {
+			err := s.newUDPMultiplexFlow(ctx, flow, metadata)
+			flow.Close()
+			if err != nil && !E.IsClosedOrCanceled(err) {
+				s.handler.NewError(ctx, err)
+			}
+		}()
+	})
+	err = mux.loop()
+	if E.IsClosed(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Service[U]) newUDPMultiplexFlow(ctx context.Context, flow *udpMultiplexFlow, metadata M.Metadata) error {
+	if flow.rewrite != nil {
+		destination, err := flow.rewriteDestination(flow.destination)
+		if err != nil {
+			return err
+		}
+		flow.destination = destination
+	}
+	metadata.Destination = flow.destination
+	return s.handler.NewPacketConnection(ctx, flow, metadata)
+}
+
+func (s *Service[U]) udpMultiplexRewrite(ctx context.Context, session SessionInfo[U]) func(destination M.Socksaddr) (M.Socksaddr, error) {
+	if s.rewrite == nil && s.udpResolver == nil {
+		return nil
+	}
+	session.Command = CommandUDP
+	return func(destination M.Socksaddr) (M.Socksaddr, error) {
+		session := session
+		session.Destination = destination
+		if s.rewrite != nil {
+			var err error
+			destination, err = s.rewriteDestination(session)
+			if err != nil {
+				return M.Socksaddr{}, err
+			}
+			session.Destination = destination
+		}
+		if s.udpResolver != nil && destination.IsFqdn() {
+			var err error
+			destination, _, err = s.resolveUDPDestination(ctx, session, destination)
+			if err != nil {
+				return M.Socksaddr{}, err
+			}
+		}
+		return destination, nil
+	}
+}
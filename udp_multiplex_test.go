@@ -0,0 +1,162 @@
+package vmess
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type packetEchoHandler struct {
+	echoHandler
+}
+
+func (h *packetEchoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer conn.Close()
+	for {
+		buffer := buf.NewSize(2 * MaxPacketChunkSize)
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+		err = conn.WritePacket(buffer, destination)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestUDPMultiplex(t *testing.T) {
+	service := newTestService(t, &packetEchoHandler{}, ServiceWithUDPMultiplex())
+	destinations := []M.Socksaddr{
+		M.ParseSocksaddr("1.1.1.1:53"),
+		M.ParseSocksaddr("[2606:4700:4700::1111]:53"),
+		M.ParseSocksaddr("example.com:443"),
+	}
+	for _, security := range []string{"aes-128-gcm", "chacha20-poly1305", "none", "zero"} {
+		client, err := NewClient(testUserID, security, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream, _ := serveTestConn(service)
+		conn, err := client.DialUDPMultiplexConn(upstream)
+		if err != nil {
+			t.Fatal(security, ": ", err)
+		}
+		flows := make([]PacketConn, len(destinations))
+		for i, destination := range destinations {
+			flows[i], err = conn.ListenPacket(destination)
+			if err != nil {
+				t.Fatal(security, ": ", err)
+			}
+		}
+		for i, flow := range flows {
+			payload := []byte{byte(i)}
+			err = flow.WritePacket(buf.As(payload), destinations[i])
+			if err != nil {
+				t.Fatal(security, ": ", err)
+			}
+			echoed := destinations[(i+1)%len(destinations)]
+			err = flow.WritePacket(buf.As(payload), echoed)
+			if err != nil {
+				t.Fatal(security, ": ", err)
+			}
+			for _, expected := range []M.Socksaddr{destinations[i], echoed} {
+				buffer := buf.New()
+				destination, err := flow.ReadPacket(buffer)
+				if err != nil {
+					t.Fatal(security, ": ", err)
+				}
+				if destination != expected || buffer.Len() != 1 || buffer.Byte(0) != byte(i) {
+					t.Fatal(security, ": flow ", i, " got ", buffer.Bytes(), " from ", destination, ", expected ", expected)
+				}
+				buffer.Release()
+			}
+		}
+		flows[0].Close()
+		_, err = flows[0].ReadPacket(buf.New())
+		if err == nil {
+			t.Fatal(security, ": read from a closed flow")
+		}
+		err = flows[1].WritePacket(buf.As([]byte{1}), destinations[1])
+		if err != nil {
+			t.Fatal(security, ": other flow closed with the first one: ", err)
+		}
+		_, err = flows[1].ReadPacket(buf.New())
+		if err != nil {
+			t.Fatal(security, ": other flow closed with the first one: ", err)
+		}
+		conn.Close()
+		_, err = flows[1].ReadPacket(buf.New())
+		if err == nil {
+			t.Fatal(security, ": read from a flow of a closed stream")
+		}
+	}
+}
+
+func TestUDPMultiplexUnsupported(t *testing.T) {
+	service := newTestService(t, &packetEchoHandler{})
+	client := newTestClient(t, testUserID)
+	upstream, _ := serveTestConn(service)
+	defer upstream.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := client.DialUDPMultiplexConnContext(ctx, upstream)
+	if err == nil {
+		t.Fatal("dial succeeded without server support")
+	}
+}
+
+func TestUDPMultiplexRewrite(t *testing.T) {
+	blocked := M.ParseSocksaddr("1.1.1.1:53")
+	rewritten := M.ParseSocksaddr("9.9.9.9:53")
+	service := newTestService(t, &packetEchoHandler{}, ServiceWithUDPMultiplex())
+	service.SetRewriteHandler(func(session SessionInfo[int]) (M.Socksaddr, error) {
+		if session.Command != CommandUDP {
+			t.Error("unexpected command ", session.Command)
+		}
+		if session.Destination == blocked {
+			return M.Socksaddr{}, E.New("blocked")
+		}
+		return session.Destination, nil
+	})
+	service.SetUDPResolver(func(ctx context.Context, session SessionInfo[int], domain string) ([]netip.Addr, error) {
+		return []netip.Addr{rewritten.Addr}, nil
+	})
+	upstream, _ := serveTestConn(service)
+	conn, err := newTestClient(t, testUserID).DialUDPMultiplexConn(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	flow, err := conn.ListenPacket(M.ParseSocksaddr("dns.example:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range []struct {
+		payload     byte
+		destination M.Socksaddr
+	}{{1, M.Socksaddr{}}, {2, blocked}, {3, M.Socksaddr{}}} {
+		err = flow.WritePacket(buf.As([]byte{packet.payload}), packet.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []byte{1, 3} {
+		buffer := buf.New()
+		destination, err := flow.ReadPacket(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if destination != rewritten || buffer.Len() != 1 || buffer.Byte(0) != expected {
+			t.Fatal("got ", buffer.Bytes(), " from ", destination, ", expected ", []byte{expected}, " from ", rewritten)
+		}
+		buffer.Release()
+	}
+}
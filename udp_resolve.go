@@ -0,0 +1,31 @@
+package vmess
+
+import (
+	"context"
+	"net/netip"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// UDPResolver resolves the domain of a UDP request before the packet conn reaches the handler.
+type UDPResolver[U comparable] func(ctx context.Context, session SessionInfo[U], domain string) ([]netip.Addr, error)
+
+func (s *Service[U]) SetUDPResolver(resolver UDPResolver[U]) {
+	s.udpResolver = resolver
+}
+
+func (s *Service[U]) resolveUDPDestination(ctx context.Context, session SessionInfo[U], destination M.Socksaddr) (M.Socksaddr, []netip.Addr, error) {
+	addresses, err := s.udpResolver(ctx, session, destination.Fqdn)
+	if err != nil {
+		return M.Socksaddr{}, nil, E.Cause(err, "resolve ", destination.Fqdn)
+	}
+	if len(addresses) == 0 {
+		return M.Socksaddr{}, nil, E.New("resolve ", destination.Fqdn, ": empty result")
+	}
+	return M.SocksaddrFrom(addresses[0], destination.Port), addresses, nil
+}
+
+func (c *serverPacketConn) ResolvedAddresses() []netip.Addr {
+	return c.addresses
+}
@@ -0,0 +1,136 @@
+package vmess
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type udpSessionKey[U comparable] struct {
+	user        U
+	source      M.Socksaddr
+	destination M.Socksaddr
+}
+
+type udpSessionTable[U comparable] struct {
+	access       sync.Mutex
+	idleTimeout  time.Duration
+	maxSessions  int
+	sessions     map[udpSessionKey[U]]*udpSession[U]
+	userSessions map[U][]*udpSession[U]
+}
+
+type udpSession[U comparable] struct {
+	udpActivity
+	table   *udpSessionTable[U]
+	key     udpSessionKey[U]
+	conn    net.Conn
+	timer   *time.Timer
+	removed bool
+}
+
+type udpActivity struct {
+	lastActive int64
+}
+
+func (a *udpActivity) touch() {
+	if a == nil {
+		return
+	}
+	atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+}
+
+func newUDPSessionTable[U comparable](idleTimeout time.Duration, maxSessions int) *udpSessionTable[U] {
+	return &udpSessionTable[U]{
+		idleTimeout:  idleTimeout,
+		maxSessions:  maxSessions,
+		sessions:     make(map[udpSessionKey[U]]*udpSession[U]),
+		userSessions: make(map[U][]*udpSession[U]),
+	}
+}
+
+func (t *udpSessionTable[U]) open(key udpSessionKey[U], conn net.Conn) *udpSession[U] {
+	session := &udpSession[U]{
+		udpActivity: udpActivity{time.Now().UnixNano()},
+		table:       t,
+		key:         key,
+		conn:        conn,
+	}
+	var evicted []*udpSession[U]
+	t.access.Lock()
+	// a client reusing its source mapping means the previous stream was abandoned
+	if key.source.IsValid() {
+		if previous, loaded := t.sessions[key]; loaded {
+			t.remove(previous)
+			evicted = append(evicted, previous)
+		}
+		t.sessions[key] = session
+	}
+	if t.maxSessions > 0 {
+		for len(t.userSessions[key.user]) >= t.maxSessions {
+			oldest := t.userSessions[key.user][0]
+			t.remove(oldest)
+			evicted = append(evicted, oldest)
+		}
+	}
+	t.userSessions[key.user] = append(t.userSessions[key.user], session)
+	if t.idleTimeout > 0 {
+		session.timer = time.AfterFunc(t.idleTimeout, session.checkIdle)
+	}
+	t.access.Unlock()
+	for _, it := range evicted {
+		it.conn.Close()
+	}
+	return session
+}
+
+func (t *udpSessionTable[U]) release(session *udpSession[U]) {
+	t.access.Lock()
+	t.remove(session)
+	t.access.Unlock()
+}
+
+func (t *udpSessionTable[U]) remove(session *udpSession[U]) {
+	if session.removed {
+		return
+	}
+	session.removed = true
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	userSessions := t.userSessions[session.key.user]
+	for i, it := range userSessions {
+		if it == session {
+			userSessions = append(userSessions[:i], userSessions[i+1:]...)
+			break
+		}
+	}
+	if len(userSessions) == 0 {
+		delete(t.userSessions, session.key.user)
+	} else {
+		t.userSessions[session.key.user] = userSessions
+	}
+}
+
+func (s *udpSession[U]) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+	s.table.access.Lock()
+	if s.removed {
+		s.table.access.Unlock()
+		return
+	}
+	if idle < s.table.idleTimeout {
+		s.timer.Reset(s.table.idleTimeout - idle)
+		s.table.access.Unlock()
+		return
+	}
+	s.table.remove(s)
+	s.table.access.Unlock()
+	s.conn.Close()
+}
@@ -0,0 +1,36 @@
+package vmess
+
+import (
+	"context"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/uot"
+)
+
+func isUoTDestination(destination M.Socksaddr) bool {
+	return destination.Fqdn == uot.MagicAddress || destination.Fqdn == uot.LegacyMagicAddress
+}
+
+func (s *Service[U]) newUoTConnection(ctx context.Context, conn *serverConn, metadata M.Metadata, session SessionInfo[U]) error {
+	var request uot.Request
+	if metadata.Destination.Fqdn == uot.MagicAddress {
+		uotRequest, err := uot.ReadRequest(conn)
+		if err != nil {
+			return E.Cause(err, "read UoT request")
+		}
+		request = *uotRequest
+	}
+	if s.rewrite != nil && request.Destination.IsValid() {
+		session.Command = CommandUDP
+		session.Destination = request.Destination
+		destination, err := s.rewriteDestination(session)
+		if err != nil {
+			return err
+		}
+		request.Destination = destination
+	}
+	conn.destination = request.Destination
+	metadata.Destination = request.Destination
+	return s.handler.NewPacketConnection(ctx, uot.NewConn(conn, request), metadata)
+}
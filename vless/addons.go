@@ -0,0 +1,74 @@
+package vless
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const addonsFieldFlow = 1
+
+var ErrAddonsTooLarge = E.New("vless addons too large")
+
+func addonsLen(flow string) int {
+	if flow == "" {
+		return 0
+	}
+	return 1 + uvarintLen(uint64(len(flow))) + len(flow)
+}
+
+func writeAddons(buffer *buf.Buffer, flow string) {
+	length := addonsLen(flow)
+	common.Must(buffer.WriteByte(byte(length)))
+	if length == 0 {
+		return
+	}
+	common.Must(buffer.WriteByte(addonsFieldFlow<<3 | 2))
+	binary.PutUvarint(buffer.Extend(uvarintLen(uint64(len(flow)))), uint64(len(flow)))
+	common.Must1(buffer.WriteString(flow))
+}
+
+func readAddons(addons []byte) (flow string, err error) {
+	for len(addons) > 0 {
+		tag, n := binary.Uvarint(addons)
+		if n <= 0 {
+			return "", E.New("bad addons field tag")
+		}
+		addons = addons[n:]
+		var value []byte
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(addons)
+			if n <= 0 {
+				return "", E.New("bad addons varint")
+			}
+			addons = addons[n:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(addons)
+			if n <= 0 || length > uint64(len(addons)-n) {
+				return "", E.Extend(io.ErrUnexpectedEOF, "addons field ", tag>>3)
+			}
+			value = addons[n : n+int(length)]
+			addons = addons[n+int(length):]
+		default:
+			return "", E.New("unsupported addons wire type: ", tag&7)
+		}
+		if tag>>3 == addonsFieldFlow {
+			flow = string(value)
+		}
+	}
+	return
+}
+
+func uvarintLen(value uint64) int {
+	n := 1
+	for value >= 0x80 {
+		value >>= 7
+		n++
+	}
+	return n
+}
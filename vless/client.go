@@ -78,7 +78,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 
 func (c *Conn) Write(b []byte) (n int, err error) {
 	if !c.requestWritten {
-		err = WriteRequest(c.Conn, Request{c.key, c.command, c.destination}, b)
+		err = WriteRequest(c.Conn, Request{UUID: c.key, Command: c.command, Destination: c.destination}, b)
 		if err == nil {
 			n = len(b)
 		}
@@ -121,7 +121,7 @@ func (c *PacketConn) Read(b []byte) (n int, err error) {
 
 func (c *PacketConn) Write(b []byte) (n int, err error) {
 	if !c.requestWritten {
-		err = WritePacketRequest(c.Conn, Request{c.key, vmess.CommandUDP, c.destination}, b)
+		err = WritePacketRequest(c.Conn, Request{UUID: c.key, Command: vmess.CommandUDP, Destination: c.destination}, b)
 		if err == nil {
 			n = len(b)
 		}
@@ -140,7 +140,7 @@ func (c *PacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) er
 	dataLen := buffer.Len()
 	binary.BigEndian.PutUint16(buffer.ExtendHeader(2), uint16(dataLen))
 	if !c.requestWritten {
-		err := WritePacketRequest(c.Conn, Request{c.key, vmess.CommandUDP, c.destination}, buffer.Bytes())
+		err := WritePacketRequest(c.Conn, Request{UUID: c.key, Command: vmess.CommandUDP, Destination: c.destination}, buffer.Bytes())
 		c.requestWritten = true
 		return err
 	}
@@ -18,14 +18,69 @@ type Request struct {
 	UUID        []byte
 	Command     byte
 	Destination M.Socksaddr
+	Flow        string
+}
+
+func ReadRequest(reader io.Reader) (*Request, error) {
+	var request Request
+
+	version, err := rw.ReadByte(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, E.New("unknown version: ", version)
+	}
+
+	request.UUID = make([]byte, 16)
+	_, err = io.ReadFull(reader, request.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	protobufLength, err := rw.ReadByte(reader)
+	if err != nil {
+		return nil, err
+	}
+	if protobufLength > 0 {
+		addons := make([]byte, protobufLength)
+		_, err = io.ReadFull(reader, addons)
+		if err != nil {
+			return nil, err
+		}
+		request.Flow, err = readAddons(addons)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request.Command, err = rw.ReadByte(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch request.Command {
+	case vmess.CommandTCP, vmess.CommandUDP:
+		request.Destination, err = vmess.AddressSerializer.ReadAddrPort(reader)
+		if err != nil {
+			return nil, err
+		}
+	case vmess.CommandMux:
+	default:
+		return nil, E.New("unknown command: ", request.Command)
+	}
+	return &request, nil
 }
 
 func WriteRequest(writer io.Writer, request Request, payload []byte) error {
+	if addonsLen(request.Flow) > 255 {
+		return E.Extend(ErrAddonsTooLarge, "flow ", request.Flow)
+	}
 	var requestLen int
 	requestLen += 1  // version
 	requestLen += 16 // uuid
 	requestLen += 1  // protobuf length
 	requestLen += 1  // command
+	requestLen += addonsLen(request.Flow)
 	if request.Command != vmess.CommandMux {
 		requestLen += vmess.AddressSerializer.AddrPortLen(request.Destination)
 	}
@@ -35,9 +90,9 @@ func WriteRequest(writer io.Writer, request Request, payload []byte) error {
 	common.Must(
 		buffer.WriteByte(Version),
 		common.Error(buffer.Write(request.UUID)),
-		buffer.WriteByte(0),
-		buffer.WriteByte(request.Command),
 	)
+	writeAddons(buffer, request.Flow)
+	common.Must(buffer.WriteByte(request.Command))
 
 	if request.Command != vmess.CommandMux {
 		common.Must(vmess.AddressSerializer.WriteAddrPort(buffer, request.Destination))
@@ -48,11 +103,15 @@ func WriteRequest(writer io.Writer, request Request, payload []byte) error {
 }
 
 func WritePacketRequest(writer io.Writer, request Request, payload []byte) error {
+	if addonsLen(request.Flow) > 255 {
+		return E.Extend(ErrAddonsTooLarge, "flow ", request.Flow)
+	}
 	var requestLen int
 	requestLen += 1  // version
 	requestLen += 16 // uuid
 	requestLen += 1  // protobuf length
 	requestLen += 1  // command
+	requestLen += addonsLen(request.Flow)
 	requestLen += vmess.AddressSerializer.AddrPortLen(request.Destination)
 	if len(payload) > 0 {
 		requestLen += 2
@@ -63,12 +122,18 @@ func WritePacketRequest(writer io.Writer, request Request, payload []byte) error
 	common.Must(
 		buffer.WriteByte(Version),
 		common.Error(buffer.Write(request.UUID)),
-		buffer.WriteByte(0),
+	)
+	writeAddons(buffer, request.Flow)
+	common.Must(
 		buffer.WriteByte(vmess.CommandUDP),
 		vmess.AddressSerializer.WriteAddrPort(buffer, request.Destination),
-		binary.Write(buffer, binary.BigEndian, uint16(len(payload))),
-		common.Error(buffer.Write(payload)),
 	)
+	if len(payload) > 0 {
+		common.Must(
+			binary.Write(buffer, binary.BigEndian, uint16(len(payload))),
+			common.Error(buffer.Write(payload)),
+		)
+	}
 	return common.Error(writer.Write(buffer.Bytes()))
 }
 
@@ -92,3 +157,14 @@ func ReadResponse(reader io.Reader) error {
 	}
 	return nil
 }
+
+func WriteResponse(writer io.Writer, payload []byte) error {
+	buffer := buf.NewSize(2 + len(payload))
+	defer buffer.Release()
+	common.Must(
+		buffer.WriteByte(Version),
+		buffer.WriteByte(0),
+		common.Error(buffer.Write(payload)),
+	)
+	return common.Error(writer.Write(buffer.Bytes()))
+}
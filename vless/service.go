@@ -0,0 +1,152 @@
+package vless
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sagernet/sing-vmess"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var (
+	ErrUnknownUser     = E.New("vless: unknown user")
+	ErrUnsupportedFlow = E.New("vless: unsupported flow")
+)
+
+type Service[U comparable] struct {
+	access  sync.RWMutex
+	userMap map[[16]byte]U
+	handler vmess.Handler
+}
+
+func NewService[U comparable](handler vmess.Handler) *Service[U] {
+	return &Service[U]{
+		userMap: make(map[[16]byte]U),
+		handler: handler,
+	}
+}
+
+func (s *Service[U]) UpdateUsers(userList []U, userUUIDList []string) {
+	userMap := make(map[[16]byte]U, len(userList))
+	for i, userId := range userUUIDList {
+		userUUID := uuid.FromStringOrNil(userId)
+		if userUUID == uuid.Nil {
+			userUUID = uuid.NewV5(userUUID, userId)
+		}
+		userMap[userUUID] = userList[i]
+	}
+	s.access.Lock()
+	s.userMap = userMap
+	s.access.Unlock()
+}
+
+func (s *Service[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	request, err := ReadRequest(conn)
+	if err != nil {
+		return E.Cause(err, "read vless request")
+	}
+	var userUUID [16]byte
+	copy(userUUID[:], request.UUID)
+	s.access.RLock()
+	user, loaded := s.userMap[userUUID]
+	s.access.RUnlock()
+	if !loaded {
+		return E.Extend(ErrUnknownUser, uuid.UUID(userUUID))
+	}
+	if request.Flow != "" {
+		return E.Extend(ErrUnsupportedFlow, request.Flow)
+	}
+	ctx = auth.ContextWithUser(ctx, user)
+	metadata.Protocol = "vless"
+	metadata.Destination = request.Destination
+
+	switch request.Command {
+	case vmess.CommandTCP:
+		return s.handler.NewConnection(ctx, &serverConn{Conn: conn}, metadata)
+	case vmess.CommandUDP:
+		return s.handler.NewPacketConnection(ctx, &serverPacketConn{serverConn: serverConn{Conn: conn}, destination: request.Destination}, metadata)
+	default:
+		metadata.Destination = vmess.MuxDestination
+		return vmess.HandleMuxConnection(ctx, &serverConn{Conn: conn}, s.handler)
+	}
+}
+
+type serverConn struct {
+	net.Conn
+	access          sync.Mutex
+	responseWritten bool
+}
+
+func (c *serverConn) Write(b []byte) (n int, err error) {
+	c.access.Lock()
+	if c.responseWritten {
+		c.access.Unlock()
+		return c.Conn.Write(b)
+	}
+	err = WriteResponse(c.Conn, b)
+	c.responseWritten = true
+	c.access.Unlock()
+	if err == nil {
+		n = len(b)
+	}
+	return
+}
+
+func (c *serverConn) Upstream() any {
+	return c.Conn
+}
+
+var _ N.PacketConn = (*serverPacketConn)(nil)
+
+type serverPacketConn struct {
+	serverConn
+	destination M.Socksaddr
+}
+
+func (c *serverPacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	var length uint16
+	err = binary.Read(c.Conn, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	if buffer.FreeLen() < int(length) {
+		return M.Socksaddr{}, io.ErrShortBuffer
+	}
+	_, err = buffer.ReadFullFrom(c.Conn, int(length))
+	if err != nil {
+		return
+	}
+	destination = c.destination
+	return
+}
+
+func (c *serverPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	dataLen := buffer.Len()
+	if dataLen > 65535 {
+		return E.Extend(io.ErrShortWrite, "vless packet too large: ", dataLen)
+	}
+	if buffer.Start() < 2 {
+		packet := buf.NewSize(2 + dataLen)
+		defer packet.Release()
+		binary.BigEndian.PutUint16(packet.Extend(2), uint16(dataLen))
+		common.Must1(packet.Write(buffer.Bytes()))
+		return common.Error(c.serverConn.Write(packet.Bytes()))
+	}
+	binary.BigEndian.PutUint16(buffer.ExtendHeader(2), uint16(dataLen))
+	return common.Error(c.serverConn.Write(buffer.Bytes()))
+}
+
+func (c *serverPacketConn) FrontHeadroom() int {
+	return 2
+}
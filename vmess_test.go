@@ -0,0 +1,62 @@
+package vmess
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const testUserID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+type echoHandler struct{}
+
+func (h *echoHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	defer conn.Close()
+	_, err := bufio.Copy(conn, conn)
+	return err
+}
+
+func (h *echoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return conn.Close()
+}
+
+func (h *echoHandler) NewError(ctx context.Context, err error) {
+}
+
+func newTestService(t *testing.T, handler Handler, options ...ServiceOption) *Service[int] {
+	service := NewService[int](handler, options...)
+	err := service.UpdateUsers([]int{1}, []string{testUserID}, []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		service.Close()
+	})
+	return service
+}
+
+func newTestClient(t *testing.T, userID string, options ...ClientOption) *Client {
+	client, err := NewClient(userID, "aes-128-gcm", 0, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func serveTestConn(service *Service[int]) (net.Conn, <-chan error) {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		serverConn.Close()
+	}()
+	return clientConn, done
+}
@@ -0,0 +1,223 @@
+//go:build ignore
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sagernet/sing-vmess"
+	"github.com/sagernet/sing-vmess/vmesstest"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/rw"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	userID      = "b831381d-6324-4d53-ad4f-8cda48b30811"
+	timestamp   = 1700000000
+	destination = "example.com:443"
+)
+
+var (
+	requestPayload  = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	responsePayload = []byte("HTTP/1.1 204 No Content\r\n\r\n")
+)
+
+func main() {
+	var vectors []vmesstest.Vector
+	for _, security := range []string{"aes-128-gcm", "chacha20-poly1305", "none", "zero", "aes-128-cfb"} {
+		for _, alterID := range []int{0, 4} {
+			for flags := 0; flags < 8; flags++ {
+				if security == "aes-128-cfb" && flags&4 != 0 {
+					continue
+				}
+				vector := vmesstest.Vector{
+					UserID:              userID,
+					AlterID:             alterID,
+					Security:            security,
+					DisableChunkMasking: flags&1 != 0,
+					GlobalPadding:       flags&2 != 0,
+					AuthenticatedLength: flags&4 != 0,
+					Timestamp:           timestamp,
+					Destination:         destination,
+					RequestPayload:      requestPayload,
+					ResponsePayload:     responsePayload,
+				}
+				vector.Name = vectorName(vector)
+				vector.Random = "shake128:" + vector.Name
+				common.Must(generate(&vector))
+				vectors = append(vectors, vector)
+			}
+		}
+	}
+	content, err := json.MarshalIndent(vectors, "", "  ")
+	common.Must(err)
+	common.Must(os.WriteFile("vectors.json", append(content, '\n'), 0o644))
+}
+
+func vectorName(vector vmesstest.Vector) string {
+	name := vector.Security
+	if vector.AlterID > 0 {
+		name += "-legacy"
+	}
+	if vector.DisableChunkMasking {
+		name += "-nomask"
+	}
+	if vector.GlobalPadding {
+		name += "-padding"
+	}
+	if vector.AuthenticatedLength {
+		name += "-authlen"
+	}
+	return name
+}
+
+func generate(vector *vmesstest.Vector) error {
+	random := sha3.NewShake128()
+	common.Must1(random.Write([]byte(vector.Name)))
+	timeFunc := func() time.Time {
+		return time.Unix(vector.Timestamp, 0)
+	}
+	client, err := vmess.NewClient(vector.UserID, vector.Security, vector.AlterID,
+		vmess.ClientWithRandom(random),
+		vmess.ClientWithTimeFunc(timeFunc),
+		vmess.ClientWithChunkMasking(!vector.DisableChunkMasking),
+		vmess.ClientWithGlobalPaddingEnabled(vector.GlobalPadding),
+		vmess.ClientWithAuthenticatedLengthEnabled(vector.AuthenticatedLength),
+	)
+	if err != nil {
+		return err
+	}
+	requestConn := &recordConn{}
+	conn, err := client.DialConn(requestConn, M.ParseSocksaddr(vector.Destination))
+	if err != nil {
+		return err
+	}
+	vector.RequestHeader = append([]byte(nil), requestConn.written.Bytes()...)
+	requestConn.written.Reset()
+	_, err = conn.Write(vector.RequestPayload)
+	if err != nil {
+		return err
+	}
+	err = rw.CloseWrite(conn)
+	if err != nil {
+		return err
+	}
+	vector.RequestChunks = append([]byte(nil), requestConn.written.Bytes()...)
+
+	handler := &responseHandler{vector: vector}
+	service := vmess.NewService[int](handler, vmess.ServiceWithTimeFunc(timeFunc), vmess.ServiceWithLegacyHeader())
+	err = service.UpdateUsers([]int{0}, []string{vector.UserID}, []int{vector.AlterID})
+	if err != nil {
+		return err
+	}
+	common.Must(service.Start())
+	defer service.Close()
+	responseConn := &recordConn{reader: bytes.NewReader(vector.Request())}
+	handler.conn = responseConn
+	err = service.NewConnection(context.Background(), responseConn, M.Metadata{})
+	if err != nil {
+		return err
+	}
+	vector.ResponseChunks = append([]byte(nil), responseConn.written.Bytes()...)
+
+	requestConn.reader = bytes.NewReader(vector.Response())
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(response, vector.ResponsePayload) {
+		return E.New("response mismatch in ", vector.Name)
+	}
+	return nil
+}
+
+type responseHandler struct {
+	vector *vmesstest.Vector
+	conn   *recordConn
+}
+
+func (h *responseHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination.String() != h.vector.Destination {
+		return E.New("destination mismatch: ", metadata.Destination)
+	}
+	request, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(request, h.vector.RequestPayload) {
+		return E.New("request mismatch")
+	}
+	err = conn.(interface{ HandshakeSuccess() error }).HandshakeSuccess()
+	if err != nil {
+		return err
+	}
+	h.vector.ResponseHeader = append([]byte(nil), h.conn.written.Bytes()...)
+	h.conn.written.Reset()
+	_, err = conn.Write(h.vector.ResponsePayload)
+	if err != nil {
+		return err
+	}
+	return rw.CloseWrite(conn)
+}
+
+func (h *responseHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return os.ErrInvalid
+}
+
+func (h *responseHandler) NewError(ctx context.Context, err error) {
+}
+
+type recordConn struct {
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func (c *recordConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(p)
+}
+
+func (c *recordConn) Write(p []byte) (n int, err error) {
+	return c.written.Write(p)
+}
+
+func (c *recordConn) CloseWrite() error {
+	return nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func (c *recordConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *recordConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *recordConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *recordConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
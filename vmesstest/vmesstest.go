@@ -0,0 +1,63 @@
+package vmesstest
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+)
+
+//go:generate go run generate.go
+
+// Vector is a complete TCP exchange with fixed input, generated from this module with go generate.
+type Vector struct {
+	Name                string
+	UserID              string
+	AlterID             int
+	Security            string
+	DisableChunkMasking bool
+	GlobalPadding       bool
+	AuthenticatedLength bool
+	Timestamp           int64
+	Random              string
+	Destination         string
+	RequestPayload      []byte
+	ResponsePayload     []byte
+	RequestHeader       []byte
+	RequestChunks       []byte
+	ResponseHeader      []byte
+	ResponseChunks      []byte
+}
+
+func (v Vector) Request() []byte {
+	return append(append([]byte(nil), v.RequestHeader...), v.RequestChunks...)
+}
+
+func (v Vector) Response() []byte {
+	return append(append([]byte(nil), v.ResponseHeader...), v.ResponseChunks...)
+}
+
+//go:embed vectors.json
+var vectorsJSON []byte
+
+var (
+	vectorsOnce sync.Once
+	vectors     []Vector
+)
+
+func Vectors() []Vector {
+	vectorsOnce.Do(func() {
+		common.Must(json.Unmarshal(vectorsJSON, &vectors))
+	})
+	return append([]Vector(nil), vectors...)
+}
+
+func Find(name string) (Vector, bool) {
+	for _, vector := range Vectors() {
+		if vector.Name == name {
+			return vector, true
+		}
+	}
+	return Vector{}, false
+}
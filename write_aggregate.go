@@ -0,0 +1,185 @@
+package vmess
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	DefaultWriteAggregationSize = 256 * 1024
+	aggregateBufferPoolSize     = 32
+)
+
+func writeAggregationSize(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	pageSize := os.Getpagesize()
+	return (size + pageSize - 1) / pageSize * pageSize
+}
+
+type aggregateBufferPool struct {
+	size int
+	free chan []byte
+}
+
+var aggregateBufferPools sync.Map
+
+func loadAggregateBufferPool(size int) *aggregateBufferPool {
+	if pool, loaded := aggregateBufferPools.Load(size); loaded {
+		return pool.(*aggregateBufferPool)
+	}
+	pool, _ := aggregateBufferPools.LoadOrStore(size, &aggregateBufferPool{
+		size: size,
+		free: make(chan []byte, aggregateBufferPoolSize),
+	})
+	return pool.(*aggregateBufferPool)
+}
+
+func (p *aggregateBufferPool) get() []byte {
+	select {
+	case buffer := <-p.free:
+		return buffer
+	default:
+		return allocAggregateBuffer(p.size)
+	}
+}
+
+func (p *aggregateBufferPool) put(buffer []byte) {
+	select {
+	case p.free <- buffer[:0]:
+	default:
+		freeAggregateBuffer(buffer)
+	}
+}
+
+type aggregateWriter struct {
+	upstream   N.ExtendedWriter
+	vectorised N.VectorisedWriter
+	pool       *aggregateBufferPool
+	batchLock  sync.Mutex
+	access     sync.Mutex
+	batching   bool
+	buffer     []byte
+}
+
+func newAggregateWriter(upstream io.Writer, size int) *aggregateWriter {
+	return &aggregateWriter{
+		upstream:   bufio.NewExtendedWriter(upstream),
+		vectorised: bufio.NewVectorisedWriter(upstream),
+		pool:       loadAggregateBufferPool(size),
+	}
+}
+
+func (w *aggregateWriter) write(writer N.ExtendedWriter, p []byte) (n int, err error) {
+	if w == nil {
+		return writer.Write(p)
+	}
+	w.begin()
+	n, err = writer.Write(p)
+	return n, common.AnyError(err, w.end())
+}
+
+func (w *aggregateWriter) writeBuffer(writer N.ExtendedWriter, buffer *buf.Buffer) error {
+	if w == nil {
+		return writer.WriteBuffer(buffer)
+	}
+	w.begin()
+	err := writer.WriteBuffer(buffer)
+	return common.AnyError(err, w.end())
+}
+
+func (w *aggregateWriter) begin() {
+	w.batchLock.Lock()
+	w.access.Lock()
+	w.batching = true
+	w.access.Unlock()
+}
+
+func (w *aggregateWriter) end() error {
+	w.access.Lock()
+	err := w.flush()
+	w.batching = false
+	if w.buffer != nil {
+		w.pool.put(w.buffer)
+		w.buffer = nil
+	}
+	w.access.Unlock()
+	w.batchLock.Unlock()
+	return err
+}
+
+func (w *aggregateWriter) flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	_, err := w.upstream.Write(w.buffer)
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+func (w *aggregateWriter) collect(p []byte) error {
+	if len(w.buffer)+len(p) > w.pool.size {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+		if len(p) > w.pool.size {
+			return common.Error(w.upstream.Write(p))
+		}
+	}
+	if w.buffer == nil {
+		w.buffer = w.pool.get()
+	}
+	w.buffer = append(w.buffer, p...)
+	return nil
+}
+
+func (w *aggregateWriter) Write(p []byte) (n int, err error) {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if !w.batching {
+		return w.upstream.Write(p)
+	}
+	err = w.collect(p)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (w *aggregateWriter) WriteBuffer(buffer *buf.Buffer) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if !w.batching {
+		return w.upstream.WriteBuffer(buffer)
+	}
+	defer buffer.Release()
+	return w.collect(buffer.Bytes())
+}
+
+func (w *aggregateWriter) WriteVectorised(buffers []*buf.Buffer) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if !w.batching {
+		return w.vectorised.WriteVectorised(buffers)
+	}
+	defer buf.ReleaseMulti(buffers)
+	for _, buffer := range buffers {
+		err := w.collect(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *aggregateWriter) Upstream() any {
+	return w.upstream
+}
@@ -0,0 +1,16 @@
+package vmess
+
+import "golang.org/x/sys/unix"
+
+func allocAggregateBuffer(size int) []byte {
+	buffer, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return make([]byte, 0, size)
+	}
+	return buffer[:0]
+}
+
+func freeAggregateBuffer(buffer []byte) {
+	// heap buffers from a failed mapping are not tracked and left to the GC
+	_ = unix.Munmap(buffer[:cap(buffer)])
+}
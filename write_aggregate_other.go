@@ -0,0 +1,10 @@
+//go:build !linux
+
+package vmess
+
+func allocAggregateBuffer(size int) []byte {
+	return make([]byte, 0, size)
+}
+
+func freeAggregateBuffer(buffer []byte) {
+}
@@ -1,9 +1,14 @@
 package vmess
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
@@ -13,10 +18,40 @@ import (
 	N "github.com/sagernet/sing/common/network"
 )
 
+const XUDPGlobalIDLength = 8
+
+var (
+	xudpBaseKey     []byte
+	xudpBaseKeyOnce sync.Once
+)
+
+func XUDPGlobalID(source M.Socksaddr) (globalID [XUDPGlobalIDLength]byte) {
+	xudpBaseKeyOnce.Do(func() {
+		xudpBaseKey = make([]byte, 32)
+		common.Must1(io.ReadFull(rand.Reader, xudpBaseKey))
+	})
+	idHash := hmac.New(sha256.New, xudpBaseKey)
+	common.Must1(idHash.Write([]byte(source.String())))
+	copy(globalID[:], idHash.Sum(nil))
+	return
+}
+
+type xudpGlobalIDKey struct{}
+
+func ContextWithXUDPGlobalID(ctx context.Context, globalID [XUDPGlobalIDLength]byte) context.Context {
+	return context.WithValue(ctx, xudpGlobalIDKey{}, globalID)
+}
+
+func XUDPGlobalIDFromContext(ctx context.Context) ([XUDPGlobalIDLength]byte, bool) {
+	globalID, loaded := ctx.Value(xudpGlobalIDKey{}).([XUDPGlobalIDLength]byte)
+	return globalID, loaded
+}
+
 type XUDPConn struct {
 	net.Conn
 	writer         N.ExtendedWriter
 	destination    M.Socksaddr
+	globalID       *[XUDPGlobalIDLength]byte
 	requestWritten bool
 }
 
@@ -28,6 +63,15 @@ func NewXUDPConn(conn net.Conn, destination M.Socksaddr) *XUDPConn {
 	}
 }
 
+func NewXUDPConnWithGlobalID(conn net.Conn, destination M.Socksaddr, globalID [XUDPGlobalIDLength]byte) *XUDPConn {
+	return &XUDPConn{
+		Conn:        conn,
+		writer:      bufio.NewExtendedWriter(conn),
+		destination: destination,
+		globalID:    &globalID,
+	}
+}
+
 func (c *XUDPConn) Read(p []byte) (n int, err error) {
 	n, _, err = c.ReadFrom(p)
 	return
@@ -125,6 +169,9 @@ func (c *XUDPConn) frontHeadroom(addrLen int) int {
 		headerLen += 2 // frame len
 		headerLen += 5 // frame header
 		headerLen += addrLen
+		if c.globalID != nil {
+			headerLen += XUDPGlobalIDLength
+		}
 		headerLen += 2 // payload len
 		return headerLen
 	} else {
@@ -137,16 +184,23 @@ func (c *XUDPConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) erro
 	addrLen := M.SocksaddrSerializer.AddrPortLen(destination)
 	if !c.requestWritten {
 		header := buf.With(buffer.ExtendHeader(c.frontHeadroom(addrLen)))
+		metaLen := 5 + addrLen
+		if c.globalID != nil {
+			metaLen += XUDPGlobalIDLength
+		}
 		common.Must(
-			binary.Write(header, binary.BigEndian, uint16(5+addrLen)),
+			binary.Write(header, binary.BigEndian, uint16(metaLen)),
 			header.WriteByte(0),
 			header.WriteByte(0),
 			header.WriteByte(1), // frame type new
 			header.WriteByte(1), // option data
 			header.WriteByte(NetworkUDP),
 			AddressSerializer.WriteAddrPort(header, destination),
-			binary.Write(header, binary.BigEndian, uint16(dataLen)),
 		)
+		if c.globalID != nil {
+			common.Must1(header.Write(c.globalID[:]))
+		}
+		common.Must(binary.Write(header, binary.BigEndian, uint16(dataLen)))
 		c.requestWritten = true
 	} else {
 		header := buffer.ExtendHeader(c.frontHeadroom(addrLen))